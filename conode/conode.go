@@ -10,6 +10,11 @@
 //
 //  ./conode
 //
+// If the state of the ledgers is corrupted, it can be rebuilt from the
+// skipchains when starting the daemon with:
+//
+//  ./conode rebuild
+//
 package main
 
 import (
@@ -23,7 +28,7 @@ import (
 
 	"gopkg.in/dedis/cothority.v2"
 	// Import your service:
-	_ "github.com/dedis/student_18_omniledger/omniledger/service"
+	"github.com/dedis/student_18_omniledger/omniledger/service"
 	// Here you can import any other needed service for your conode.
 	// For example, if your service needs cosi available in the server
 	// as well, uncomment this:
@@ -60,6 +65,14 @@ func main() {
 				runServer(c)
 			},
 		},
+		{
+			Name:  "rebuild",
+			Usage: "Rebuild the state of all ledgers from the skipchains and start cothority server",
+			Action: func(c *cli.Context) {
+				service.RebuildCollections = true
+				runServer(c)
+			},
+		},
 	}
 	cliApp.Flags = []cli.Flag{
 		cli.IntFlag{
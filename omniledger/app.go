@@ -3,8 +3,11 @@
 package main
 
 import (
+	"encoding/hex"
 	"errors"
 	"os"
+	"sort"
+	"strings"
 
 	"github.com/dedis/student_18_omniledger/omniledger/darc"
 	"github.com/dedis/student_18_omniledger/omniledger/service"
@@ -29,6 +32,13 @@ func main() {
 			ArgsUsage: "group.toml",
 			Action:    create,
 		},
+		{
+			Name:      "analyze",
+			Usage:     "lists who can sign for the rules of a darc",
+			Aliases:   []string{"a"},
+			ArgsUsage: "group.toml skipchain-id darc-id [action]",
+			Action:    analyze,
+		},
 	}
 	cliApp.Flags = []cli.Flag{
 		cli.IntFlag{
@@ -71,6 +81,63 @@ func create(c *cli.Context) error {
 	return nil
 }
 
+// Lists the minimal sets of identities that can sign for the rules of a darc
+func analyze(c *cli.Context) error {
+	if c.NArg() < 3 {
+		return errors.New("please give: group.toml skipchain-id darc-id [action]")
+	}
+	group := readGroup(c)
+	scID, err := hex.DecodeString(c.Args().Get(1))
+	if err != nil {
+		return err
+	}
+	dID, err := hex.DecodeString(c.Args().Get(2))
+	if err != nil {
+		return err
+	}
+
+	client := service.NewClient()
+	d, err := client.GetDarc(group.Roster, scID, dID)
+	if err != nil {
+		return errors.New("couldn't get darc: " + err.Error())
+	}
+	// The delegated darcs are fetched from the ledger as well.
+	getDarc := func(id string) *darc.Darc {
+		buf, err := hex.DecodeString(strings.TrimPrefix(id, "darc:"))
+		if err != nil {
+			return nil
+		}
+		dd, err := client.GetDarc(group.Roster, scID, buf)
+		if err != nil {
+			log.Lvl2("couldn't get delegated darc:", err)
+			return nil
+		}
+		return dd
+	}
+
+	var actions []string
+	if c.NArg() > 3 {
+		actions = []string{c.Args().Get(3)}
+	} else {
+		for a := range d.Rules {
+			actions = append(actions, string(a))
+		}
+		sort.Strings(actions)
+	}
+	for _, a := range actions {
+		sets, err := d.SignerSets(darc.Action(a), getDarc)
+		if err != nil {
+			log.Infof("%s: %s", a, err)
+			continue
+		}
+		log.Infof("%s can be signed by:", a)
+		for _, set := range sets {
+			log.Infof("  %s", strings.Join(set, " & "))
+		}
+	}
+	return nil
+}
+
 // readGroup decodes the group given in the file with the name in the
 // first argument of the cli.Context.
 func readGroup(c *cli.Context) *app.Group {
@@ -5,6 +5,8 @@
 // distributed and decentralized ledgers with minimal bootstrapping time.
 package collection
 
+import "sync"
+
 // Collection represents the Merkle-tree based data structure.
 // The data is defined by a pointer to its root.
 type Collection struct {
@@ -17,6 +19,14 @@ type Collection struct {
 		ongoing bool
 		id      uint64
 	}
+
+	// storage is nil for the collections kept in memory.
+	storage *store
+
+	// mutex protects the nodes, which also change when reading a
+	// disk-backed collection. It is shared with the clones of the
+	// collection, which have nodes in common.
+	mutex *sync.Mutex
 }
 
 // Constructors
@@ -28,8 +38,11 @@ func New(fields ...Field) (collection Collection) {
 	collection.scope.All()
 	collection.autoCollect.Enable()
 
+	collection.mutex = new(sync.Mutex)
+
 	collection.root = new(node)
 	collection.root.known = true
+	collection.root.owner = newOwner()
 
 	collection.root.branch()
 
@@ -56,8 +69,11 @@ func NewVerifier(fields ...Field) (verifier Collection) {
 
 	empty := New(fields...)
 
+	verifier.mutex = new(sync.Mutex)
+
 	verifier.root = new(node)
 	verifier.root.known = false
+	verifier.root.owner = newOwner()
 	verifier.root.label = empty.root.label
 
 	return
@@ -65,14 +81,21 @@ func NewVerifier(fields ...Field) (verifier Collection) {
 
 // Methods
 
-// Clone returns a deep copy of the collection.
+// Clone returns a copy of the collection.
 // Note that the transaction id are restarted from 0 for the copy.
+// The nodes are shared by the collection and its copy until one of them
+// changes them, so that cloning takes constant time, and only the nodes on
+// the path of a change are copied.
+// Clone changes the collection too, as its root gets a new owner so that it
+// doesn't change the shared nodes anymore. Like all other operations, it takes
+// the lock of the collection, which is shared with the copy.
+// The clone of a disk-backed collection loads its nodes from the same
+// storage, which keeps them until the clone is closed with Close.
 func (c *Collection) Clone() (collection Collection) {
 	if c.transaction.ongoing {
 		panic("Cannot clone a collection while a transaction is ongoing.")
 	}
-
-	collection.root = new(node)
+	defer c.lock()()
 
 	collection.fields = make([]Field, len(c.fields))
 	copy(collection.fields, c.fields)
@@ -83,32 +106,52 @@ func (c *Collection) Clone() (collection Collection) {
 	collection.transaction.ongoing = false
 	collection.transaction.id = 0
 
-	var explore func(*node, *node)
-	explore = func(dstCursor *node, srcCursor *node) {
-		dstCursor.label = srcCursor.label
-		dstCursor.known = srcCursor.known
-
-		dstCursor.transaction.inconsistent = false
-		dstCursor.transaction.backup = nil
+	collection.mutex = c.mutex
 
-		dstCursor.key = srcCursor.key
-		dstCursor.values = make([][]byte, len(srcCursor.values))
-		copy(dstCursor.values, srcCursor.values)
-
-		if !(srcCursor.leaf()) {
-			dstCursor.branch()
-			explore(dstCursor.children.left, srcCursor.children.left)
-			explore(dstCursor.children.right, srcCursor.children.right)
-		}
+	if c.storage != nil {
+		collection.storage = c.storage.clone()
 	}
 
-	explore(collection.root, c.root)
+	// Neither the collection nor its copy can change the nodes they share
+	// anymore, only their own root.
+	c.root.owner = newOwner()
+
+	collection.root = c.root.copy()
+	collection.root.owner = newOwner()
 
 	return
 }
 
+// Close releases a clone of a disk-backed collection, so that the nodes it
+// shares with the collection are not kept in the storage for it anymore. The
+// clone must not be used after it is closed. Close does nothing for the other
+// collections.
+func (c *Collection) Close() {
+	if c.storage == nil || !(c.storage.cloned) || c.storage.closed {
+		return
+	}
+	defer c.lock()()
+
+	c.storage.closed = true
+	c.storage.cache.clones--
+	c.storage.untrack(c.root)
+}
+
 // GetRoot returns the root hash of the collection, which cryptographically
 // represents the whole set of key/value pairs in the collection.
 func (c *Collection) GetRoot() []byte {
 	return c.root.key
 }
+
+// Private methods
+
+// lock locks the nodes of the collection and returns the function to unlock
+// them.
+func (c *Collection) lock() func() {
+	if c.mutex == nil {
+		return func() {}
+	}
+
+	c.mutex.Lock()
+	return c.mutex.Unlock
+}
@@ -168,3 +168,228 @@ func TestCollectionClone(test *testing.T) {
 		collection.End()
 	})
 }
+
+func TestCollectionCloneShared(test *testing.T) {
+	ctx := testCtx("[collection.go]", test)
+
+	stake64 := Stake64{}
+	data := Data{}
+
+	collection := New(stake64, data)
+
+	for index := 0; index < 512; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		collection.Add(key, uint64(index), key)
+	}
+
+	label := collection.root.label
+	clone := collection.Clone()
+
+	if clone.root == collection.root || clone.root.children.left != collection.root.children.left {
+		test.Error("[collection.go]", "[clone]", "Clone does not share the nodes below the root.")
+	}
+
+	for index := 0; index < 512; index += 2 {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		clone.Set(key, uint64(index+1), key)
+	}
+
+	for index := 512; index < 1024; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		collection.Add(key, uint64(index), key)
+	}
+
+	ctx.verify.tree("[collection]", &collection)
+	ctx.verify.tree("[clone]", &clone)
+
+	for index := 0; index < 512; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		ctx.verify.values("[collection]", &collection, key, uint64(index), key)
+
+		if index%2 == 0 {
+			ctx.verify.values("[clone]", &clone, key, uint64(index+1), key)
+		} else {
+			ctx.verify.values("[clone]", &clone, key, uint64(index), key)
+		}
+	}
+
+	for index := 512; index < 1024; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		ctx.verify.values("[collection]", &collection, key, uint64(index), key)
+		ctx.verify.noKey("[clone]", &clone, key)
+	}
+
+	// Changes rolled back in a clone leave the collection untouched.
+	again := clone.Clone()
+	again.Begin()
+	for index := 0; index < 512; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		again.Remove(key)
+	}
+	again.Rollback()
+
+	ctx.verify.tree("[again]", &again)
+	if again.root.label != clone.root.label {
+		test.Error("[collection.go]", "[clone]", "Rollback in a clone does not restore its root.")
+	}
+
+	for index := 0; index < 512; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		again.Remove(key)
+	}
+
+	ctx.verify.tree("[clone]", &clone)
+	if clone.root.label == again.root.label {
+		test.Error("[collection.go]", "[clone]", "Removing keys from a clone changes the collection.")
+	}
+
+	// Collecting the nodes out of the scope of a clone keeps them in the
+	// collection.
+	scoped := collection.Clone()
+	scoped.scope.None()
+	scoped.scope.Add([]byte{0xff}, 1)
+	scoped.Collect()
+
+	ctx.verify.scope("[scoped]", &scoped)
+	for index := 0; index < 1024; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		ctx.verify.values("[collection]", &collection, key, uint64(index), key)
+	}
+
+	// Leaves moved up when removing their siblings from a clone don't share
+	// their values with the collection.
+	collapsed := collection.Clone()
+	for index := 0; index < 1024; index += 2 {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		collapsed.Remove(key)
+	}
+	for index := 1; index < 1024; index += 2 {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		collapsed.SetField(key, 0, uint64(0))
+	}
+
+	ctx.verify.tree("[collapsed]", &collapsed)
+	for index := 0; index < 1024; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		ctx.verify.values("[collection]", &collection, key, uint64(index), key)
+	}
+
+	if label == collection.root.label {
+		test.Error("[collection.go]", "[clone]", "Adding keys to the collection doesn't change its root.")
+	}
+}
+
+func TestCollectionCloneConcurrent(test *testing.T) {
+	stake64 := Stake64{}
+	collection := New(stake64)
+
+	// Cloning gives a new owner to the root of the collection, while it
+	// is changed by another goroutine.
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for index := 0; index < 256; index++ {
+			clone := collection.Clone()
+			clone.Add([]byte("clone"), uint64(index))
+		}
+	}()
+	for index := 0; index < 256; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		collection.Add(key, uint64(index))
+	}
+	<-done
+
+	for index := 0; index < 256; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		record, err := collection.Get(key).Record()
+		if err != nil || !(record.Match()) {
+			test.Error("[collection.go]", "[clone]", "Cloning concurrently loses keys of the collection.")
+		}
+	}
+}
+
+// deepClone copies all the nodes of the collection, which is what Clone did
+// before the nodes were shared.
+func deepClone(c *Collection) (collection Collection) {
+	collection = New(c.fields...)
+
+	var explore func(*node, *node)
+	explore = func(dstCursor *node, srcCursor *node) {
+		dstCursor.label = srcCursor.label
+		dstCursor.known = srcCursor.known
+
+		dstCursor.key = srcCursor.key
+		dstCursor.values = make([][]byte, len(srcCursor.values))
+		copy(dstCursor.values, srcCursor.values)
+
+		if !(srcCursor.leaf()) {
+			dstCursor.branch()
+			explore(dstCursor.children.left, srcCursor.children.left)
+			explore(dstCursor.children.right, srcCursor.children.right)
+		} else {
+			dstCursor.prune()
+		}
+	}
+
+	explore(collection.root, c.root)
+
+	return
+}
+
+func benchmarkCollection(size int) Collection {
+	collection := New(Data{})
+
+	for index := 0; index < size; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		collection.Add(key, key)
+	}
+
+	return collection
+}
+
+func benchmarkClone(b *testing.B, size int, clone func(*Collection) Collection) {
+	collection := benchmarkCollection(size)
+	key := []byte("benchmark")
+
+	b.ResetTimer()
+	for index := 0; index < b.N; index++ {
+		copied := clone(&collection)
+		copied.Add(key, key)
+	}
+}
+
+func BenchmarkCollectionClone(b *testing.B) {
+	benchmarkClone(b, 1<<14, (*Collection).Clone)
+}
+
+func BenchmarkCollectionCloneDeep(b *testing.B) {
+	benchmarkClone(b, 1<<14, deepClone)
+}
@@ -29,13 +29,16 @@ func (g Getter) Record() (Record, error) {
 	if len(g.key) == 0 {
 		return Record{}, errors.New("cannot create a record with no key")
 	}
+	defer g.collection.lock()()
+	defer g.collection.evict()
+
 	path := sha256.Sum256(g.key)
 
 	depth := 0
 	cursor := g.collection.root
 
 	for {
-		if !(cursor.known) {
+		if !(g.collection.fetch(cursor)) {
 			return Record{}, errors.New("record lies in an unknown subtree")
 		}
 
@@ -62,24 +65,33 @@ func (g Getter) Proof() (Proof, error) {
 	if len(g.key) == 0 {
 		return Proof{}, errors.New("cannot create a proof with no key")
 	}
+	defer g.collection.lock()()
+	defer g.collection.evict()
+
+	return g.collection.proof(g.key)
+}
+
+// proof returns the Proof of the given key. The caller must hold the lock of
+// the collection.
+func (c *Collection) proof(key []byte) (Proof, error) {
 	var proof Proof
 
-	proof.collection = g.collection
-	proof.Key = g.key
+	proof.collection = c
+	proof.Key = key
 
-	proof.Root = dumpNode(g.collection.root)
+	proof.Root = dumpNode(c.root)
 
-	path := sha256.Sum256(g.key)
+	path := sha256.Sum256(key)
 
 	depth := 0
-	cursor := g.collection.root
+	cursor := c.root
 
-	if !(cursor.known) {
+	if !(c.fetch(cursor)) {
 		return proof, errors.New("record lies in unknown subtree")
 	}
 
 	for {
-		if !(cursor.children.left.known) || !(cursor.children.right.known) {
+		if !(c.fetch(cursor.children.left)) || !(c.fetch(cursor.children.right)) {
 			return proof, errors.New("record lies in unknown subtree")
 		}
 
@@ -28,28 +28,27 @@ func (c *Collection) Add(key []byte, values ...interface{}) error {
 		rawValues[index] = field.Encode(values[index])
 	}
 
+	defer c.lock()()
+	defer c.evict()
+
 	path := sha256.Sum256(key)
 
 	depth := 0
 	cursor := c.root
 
-	if !(cursor.known) {
+	if !(c.fetch(cursor)) {
 		return errors.New("applying update to unknown subtree. Proof needed")
 	}
 
 	for {
-		if !(cursor.children.left.known) || !(cursor.children.right.known) {
+		if !(c.fetch(cursor.children.left)) || !(c.fetch(cursor.children.right)) {
 			return errors.New("applying update to unknown subtree. Proof needed")
 		}
 
 		step := bit(path[:], depth)
 		depth++
 
-		if step == Right {
-			cursor = cursor.children.right
-		} else {
-			cursor = cursor.children.left
-		}
+		cursor = c.child(cursor, step)
 
 		if cursor.placeholder() {
 			if c.transaction.ongoing {
@@ -87,6 +86,7 @@ func (c *Collection) Add(key []byte, values ...interface{}) error {
 			}
 
 			validNode.known = true
+			validNode.stored = collision.stored
 			validNode.label = collision.label
 			validNode.key = collision.key
 			validNode.values = collision.values
@@ -126,28 +126,27 @@ func (c *Collection) Set(key []byte, values ...interface{}) error {
 		panic("wrong number of values provided")
 	}
 
+	defer c.lock()()
+	defer c.evict()
+
 	path := sha256.Sum256(key)
 
 	depth := 0
 	cursor := c.root
 
-	if !(cursor.known) {
+	if !(c.fetch(cursor)) {
 		return errors.New("applying update to unknown subtree. Proof needed")
 	}
 
 	for {
-		if !(cursor.children.left.known) || !(cursor.children.right.known) {
+		if !(c.fetch(cursor.children.left)) || !(c.fetch(cursor.children.right)) {
 			return errors.New("applying update to unknown subtree. Proof needed")
 		}
 
 		step := bit(path[:], depth)
 		depth++
 
-		if step {
-			cursor = cursor.children.right
-		} else {
-			cursor = cursor.children.left
-		}
+		cursor = c.child(cursor, step)
 
 		if cursor.leaf() {
 			if !(equal(cursor.key, key)) {
@@ -216,28 +215,27 @@ func (c *Collection) SetField(key []byte, field int, value interface{}) error {
 // except if the collection contains no more data.
 // Note that the removed key/pair value must be present in the known tree, otherwise an error is thrown.
 func (c *Collection) Remove(key []byte) error {
+	defer c.lock()()
+	defer c.evict()
+
 	path := sha256.Sum256(key)
 
 	depth := 0
 	cursor := c.root
 
-	if !(cursor.known) {
+	if !(c.fetch(cursor)) {
 		return errors.New("applying update to unknown subtree. Proof needed")
 	}
 
 	for {
-		if !(cursor.children.left.known) || !(cursor.children.right.known) {
+		if !(c.fetch(cursor.children.left)) || !(c.fetch(cursor.children.right)) {
 			return errors.New("applying update to unknown subtree. Proof needed")
 		}
 
 		step := bit(path[:], depth)
 		depth++
 
-		if step {
-			cursor = cursor.children.right
-		} else {
-			cursor = cursor.children.left
-		}
+		cursor = c.child(cursor, step)
 
 		if cursor.leaf() {
 			if !(equal(cursor.key, key)) {
@@ -268,13 +266,17 @@ func (c *Collection) Remove(key []byte) error {
 			}
 
 			if cursor.children.left.placeholder() {
+				cursor.stored = cursor.children.right.stored
 				cursor.label = cursor.children.right.label
 				cursor.key = cursor.children.right.key
-				cursor.values = cursor.children.right.values
+				cursor.values = make([][]byte, len(cursor.children.right.values))
+				copy(cursor.values, cursor.children.right.values)
 			} else {
+				cursor.stored = cursor.children.left.stored
 				cursor.label = cursor.children.left.label
 				cursor.key = cursor.children.left.key
-				cursor.values = cursor.children.left.values
+				cursor.values = make([][]byte, len(cursor.children.left.values))
+				copy(cursor.values, cursor.children.left.values)
 			}
 
 			cursor.prune()
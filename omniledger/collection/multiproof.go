@@ -0,0 +1,109 @@
+package collection
+
+import (
+	"errors"
+)
+
+// multiPath
+
+type multiPath struct {
+	Steps []int
+}
+
+// MultiProof
+
+// MultiProof is an object representing the proofs of presence or absence of
+// several keys in the same collection. The steps that the proofs have in
+// common, like the ones close to the root, are stored only once.
+type MultiProof struct {
+	Keys  [][]byte    // Keys are the keys that this proof is representing
+	Root  dump        // Root is the root node
+	Steps []step      // Steps are the distinct steps of all the proofs
+	Paths []multiPath // Paths hold the indexes of the steps to go from root to every key
+
+	collection *Collection
+}
+
+// Constructors
+
+// Proofs returns a MultiProof for all the given keys. It returns an error if
+// one of the proofs cannot be created. All proofs are created under the same
+// lock, so they start from the same root.
+func (c *Collection) Proofs(keys ...[]byte) (MultiProof, error) {
+	for _, key := range keys {
+		if len(key) == 0 {
+			return MultiProof{}, errors.New("cannot create a proof with no key")
+		}
+	}
+	defer c.lock()()
+	defer c.evict()
+
+	multi := MultiProof{collection: c, Root: dumpNode(c.root)}
+	indexes := make(map[[2][32]byte]int)
+
+	for _, key := range keys {
+		proof, err := c.proof(key)
+		if err != nil {
+			return MultiProof{}, err
+		}
+
+		var path multiPath
+		for _, s := range proof.Steps {
+			id := [2][32]byte{s.Left.Label, s.Right.Label}
+			index, ok := indexes[id]
+			if !ok {
+				index = len(multi.Steps)
+				indexes[id] = index
+				multi.Steps = append(multi.Steps, s)
+			}
+			path.Steps = append(path.Steps, index)
+		}
+
+		multi.Keys = append(multi.Keys, key)
+		multi.Paths = append(multi.Paths, path)
+	}
+
+	return multi, nil
+}
+
+// Getters
+
+// TreeRootHash returns the hash of the merkle tree root.
+func (m MultiProof) TreeRootHash() []byte {
+	return m.Root.Key
+}
+
+// Methods
+
+// Proof returns the proof of the key with the given index.
+func (m MultiProof) Proof(index int) (Proof, error) {
+	if index < 0 || index >= len(m.Keys) || len(m.Paths) != len(m.Keys) {
+		return Proof{}, errors.New("no such key in the proof")
+	}
+
+	proof := Proof{Key: m.Keys[index], Root: m.Root, collection: m.collection}
+	for _, s := range m.Paths[index].Steps {
+		if s < 0 || s >= len(m.Steps) {
+			return Proof{}, errors.New("step out of range")
+		}
+		proof.Steps = append(proof.Steps, m.Steps[s])
+	}
+
+	return proof, nil
+}
+
+// Consistent returns true if the proofs of all keys are consistent.
+func (m MultiProof) Consistent() bool {
+	if len(m.Keys) == 0 || len(m.Paths) != len(m.Keys) {
+		return false
+	}
+
+	for index := range m.Keys {
+		proof, err := m.Proof(index)
+		if err != nil || !(proof.Consistent()) {
+			return false
+		}
+	}
+
+	return true
+}
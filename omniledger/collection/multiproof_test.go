@@ -0,0 +1,105 @@
+package collection
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/dedis/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiProof(test *testing.T) {
+	stake64 := Stake64{}
+	collection := New(stake64)
+
+	for index := 0; index < 512; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		collection.Add(key, uint64(index))
+	}
+
+	var keys [][]byte
+	for index := 0; index < 1024; index += 16 {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+		keys = append(keys, key)
+	}
+
+	multi, err := collection.Proofs(keys...)
+	require.Nil(test, err)
+	require.True(test, multi.Consistent())
+	require.Equal(test, collection.root.label, multi.Root.Label)
+
+	var total int
+	for index, key := range keys {
+		proof, err := multi.Proof(index)
+		require.Nil(test, err)
+		single, err := collection.Get(key).Proof()
+		require.Nil(test, err)
+		require.Equal(test, single.Key, proof.Key)
+		require.Equal(test, single.Steps, proof.Steps)
+		require.Equal(test, index < 32, proof.Match())
+		require.True(test, collection.Verify(proof))
+		total += len(single.Steps)
+	}
+	require.True(test, len(multi.Steps) < total)
+
+	_, err = multi.Proof(len(keys))
+	require.NotNil(test, err)
+	_, err = collection.Proofs([]byte{})
+	require.NotNil(test, err)
+	require.False(test, MultiProof{}.Consistent())
+
+	buf, err := protobuf.Encode(&multi)
+	require.Nil(test, err)
+	var decoded MultiProof
+	require.Nil(test, protobuf.Decode(buf, &decoded))
+	require.True(test, decoded.Consistent())
+
+	decoded.Steps[len(decoded.Steps)-1].Left.Label[0]++
+	require.False(test, decoded.Consistent())
+	decoded.Steps[len(decoded.Steps)-1].Left.Label[0]--
+
+	decoded.Paths[0].Steps[0] = len(decoded.Steps)
+	require.False(test, decoded.Consistent())
+	_, err = decoded.Proof(0)
+	require.NotNil(test, err)
+}
+
+func TestMultiProofConcurrent(test *testing.T) {
+	stake64 := Stake64{}
+	collection := New(stake64)
+
+	var keys [][]byte
+	for index := 0; index < 64; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+		keys = append(keys, key)
+
+		collection.Add(key, uint64(index))
+	}
+
+	// The proofs of all keys start from the same root, even if the
+	// collection is changed by another goroutine.
+	stop := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for index := 0; ; index++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			collection.Set(keys[index%len(keys)], uint64(index))
+		}
+	}()
+	for index := 0; index < 64; index++ {
+		multi, err := collection.Proofs(keys...)
+		require.Nil(test, err)
+		require.True(test, multi.Consistent())
+	}
+	close(stop)
+	<-done
+}
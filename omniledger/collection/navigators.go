@@ -26,17 +26,20 @@ func (c *Collection) Navigate(field int, value interface{}) Navigator {
 // Record returns the Record obtained by navigating the tree to the searched field's value.
 // It returns an error if the value in question is in an unknown subtree or if the Navigate function of the field returns an error.
 func (n Navigator) Record() (Record, error) {
+	defer n.collection.lock()()
+	defer n.collection.evict()
+
 	cursor := n.collection.root
 
 	for {
-		if !(cursor.known) {
+		if !(n.collection.fetch(cursor)) {
 			return Record{}, errors.New("record lies in an unknown subtree")
 		}
 
 		if cursor.leaf() {
 			return recordQueryMatch(n.collection, n.field, n.query, cursor), nil
 		}
-		if !(cursor.children.left.known) || !(cursor.children.right.known) {
+		if !(n.collection.fetch(cursor.children.left)) || !(n.collection.fetch(cursor.children.right)) {
 			return Record{}, errors.New("record lies in an unknown subtree")
 		}
 
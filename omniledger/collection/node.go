@@ -1,12 +1,25 @@
 package collection
 
-import "crypto/sha256"
+import (
+	"crypto/sha256"
+	"sync/atomic"
+)
+
+// owners is the number of owners given to collections so far.
+var owners uint64
 
 //A node represents one element of the Merkle tree like data-structure.
 type node struct {
 	label [sha256.Size]byte
 
 	known bool
+	// stored is true if the node is in the storage of a disk-backed
+	// collection.
+	stored bool
+	// owner identifies the collection that can change the node in place.
+	// The owner of a collection is the one of its root. Nodes with another
+	// owner are shared with clones of the collection.
+	owner uint64
 
 	transaction struct {
 		inconsistent bool
@@ -23,6 +36,13 @@ type node struct {
 	}
 }
 
+// Constructors
+
+// newOwner returns an owner that was not given to any other collection.
+func newOwner() uint64 {
+	return atomic.AddUint64(&owners, 1)
+}
+
 // Getters
 
 func (n *node) root() bool {
@@ -39,21 +59,31 @@ func (n *node) placeholder() bool {
 
 // Methods
 
-func (n *node) backup() {
-	if n.transaction.backup == nil {
-		n.transaction.backup = new(node)
+// copy returns a copy of the node outside of any transaction, which has the
+// same children.
+func (n *node) copy() *node {
+	copied := new(node)
 
-		n.transaction.backup.label = n.label
-		n.transaction.backup.known = n.known
-		n.transaction.backup.transaction.inconsistent = n.transaction.inconsistent
+	copied.label = n.label
+	copied.known = n.known
+	copied.stored = n.stored
+	copied.owner = n.owner
 
-		n.transaction.backup.key = n.key
-		n.transaction.backup.values = make([][]byte, len(n.values))
-		copy(n.transaction.backup.values, n.values)
+	copied.key = n.key
+	copied.values = make([][]byte, len(n.values))
+	copy(copied.values, n.values)
 
-		n.transaction.backup.parent = n.parent
-		n.transaction.backup.children.left = n.children.left
-		n.transaction.backup.children.right = n.children.right
+	copied.parent = n.parent
+	copied.children.left = n.children.left
+	copied.children.right = n.children.right
+
+	return copied
+}
+
+func (n *node) backup() {
+	if n.transaction.backup == nil {
+		n.transaction.backup = n.copy()
+		n.transaction.backup.transaction.inconsistent = n.transaction.inconsistent
 	}
 }
 
@@ -71,6 +101,9 @@ func (n *node) branch() {
 
 	n.children.left.parent = n
 	n.children.right.parent = n
+
+	n.children.left.owner = n.owner
+	n.children.right.owner = n.owner
 }
 
 func (n *node) prune() {
@@ -25,7 +25,9 @@ type dump struct {
 
 func dumpNode(node *node) (dump dump) {
 	dump.Label = node.label
-	dump.Values = node.values
+	// Set replaces the values of a node in place, so the dump gets its
+	// own slice.
+	dump.Values = append([][]byte{}, node.values...)
 
 	if node.leaf() {
 		dump.Key = node.key
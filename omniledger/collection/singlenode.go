@@ -41,11 +41,59 @@ func (c *Collection) update(node *node) error {
 	}
 
 	label := node.generateHash()
+	if label != node.label {
+		node.stored = false
+	}
 	node.label = label
 
 	return nil
 }
 
+// own returns the node if it belongs to the collection. Otherwise the node is
+// shared with clones of the collection, and a copy of it that belongs to the
+// collection is returned instead. The copy still has the parent of the node.
+func (c *Collection) own(node *node) *node {
+	if node.owner == c.root.owner {
+		return node
+	}
+
+	copied := node.copy()
+	copied.owner = c.root.owner
+
+	return copied
+}
+
+// child returns the child of the node on the given side, after making it
+// belong to the collection. The node must belong to the collection.
+func (c *Collection) child(node *node, side bool) *node {
+	if side == Right {
+		node.children.right = c.own(node.children.right)
+		node.children.right.parent = node
+
+		return node.children.right
+	}
+
+	node.children.left = c.own(node.children.left)
+	node.children.left.parent = node
+
+	return node.children.left
+}
+
+// replace sets the children of the node, which must belong to the
+// collection. Only the children that changed get the node as parent, the
+// others can be shared with clones of the collection.
+func (c *Collection) replace(node *node, left *node, right *node) {
+	if left != node.children.left {
+		node.children.left = left
+		left.parent = node
+	}
+
+	if right != node.children.right {
+		node.children.right = right
+		right.parent = node
+	}
+}
+
 func (c *Collection) setPlaceholder(node *node) error {
 	node.known = true
 	node.key = []byte{}
@@ -0,0 +1,457 @@
+package collection
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/dedis/protobuf"
+)
+
+// Storage is a key/value store holding the nodes of a disk-backed collection.
+type Storage interface {
+	// Get returns the value stored under the key, or nil if there is none.
+	Get(key []byte) ([]byte, error)
+	// Write stores all the values of the batch at once. A nil value
+	// removes the key.
+	Write(batch map[string][]byte) error
+}
+
+// storedNode is the value stored for every node under its label. Nodes with
+// the same label are stored only once. References counts the nodes and the
+// root pointing to it, so that it is removed once it is not part of the
+// collection anymore.
+type storedNode struct {
+	References int
+	Node       dump
+}
+
+// rootKey is the key under which the label of the root is stored.
+var rootKey = []byte("root")
+
+// removedKey is the key under which the labels of the nodes that are kept
+// for the clones of the collection are stored.
+var removedKey = []byte("removed")
+
+// store
+
+// store is the part of a disk-backed collection that keeps track of the
+// nodes in memory.
+type store struct {
+	backend Storage
+
+	// root is the label of the root in the backend.
+	root [sha256.Size]byte
+	// cloned is true for the clones of a collection, which cannot be
+	// flushed. closed is true once a clone is closed.
+	cloned bool
+	closed bool
+	// removed holds the labels of the nodes that are not part of the
+	// collection anymore, but are kept in the backend until all clones
+	// are closed.
+	removed [][sha256.Size]byte
+
+	// cache is shared by the collection and its clones.
+	cache *cache
+}
+
+// cache holds the nodes known by a collection and its clones, so that the
+// nodes loaded by a clone are unloaded like the ones of the collection.
+type cache struct {
+	capacity int
+
+	// lru holds the known stored nodes, the most recently used first.
+	lru      *list.List
+	elements map[*node]*list.Element
+
+	// clones is the number of clones that are not closed yet.
+	clones int
+}
+
+// Constructors
+
+func newStore(backend Storage, capacity int) *store {
+	return &store{
+		backend: backend,
+		cache: &cache{
+			capacity: capacity,
+			lru:      list.New(),
+			elements: make(map[*node]*list.Element),
+		},
+	}
+}
+
+// NewStored creates a disk-backed collection, whose nodes are kept in the
+// storage and only loaded in memory when they are needed. If the storage
+// already holds a collection, it is used; otherwise an empty collection with
+// the given fields is stored. Changes are written to the storage by Flush.
+// At most cacheSize nodes are kept in memory between the operations by the
+// collection and its clones, except for the nodes that are not flushed yet.
+func NewStored(storage Storage, cacheSize int, fields ...Field) (Collection, error) {
+	collection := New(fields...)
+	collection.storage = newStore(storage, cacheSize)
+
+	label, err := storage.Get(rootKey)
+	if err != nil {
+		return Collection{}, err
+	}
+	if label == nil {
+		return collection, collection.Flush()
+	}
+	if len(label) != sha256.Size {
+		return Collection{}, errors.New("invalid root label in storage")
+	}
+
+	removed, err := storage.Get(removedKey)
+	if err != nil {
+		return Collection{}, err
+	}
+	if len(removed)%sha256.Size != 0 {
+		return Collection{}, errors.New("invalid removed labels in storage")
+	}
+	for ; len(removed) > 0; removed = removed[sha256.Size:] {
+		var removedLabel [sha256.Size]byte
+		copy(removedLabel[:], removed)
+		collection.storage.removed = append(collection.storage.removed, removedLabel)
+	}
+
+	collection.root = new(node)
+	collection.root.owner = newOwner()
+	copy(collection.root.label[:], label)
+	collection.storage.root = collection.root.label
+	if !(collection.fetch(collection.root)) {
+		return Collection{}, errors.New("couldn't load the root from storage")
+	}
+
+	return collection, nil
+}
+
+// Methods
+
+// Flush writes the nodes that changed since the last flush to the storage of
+// a disk-backed collection, and removes the nodes that are not part of the
+// collection anymore. All changes are written in one batch. It does nothing
+// for collections kept in memory.
+// While clones of the collection are not closed, they can still load the
+// nodes that are not part of the collection anymore. These nodes are only
+// removed by the first flush after all clones are closed.
+func (c *Collection) Flush() error {
+	if c.storage == nil {
+		return nil
+	}
+	if c.transaction.ongoing {
+		panic("Cannot flush a collection while a transaction is ongoing.")
+	}
+	if c.storage.cloned {
+		return errors.New("cannot flush a clone")
+	}
+	defer c.lock()()
+
+	b := &batch{
+		backend: c.storage.backend,
+		nodes:   make(map[[sha256.Size]byte]*storedNode),
+		keep:    c.storage.cache.clones > 0,
+	}
+	var persisted []*node
+	if err := b.persist(c.root, &persisted); err != nil {
+		return err
+	}
+
+	if c.root.label != c.storage.root {
+		if err := b.reference(c.root.label, 1); err != nil {
+			return err
+		}
+		var empty [sha256.Size]byte
+		if c.storage.root != empty {
+			if err := b.reference(c.storage.root, -1); err != nil {
+				return err
+			}
+		}
+	}
+
+	removed := append(c.storage.removed, b.removed...)
+	if !(b.keep) {
+		for _, label := range removed {
+			if err := b.remove(label); err != nil {
+				return err
+			}
+		}
+		removed = nil
+	}
+
+	writes, err := b.writes()
+	if err != nil {
+		return err
+	}
+	writes[string(rootKey)] = append([]byte{}, c.root.label[:]...)
+	writes[string(removedKey)] = nil
+	for _, label := range removed {
+		writes[string(removedKey)] = append(writes[string(removedKey)], label[:]...)
+	}
+	if err := c.storage.backend.Write(writes); err != nil {
+		return err
+	}
+
+	c.storage.root = c.root.label
+	c.storage.removed = removed
+	for _, n := range persisted {
+		n.stored = true
+		c.storage.touch(n)
+	}
+	c.storage.forget()
+	c.evict()
+
+	return nil
+}
+
+// Private methods
+
+// fetch returns true if the node is known, after loading it from the storage
+// of a disk-backed collection if needed.
+func (c *Collection) fetch(n *node) bool {
+	if c.storage == nil {
+		return n.known
+	}
+
+	if !(n.known) {
+		c.storage.load(n)
+	}
+	if n.known && n.stored {
+		c.storage.touch(n)
+	}
+
+	return n.known
+}
+
+// evict removes the least recently used nodes from memory, until at most
+// capacity nodes are known by the collection and its clones. The stored nodes
+// can be loaded again by all of them, so they can be removed unless they are a
+// root or they are changed by a transaction. Nothing is removed during a
+// transaction of the collection.
+func (c *Collection) evict() {
+	if c.storage == nil || c.transaction.ongoing {
+		return
+	}
+
+	s := c.storage.cache
+	for element := s.lru.Back(); element != nil && s.lru.Len() > s.capacity; {
+		n := element.Value.(*node)
+		previous := element.Prev()
+		if n.stored && !(n.root()) && !(n.transaction.inconsistent) && n.transaction.backup == nil {
+			c.storage.unload(n)
+		}
+		element = previous
+	}
+}
+
+// store
+
+// Methods
+
+func (s *store) clone() *store {
+	s.cache.clones++
+
+	return &store{
+		backend: s.backend,
+		root:    s.root,
+		cloned:  true,
+		cache:   s.cache,
+	}
+}
+
+// Private methods
+
+func (s *store) touch(n *node) {
+	if element, ok := s.cache.elements[n]; ok {
+		s.cache.lru.MoveToFront(element)
+	} else {
+		s.cache.elements[n] = s.cache.lru.PushFront(n)
+	}
+}
+
+// untrack removes the node from the recently used ones.
+func (s *store) untrack(n *node) {
+	if element, ok := s.cache.elements[n]; ok {
+		s.cache.lru.Remove(element)
+		delete(s.cache.elements, n)
+	}
+}
+
+// forget removes the nodes that are not stored from the recently used ones.
+// After a flush, they are not part of the collection anymore.
+func (s *store) forget() {
+	for element := s.cache.lru.Front(); element != nil; {
+		next := element.Next()
+		if n := element.Value.(*node); !(n.stored) {
+			s.untrack(n)
+		}
+		element = next
+	}
+}
+
+// load makes the node known from the storage. The node stays unknown if it
+// cannot be loaded.
+func (s *store) load(n *node) {
+	buffer, err := s.backend.Get(n.label[:])
+	if err != nil || buffer == nil {
+		return
+	}
+
+	var stored storedNode
+	if err = protobuf.Decode(buffer, &stored); err != nil {
+		return
+	}
+	if stored.Node.Label != n.label || !(stored.Node.consistent()) {
+		return
+	}
+
+	stored.Node.to(n)
+	n.stored = true
+}
+
+// unload makes the node unknown, keeping only its label. Its children stay in
+// memory while they are used by other nodes, like the copies made for the
+// clones of the collection.
+func (s *store) unload(n *node) {
+	s.untrack(n)
+
+	n.known = false
+	n.key = []byte{}
+	n.values = [][]byte{}
+	n.prune()
+}
+
+// batch
+
+// batch collects the changes of a flush.
+type batch struct {
+	backend Storage
+	// nodes holds the changed nodes, nil for the removed ones.
+	nodes map[[sha256.Size]byte]*storedNode
+
+	// keep is true if the nodes without references are kept for the
+	// clones of the collection. Their labels are added to removed.
+	keep    bool
+	removed [][sha256.Size]byte
+}
+
+// Private methods
+
+func (b *batch) get(label [sha256.Size]byte) (*storedNode, error) {
+	if stored, ok := b.nodes[label]; ok {
+		return stored, nil
+	}
+
+	buffer, err := b.backend.Get(label[:])
+	if err != nil || buffer == nil {
+		return nil, err
+	}
+
+	stored := &storedNode{}
+	if err = protobuf.Decode(buffer, stored); err != nil {
+		return nil, err
+	}
+
+	return stored, nil
+}
+
+// persist adds the node and its children to the batch if they are not
+// stored yet. The nodes that are known but were not stored are added to
+// persisted. The children of a node that is already in the storage are
+// in it too, so they are only added to persisted.
+func (b *batch) persist(n *node, persisted *[]*node) error {
+	if !(n.known) || n.stored {
+		return nil
+	}
+
+	stored, err := b.get(n.label)
+	if err != nil {
+		return err
+	}
+
+	if !(n.leaf()) {
+		for _, child := range []*node{n.children.left, n.children.right} {
+			if err = b.persist(child, persisted); err != nil {
+				return err
+			}
+			if stored != nil {
+				continue
+			}
+			if err = b.reference(child.label, 1); err != nil {
+				return err
+			}
+		}
+	}
+	if stored == nil {
+		b.nodes[n.label] = &storedNode{0, dumpNode(n)}
+	}
+
+	*persisted = append(*persisted, n)
+	return nil
+}
+
+// reference changes the number of references of the node with the given
+// label. Nodes without references are removed, together with their
+// references to their children, unless they are kept for the clones.
+func (b *batch) reference(label [sha256.Size]byte, delta int) error {
+	stored, err := b.get(label)
+	if err != nil {
+		return err
+	}
+	if stored == nil {
+		return errors.New("node missing in storage")
+	}
+
+	stored.References += delta
+	b.nodes[label] = stored
+	if stored.References > 0 {
+		return nil
+	}
+	if b.keep {
+		b.removed = append(b.removed, label)
+		return nil
+	}
+
+	return b.remove(label)
+}
+
+// remove removes the node with the given label if it has no references
+// anymore, together with its references to its children. Nodes that were
+// kept for the clones might have been referenced again since.
+func (b *batch) remove(label [sha256.Size]byte) error {
+	stored, err := b.get(label)
+	if err != nil || stored == nil || stored.References > 0 {
+		return err
+	}
+
+	b.nodes[label] = nil
+	if !(stored.Node.leaf()) {
+		if err = b.reference(stored.Node.Children.Left, -1); err != nil {
+			return err
+		}
+		if err = b.reference(stored.Node.Children.Right, -1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *batch) writes() (map[string][]byte, error) {
+	writes := make(map[string][]byte)
+
+	for label, stored := range b.nodes {
+		if stored == nil {
+			writes[string(label[:])] = nil
+			continue
+		}
+
+		buffer, err := protobuf.Encode(stored)
+		if err != nil {
+			return nil, err
+		}
+		writes[string(label[:])] = buffer
+	}
+
+	return writes, nil
+}
@@ -0,0 +1,318 @@
+package collection
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// memoryStorage is a Storage keeping the values in a map.
+type memoryStorage map[string][]byte
+
+func (m memoryStorage) Get(key []byte) ([]byte, error) {
+	return m[string(key)], nil
+}
+
+func (m memoryStorage) Write(batch map[string][]byte) error {
+	for key, value := range batch {
+		if value == nil {
+			delete(m, key)
+		} else {
+			m[key] = value
+		}
+	}
+	return nil
+}
+
+func TestStorageRoot(test *testing.T) {
+	stake64 := Stake64{}
+	storage := memoryStorage{}
+	memory := New(stake64)
+
+	stored, err := NewStored(storage, 16, stake64)
+	require.Nil(test, err)
+	require.Equal(test, memory.root.label, stored.root.label)
+
+	for index := 0; index < 512; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		require.Nil(test, memory.Add(key, uint64(index)))
+		require.Nil(test, stored.Add(key, uint64(index)))
+
+		if index%64 == 0 {
+			require.Nil(test, stored.Flush())
+		}
+	}
+	require.Nil(test, stored.Flush())
+	require.Equal(test, memory.root.label, stored.root.label)
+
+	// Only the nodes that were used most recently stay in memory.
+	require.True(test, stored.storage.cache.lru.Len() <= 16)
+
+	reloaded, err := NewStored(storage, 16, stake64)
+	require.Nil(test, err)
+	require.Equal(test, memory.root.label, reloaded.root.label)
+
+	for index := 0; index < 512; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		record, err := reloaded.Get(key).Record()
+		require.Nil(test, err)
+		require.True(test, record.Match())
+		values, err := record.Values()
+		require.Nil(test, err)
+		require.Equal(test, uint64(index), values[0].(uint64))
+
+		proof, err := reloaded.Get(key).Proof()
+		require.Nil(test, err)
+		expected, err := memory.Get(key).Proof()
+		require.Nil(test, err)
+		require.Equal(test, memory.Serialize(expected), reloaded.Serialize(proof))
+	}
+
+	record, err := reloaded.Navigate(0, uint64(1000)).Record()
+	require.Nil(test, err)
+	expected, err := memory.Navigate(0, uint64(1000)).Record()
+	require.Nil(test, err)
+	require.Equal(test, expected.Key(), record.Key())
+}
+
+func TestStorageFlush(test *testing.T) {
+	stake64 := Stake64{}
+	storage := memoryStorage{}
+
+	stored, err := NewStored(storage, 8, stake64)
+	require.Nil(test, err)
+	nodes := len(storage)
+
+	for index := 0; index < 128; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+		require.Nil(test, stored.Add(key, uint64(index)))
+	}
+	require.Nil(test, stored.Flush())
+
+	for index := 0; index < 128; index += 2 {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+		require.Nil(test, stored.Set(key, uint64(index+1)))
+	}
+	require.Nil(test, stored.Flush())
+
+	// The nodes that are not part of the collection anymore are removed.
+	for index := 0; index < 128; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+		require.Nil(test, stored.Remove(key))
+	}
+	require.Nil(test, stored.Flush())
+	require.Equal(test, nodes, len(storage))
+
+	// Changes that are not flushed are lost.
+	require.Nil(test, stored.Add([]byte("key"), uint64(1)))
+	reloaded, err := NewStored(storage, 8, stake64)
+	require.Nil(test, err)
+	empty := New(stake64)
+	require.Equal(test, empty.root.label, reloaded.root.label)
+}
+
+func TestStorageTransaction(test *testing.T) {
+	stake64 := Stake64{}
+	storage := memoryStorage{}
+
+	stored, err := NewStored(storage, 4, stake64)
+	require.Nil(test, err)
+
+	for index := 0; index < 64; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+		require.Nil(test, stored.Add(key, uint64(index)))
+	}
+	require.Nil(test, stored.Flush())
+	root := stored.root.label
+
+	stored.Begin()
+	for index := 64; index < 128; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+		require.Nil(test, stored.Add(key, uint64(index)))
+	}
+	stored.Rollback()
+	require.Nil(test, stored.Flush())
+	require.Equal(test, root, stored.root.label)
+
+	clone := stored.Clone()
+	require.Nil(test, clone.Add([]byte("key"), uint64(1)))
+	require.NotNil(test, clone.Flush())
+	require.Equal(test, root, stored.root.label)
+
+	stored.Begin()
+	require.Nil(test, stored.Add([]byte("key"), uint64(1)))
+	stored.End()
+	require.Nil(test, stored.Flush())
+	require.Equal(test, clone.root.label, stored.root.label)
+
+	reloaded, err := NewStored(storage, 4, stake64)
+	require.Nil(test, err)
+	require.Equal(test, clone.root.label, reloaded.root.label)
+}
+
+func TestStorageInvalid(test *testing.T) {
+	storage := memoryStorage{}
+	storage[string(rootKey)] = []byte("root")
+
+	_, err := NewStored(storage, 8)
+	require.NotNil(test, err)
+
+	label := make([]byte, 32)
+	storage[string(rootKey)] = label
+
+	_, err = NewStored(storage, 8)
+	require.NotNil(test, err)
+}
+
+func TestStorageCloneConcurrent(test *testing.T) {
+	stake64 := Stake64{}
+	storage := memoryStorage{}
+	memory := New(stake64)
+
+	stored, err := NewStored(storage, 8, stake64)
+	require.Nil(test, err)
+
+	add := func(index int) {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+		require.Nil(test, memory.Add(key, uint64(index)))
+		require.Nil(test, stored.Add(key, uint64(index)))
+	}
+	for index := 0; index < 64; index++ {
+		add(index)
+	}
+	require.Nil(test, stored.Flush())
+
+	// The collection changes, is flushed and evicts its nodes while it is
+	// cloned and its clones are read.
+	done := make(chan bool)
+	cloned := make(chan int)
+	go func() {
+		clones := 0
+		for {
+			select {
+			case <-done:
+				cloned <- clones
+				return
+			default:
+			}
+			clone := stored.Clone()
+			clone.Get([]byte("key")).Record()
+			clone.Navigate(0, uint64(1000)).Record()
+			clone.Close()
+			clones++
+		}
+	}()
+	for index := 64; index < 256; index++ {
+		add(index)
+		if index%8 == 0 {
+			require.Nil(test, stored.Flush())
+		}
+	}
+	require.Nil(test, stored.Flush())
+	close(done)
+	require.True(test, <-cloned > 0)
+
+	// Neither the clones nor the evictions changed the collection.
+	require.Equal(test, memory.root.label, stored.root.label)
+	for index := 0; index < 256; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		proof, err := stored.Get(key).Proof()
+		require.Nil(test, err)
+		expected, err := memory.Get(key).Proof()
+		require.Nil(test, err)
+		require.Equal(test, memory.Serialize(expected), stored.Serialize(proof))
+	}
+
+	// A clone can still load its nodes after the collection changed, evicted
+	// and flushed them.
+	clone := stored.Clone()
+	memoryClone := memory.Clone()
+	for index := 0; index < 256; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+		require.Nil(test, stored.Remove(key))
+		require.Nil(test, memory.Remove(key))
+		if index%8 == 0 {
+			require.Nil(test, stored.Flush())
+		}
+	}
+	require.Nil(test, stored.Flush())
+	for index := 0; index < 256; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		proof, err := clone.Get(key).Proof()
+		require.Nil(test, err)
+		expected, err := memoryClone.Get(key).Proof()
+		require.Nil(test, err)
+		require.Equal(test, memoryClone.Serialize(expected), clone.Serialize(proof))
+	}
+
+	// Once the clone is closed, the nodes it used are removed from the
+	// storage.
+	clone.Close()
+	require.Nil(test, stored.Flush())
+	empty, err := NewStored(memoryStorage{}, 8, stake64)
+	require.Nil(test, err)
+	require.Equal(test, empty.root.label, stored.root.label)
+	require.Equal(test, len(empty.storage.backend.(memoryStorage)), len(storage))
+
+	reloaded, err := NewStored(storage, 8, stake64)
+	require.Nil(test, err)
+	require.Equal(test, memory.root.label, reloaded.root.label)
+}
+
+func TestStorageCloneBounded(test *testing.T) {
+	stake64 := Stake64{}
+	storage := memoryStorage{}
+
+	stored, err := NewStored(storage, 16, stake64)
+	require.Nil(test, err)
+
+	// The nodes loaded by the clones and the ones the collection shared
+	// with them are unloaded once the clones are closed.
+	for index := 0; index < 512; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		clone := stored.Clone()
+		again := clone.Clone()
+		require.Nil(test, again.Add(key, uint64(index)))
+		previous := make([]byte, 8)
+		binary.BigEndian.PutUint64(previous, uint64(index/2))
+		_, err = clone.Get(previous).Record()
+		require.Nil(test, err)
+		again.Close()
+		clone.Close()
+
+		require.Nil(test, stored.Add(key, uint64(index)))
+		require.Nil(test, stored.Flush())
+		require.True(test, stored.storage.cache.lru.Len() <= 16)
+		require.True(test, len(knownNodes(stored.root, nil)) <= 16+1)
+	}
+}
+
+// knownNodes appends the known nodes of the tree below n to nodes.
+func knownNodes(n *node, nodes []*node) []*node {
+	if !(n.known) {
+		return nodes
+	}
+	nodes = append(nodes, n)
+	if n.leaf() {
+		return nodes
+	}
+	return knownNodes(n.children.right, knownNodes(n.children.left, nodes))
+}
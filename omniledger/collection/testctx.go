@@ -62,7 +62,11 @@ func (t testCtxVerifier) node(prefix string, collection *Collection, node *node)
 			return
 		}
 
-		if (node.children.left.parent != node) || (node.children.right.parent != node) {
+		// The children shared with clones can have another parent.
+		left := node.children.left
+		right := node.children.right
+
+		if ((left.owner == collection.root.owner) && (left.parent != node)) || ((right.owner == collection.root.owner) && (right.parent != node)) {
 			t.test.Error(t.file, prefix, "children of internal node don't have its parent correctly set")
 			return
 		}
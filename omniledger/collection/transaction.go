@@ -25,6 +25,7 @@ func (c *Collection) Rollback() {
 	explore = func(node *node) {
 		if node.transaction.inconsistent || (node.transaction.backup != nil) {
 			node.restore()
+			node.transaction.inconsistent = false
 
 			if !(node.leaf()) {
 				explore(node.children.left)
@@ -55,18 +56,25 @@ func (c *Collection) End() {
 
 	c.transaction.id++
 	c.transaction.ongoing = false
+
+	defer c.lock()()
+	c.evict()
 }
 
 // Collect performs the garbage collection of the nodes out of the scope.
 // It removes all nodes that are meant to be stored temporarily.
 func (c *Collection) Collect() {
-	var explore func(*node, [sha256.Size]byte, int)
-	explore = func(node *node, path [sha256.Size]byte, bit int) {
+	// explore returns the node that replaces the given one, which is a copy
+	// if the node is changed but is shared with clones of the collection.
+	var explore func(*node, [sha256.Size]byte, int) *node
+	explore = func(node *node, path [sha256.Size]byte, bit int) *node {
 		if !(node.known) {
-			return
+			return node
 		}
 
 		if bit > 0 && !(c.scope.match(path, bit-1)) {
+			node = c.own(node)
+
 			node.known = false
 			node.key = []byte{}
 			node.values = [][]byte{}
@@ -74,14 +82,21 @@ func (c *Collection) Collect() {
 			node.prune()
 		} else if !(node.leaf()) {
 			setBit(path[:], bit+1, false)
-			explore(node.children.left, path, bit+1)
+			left := explore(node.children.left, path, bit+1)
 
 			setBit(path[:], bit+1, true)
-			explore(node.children.right, path, bit+1)
+			right := explore(node.children.right, path, bit+1)
+
+			if (left != node.children.left) || (right != node.children.right) {
+				node = c.own(node)
+				c.replace(node, left, right)
+			}
 		}
+
+		return node
 	}
 
-	if !(c.root.known) {
+	if !(c.root.known) || (c.scope.all && len(c.scope.masks) == 0) {
 		return
 	}
 
@@ -106,10 +121,12 @@ func (c *Collection) Collect() {
 		c.root.prune()
 	} else {
 		setBit(path[:], 0, false)
-		explore(c.root.children.left, path, 0)
+		left := explore(c.root.children.left, path, 0)
 
 		setBit(path[:], 0, true)
-		explore(c.root.children.right, path, 0)
+		right := explore(c.root.children.right, path, 0)
+
+		c.replace(c.root, left, right)
 	}
 }
 
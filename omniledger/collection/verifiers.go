@@ -15,6 +15,8 @@ func (c *Collection) Verify(proof Proof) bool {
 		return false
 	}
 
+	defer c.lock()()
+
 	if !(c.root.known) {
 		proof.Root.to(c.root)
 	}
@@ -23,19 +25,15 @@ func (c *Collection) Verify(proof Proof) bool {
 	cursor := c.root
 
 	for depth := 0; depth < len(proof.Steps); depth++ {
-		if !(cursor.children.left.known) {
-			proof.Steps[depth].Left.to(cursor.children.left)
+		if !(c.fetch(cursor.children.left)) {
+			proof.Steps[depth].Left.to(c.child(cursor, Left))
 		}
 
-		if !(cursor.children.right.known) {
-			proof.Steps[depth].Right.to(cursor.children.right)
+		if !(c.fetch(cursor.children.right)) {
+			proof.Steps[depth].Right.to(c.child(cursor, Right))
 		}
 
-		if bit(path[:], depth) {
-			cursor = cursor.children.right
-		} else {
-			cursor = cursor.children.left
-		}
+		cursor = c.child(cursor, bit(path[:], depth))
 	}
 
 	return true
@@ -0,0 +1,132 @@
+package darc
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dedis/student_18_omniledger/omniledger/darc/expression"
+	"gopkg.in/dedis/cothority.v2"
+)
+
+// SignerSets returns the minimal sets of identities that can sign a request
+// for the action a. The darcs in the rule are resolved with getDarc and
+// replaced by the identities of their "_sign" rule, the same way as when a
+// request is verified. Identities nobody can sign for, like a darc that
+// doesn't exist or an invalid key, are left out of the sets. An error is
+// returned if no set can sign for the action, or if there are more than
+// expression.MaxSets sets.
+func (d *Darc) SignerSets(a Action, getDarc func(string) *Darc) ([][]string, error) {
+	expr, ok := d.Rules[a]
+	if !ok {
+		return nil, fmt.Errorf("action '%v' does not exist", a)
+	}
+	sets, err := signerSets(expr, getDarc, nil)
+	if err != nil {
+		return nil, fmt.Errorf("action '%v' cannot be satisfied: %v", a, err)
+	}
+	return sets, nil
+}
+
+// CheckSatisfiable returns an error if no set of identities can ever sign a
+// request for the action a. Unlike SignerSets it doesn't list the sets, so
+// it works for rules of any size.
+func (d *Darc) CheckSatisfiable(a Action, getDarc func(string) *Darc) error {
+	expr, ok := d.Rules[a]
+	if !ok {
+		return fmt.Errorf("action '%v' does not exist", a)
+	}
+	if err := checkSatisfiable(expr, getDarc, nil); err != nil {
+		return fmt.Errorf("action '%v' cannot be satisfied: %v", a, err)
+	}
+	return nil
+}
+
+// signerSets returns the minimal sets of identities for the expression. The
+// path holds the darcs that delegated to this expression.
+func signerSets(expr expression.Expr, getDarc func(string) *Darc, path []string) ([][]string, error) {
+	Y := expression.InitSetsParser(func(s string) ([][]string, error) {
+		if strings.HasPrefix(s, "darc") {
+			d, err := delegatedDarc(s, getDarc, path)
+			if err != nil {
+				return nil, err
+			}
+			return signerSets(d.Rules[sign], getDarc, append(path[:len(path):len(path)], s))
+		}
+		if err := checkSignerID(s); err != nil {
+			return nil, err
+		}
+		return [][]string{{s}}, nil
+	})
+	sets, err := expression.EvaluateSets(Y, expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(sets) == 0 {
+		return nil, fmt.Errorf("expression '%s' is never true", expr)
+	}
+	return sets, nil
+}
+
+// checkSatisfiable returns nil if the expression evaluates to true when all
+// identities that can sign, sign. As the expressions don't have a negation,
+// no other set of identities can make it true.
+func checkSatisfiable(expr expression.Expr, getDarc func(string) *Darc, path []string) error {
+	Y := expression.InitParser(func(s string) (bool, error) {
+		if strings.HasPrefix(s, "darc") {
+			d, err := delegatedDarc(s, getDarc, path)
+			if err != nil {
+				return false, err
+			}
+			if err := checkSatisfiable(d.Rules[sign], getDarc, append(path[:len(path):len(path)], s)); err != nil {
+				return false, err
+			}
+			return true, nil
+		}
+		if err := checkSignerID(s); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+	res, err := expression.Evaluate(Y, expr)
+	if err != nil {
+		return err
+	}
+	if res != true {
+		return fmt.Errorf("expression '%s' is never true", expr)
+	}
+	return nil
+}
+
+// checkSignerID returns an error if no signer can create signatures for the
+// identity string s, because its type is unknown or its key is invalid.
+func checkSignerID(s string) error {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return errors.New("not an identity")
+	}
+	buf, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return err
+	}
+	switch parts[0] {
+	case "ed25519":
+		if err := cothority.Suite.Point().UnmarshalBinary(buf); err != nil {
+			return fmt.Errorf("invalid ed25519 key: %v", err)
+		}
+	case "x509ec":
+		public, err := x509.ParsePKIXPublicKey(buf)
+		if err != nil {
+			return fmt.Errorf("invalid x509ec key: %v", err)
+		}
+		if _, ok := public.(*ecdsa.PublicKey); !ok {
+			return errors.New("not an ECDSA public key")
+		}
+	default:
+		return fmt.Errorf("unknown identity type '%s'", parts[0])
+	}
+	return nil
+}
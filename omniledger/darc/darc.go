@@ -36,13 +36,17 @@ package darc
 import (
 	"bytes"
 	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/sha256"
 	"crypto/sha512"
 	"crypto/x509"
 	"encoding/asn1"
 	"encoding/binary"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/big"
 	"sort"
 	"strings"
@@ -58,6 +62,11 @@ import (
 const evolve = "_evolve"
 const sign = "_sign"
 
+// MaxDelegationDepth is the maximum number of darcs that are followed when an
+// expression delegates to a darc, whose sign rule delegates to another darc,
+// and so on.
+const MaxDelegationDepth = 32
+
 // InitRules initialise a set of rules with the default actions "_evolve" and
 // "_sign". Signers are joined with logical-Or, owners are joined with
 // logical-AND. If other expressions are needed, please set the rules manually.
@@ -365,6 +374,20 @@ func (d *Darc) VerifyWithCB(getDarc func(string) *Darc) error {
 	return verifyOneEvolution(d, signer, getDarc)
 }
 
+// VerifyEvolution checks that d is a valid evolution of prev, without
+// verifying the path before prev. It is used by callers that trust prev, e.g.
+// because it is the latest version they stored, and that don't keep the
+// previous versions.
+func (d *Darc) VerifyEvolution(prev *Darc, getDarc func(string) *Darc) error {
+	if d == nil || prev == nil {
+		return errors.New("darc is nil")
+	}
+	if len(d.Signatures) == 0 {
+		return errors.New("no signatures")
+	}
+	return verifyOneEvolution(d, prev, getDarc)
+}
+
 // findPath will check if whether d.Path is unset, if it is, it'll try to
 // populate it by looking up darcs using the getDarc callback.
 func (d *Darc) findPath(getDarc func(string) *Darc) error {
@@ -402,6 +425,9 @@ func (d *Darc) findPath(getDarc func(string) *Darc) error {
 // be accepted. The caller is responsible for providing the latest darc in the
 // argument.
 func (r *Request) VerifyWithCB(d *Darc, getDarc func(string) *Darc) error {
+	if d == nil {
+		return errors.New("darc is nil")
+	}
 	if len(r.Signatures) == 0 {
 		return errors.New("no signatures - nothing to verify")
 	}
@@ -563,34 +589,26 @@ func evalExprWithSigs(expr expression.Expr, getDarc func(string) *Darc, sigs ...
 // evalExpr checks whether the expression evaluates to true
 // given a list of identities.
 func evalExpr(expr expression.Expr, getDarc func(string) *Darc, ids ...string) error {
-	Y := expression.InitParser(func(s string) bool {
+	return evalExprPath(expr, getDarc, nil, ids...)
+}
+
+// evalExprPath evaluates the expression like evalExpr. The path holds the
+// darcs that delegated to this expression, so that cycles are detected and
+// the depth of the delegation is limited.
+func evalExprPath(expr expression.Expr, getDarc func(string) *Darc, path []string, ids ...string) error {
+	Y := expression.InitParser(func(s string) (bool, error) {
 		if strings.HasPrefix(s, "darc") {
-			// getDarc is responsible for returning the latest Darc
-			// but the path should contain the darc ID s.
-			d := getDarc(s)
-			if d.Verify() != nil {
-				return false
-			}
-			// Evaluate the "sign" action only in the latest darc
-			// because it may have revoked some rules in earlier
-			// darcs. We do this recursively because there may be
-			// further delegations.
-			if !d.Rules.Contains(sign) {
-				return false
-			}
-			// Recursively evaluate the sign expression until we
-			// find the final signer with a ed25519 key.
-			if err := evalExpr(d.Rules[sign], getDarc, ids...); err != nil {
-				return false
+			if err := evalDelegation(s, getDarc, path, ids...); err != nil {
+				return false, err
 			}
-			return true
+			return true, nil
 		}
 		for _, id := range ids {
 			if id == s {
-				return true
+				return true, nil
 			}
 		}
-		return false
+		return false, nil
 	})
 	res, err := expression.Evaluate(Y, expr)
 	if err != nil {
@@ -602,6 +620,48 @@ func evalExpr(expr expression.Expr, getDarc func(string) *Darc, ids ...string) e
 	return nil
 }
 
+// evalDelegation checks whether the identities fulfill the sign rule of the
+// darc with the identity string s. The darcs in path delegated to s.
+func evalDelegation(s string, getDarc func(string) *Darc, path []string, ids ...string) error {
+	d, err := delegatedDarc(s, getDarc, path)
+	if err != nil {
+		return err
+	}
+	// Recursively evaluate the sign expression until we
+	// find the final signer with a ed25519 key.
+	return evalExprPath(d.Rules[sign], getDarc, append(path[:len(path):len(path)], s), ids...)
+}
+
+// delegatedDarc returns the darc with the identity string s, after checking
+// that the delegation through the darcs in path is allowed and that the darc
+// has a sign rule.
+func delegatedDarc(s string, getDarc func(string) *Darc, path []string) (*Darc, error) {
+	for _, p := range path {
+		if p == s {
+			return nil, errors.New("delegation cycle")
+		}
+	}
+	if len(path) >= MaxDelegationDepth {
+		return nil, fmt.Errorf("more than %d levels of delegation", MaxDelegationDepth)
+	}
+	// getDarc is responsible for returning the latest Darc
+	// but the path should contain the darc ID s.
+	d := getDarc(s)
+	if d == nil {
+		return nil, errors.New("couldn't find darc")
+	}
+	if err := d.Verify(); err != nil {
+		return nil, fmt.Errorf("darc verification failed: %v", err)
+	}
+	// Evaluate the "sign" action only in the latest darc
+	// because it may have revoked some rules in earlier
+	// darcs.
+	if !d.Rules.Contains(sign) {
+		return nil, fmt.Errorf("darc has no %s rule", sign)
+	}
+	return d, nil
+}
+
 // Type returns an integer representing the type of key held in the signer.
 // It is compatible with Identity.Type. For an empty signer, -1 is returned.
 func (s *Signer) Type() int {
@@ -797,7 +857,11 @@ func (idkc *IdentityX509EC) Verify(msg, s []byte) error {
 	if err != nil {
 		return err
 	}
-	if ecdsa.Verify(public.(*ecdsa.PublicKey), digest[:], sig.R, sig.S) {
+	ecPublic, ok := public.(*ecdsa.PublicKey)
+	if !ok {
+		return errors.New("not an ECDSA public key")
+	}
+	if ecdsa.Verify(ecPublic, digest[:], sig.R, sig.S) {
 		return nil
 	}
 	return errors.New("Wrong signature")
@@ -958,14 +1022,109 @@ func InitAndSignRequest(baseID ID, action Action, msg []byte, signers ...*Signer
 	}, nil
 }
 
-// NewSignerX509EC creates a new SignerX509EC - mostly for tests
+// NewSignerX509EC creates a new SignerX509EC with a random key on the P-384
+// curve - mostly for tests. It returns nil if the key cannot be created.
 func NewSignerX509EC() *Signer {
-	return nil
+	private, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return nil
+	}
+	s, err := NewSignerX509ECFromKey(private)
+	if err != nil {
+		return nil
+	}
+	return s
+}
+
+// NewSignerX509ECFromKey creates a new SignerX509EC holding the given ECDSA
+// private key.
+func NewSignerX509ECFromKey(private *ecdsa.PrivateKey) (*Signer, error) {
+	public, err := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	return &Signer{X509EC: &SignerX509EC{
+		Point:  public,
+		secret: secret,
+	}}, nil
 }
 
-// Sign creates a RSA signature on the message
+// NewSignerX509ECFromPEM creates a new SignerX509EC from a PEM encoded ECDSA
+// private key. The key can either be in PKCS#8 format, with the PEM type
+// "PRIVATE KEY", or in SEC 1 format, with the PEM type "EC PRIVATE KEY".
+func NewSignerX509ECFromPEM(buf []byte) (*Signer, error) {
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		private, ok := parsed.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("not an ECDSA private key")
+		}
+		return NewSignerX509ECFromKey(private)
+	case "EC PRIVATE KEY":
+		private, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return NewSignerX509ECFromKey(private)
+	default:
+		return nil, fmt.Errorf("unsupported PEM type '%s'", block.Type)
+	}
+}
+
+// LoadSignerX509EC reads a PEM encoded ECDSA private key from a file and
+// returns a new SignerX509EC.
+func LoadSignerX509EC(filename string) (*Signer, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return NewSignerX509ECFromPEM(buf)
+}
+
+// PEM returns the private key of the signer in PKCS#8 format, PEM encoded.
+func (kcs *SignerX509EC) PEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: kcs.secret,
+	})
+}
+
+// Save writes the private key of the signer to a file in PKCS#8 format, PEM
+// encoded. Only the owner of the file can read it.
+func (kcs *SignerX509EC) Save(filename string) error {
+	return ioutil.WriteFile(filename, kcs.PEM(), 0600)
+}
+
+// Sign creates an ECDSA signature on the SHA-384 digest of the message. The
+// signature is the ASN.1 encoding of R and S, as expected by
+// IdentityX509EC.Verify.
 func (kcs *SignerX509EC) Sign(msg []byte) ([]byte, error) {
-	return nil, errors.New("not yet implemented")
+	parsed, err := x509.ParsePKCS8PrivateKey(kcs.secret)
+	if err != nil {
+		return nil, err
+	}
+	private, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an ECDSA private key")
+	}
+	digest := sha512.Sum384(msg)
+	r, s, err := ecdsa.Sign(rand.Reader, private, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(sigRS{R: r, S: s})
 }
 
 func copyBytes(a []byte) []byte {
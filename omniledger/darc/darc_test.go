@@ -1,6 +1,17 @@
 package darc
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
 	"testing"
 
 	"github.com/dedis/student_18_omniledger/omniledger/darc/expression"
@@ -158,6 +169,30 @@ func TestDarc_EvolveMore(t *testing.T) {
 	require.NotNil(t, darcs[len(darcs)-2].Verify())
 }
 
+func TestDarc_VerifyEvolution(t *testing.T) {
+	d := createDarc(1, "testdarc").darc
+	owner := NewSignerEd25519(nil, nil)
+	require.Nil(t, d.Rules.UpdateEvolution([]byte(owner.Identity().String())))
+
+	darcs := []*Darc{d}
+	for i := 0; i < 3; i++ {
+		dNew := darcs[len(darcs)-1].Copy()
+		require.Nil(t, localEvolution(dNew, darcs, owner))
+		darcs = append(darcs, dNew)
+	}
+
+	// Only the latest version is needed, without its path or signatures.
+	latest := darcs[len(darcs)-2].Copy()
+	require.Nil(t, darcs[len(darcs)-1].VerifyEvolution(latest, nil))
+	require.NotNil(t, darcs[len(darcs)-1].VerifyEvolution(darcs[len(darcs)-3], nil))
+
+	dNew := latest.Copy()
+	require.Nil(t, localEvolution(dNew, []*Darc{latest}, NewSignerEd25519(nil, nil)))
+	require.NotNil(t, dNew.VerifyEvolution(latest, nil))
+	dNew.Signatures = nil
+	require.NotNil(t, dNew.VerifyEvolution(latest, nil))
+}
+
 func TestDarc_EvolveMoreOnline(t *testing.T) {
 	d := createDarc(1, "testdarc").darc
 	require.Nil(t, d.Verify())
@@ -411,8 +446,304 @@ func TestDarc_DelegationChain(t *testing.T) {
 	require.Nil(t, td.darc.VerifyWithCB(getDarc))
 }
 
+// TestDarc_DelegationCycle makes sure that darcs delegating to each other
+// don't make the verification loop forever.
+func TestDarc_DelegationCycle(t *testing.T) {
+	owner := createSigner()
+	idA := NewIdentityDarc([]byte("a")).String()
+	idB := NewIdentityDarc([]byte("b")).String()
+	a := createDarc(1, "a").darc
+	b := createDarc(1, "b").darc
+	require.Nil(t, a.Rules.UpdateSign([]byte(idB)))
+	require.Nil(t, b.Rules.UpdateSign([]byte(idA)))
+	getDarc := func(s string) *Darc {
+		switch s {
+		case idA:
+			return a
+		case idB:
+			return b
+		}
+		return nil
+	}
+
+	c := createDarc(1, "c").darc
+	require.Nil(t, c.Rules.AddRule("use", []byte(idA)))
+	r, err := InitAndSignRequest(c.GetBaseID(), "use", []byte("msg"), owner)
+	require.Nil(t, err)
+	err = r.VerifyWithCB(c, getDarc)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "cycle")
+
+	// The cycle doesn't prevent another identity from signing.
+	require.Nil(t, b.Rules.UpdateSign([]byte(idA+" | "+owner.Identity().String())))
+	require.Nil(t, r.VerifyWithCB(c, getDarc))
+}
+
+// TestDarc_DelegationDepth checks that a chain of delegations can only have
+// MaxDelegationDepth darcs.
+func TestDarc_DelegationDepth(t *testing.T) {
+	owner := createSigner()
+	chain := func(n int) (*Darc, func(string) *Darc) {
+		darcs := map[string]*Darc{}
+		next := owner.Identity().String()
+		for i := n - 1; i >= 0; i-- {
+			d := createDarc(1, "chain").darc
+			require.Nil(t, d.Rules.UpdateSign([]byte(next)))
+			next = NewIdentityDarc([]byte(fmt.Sprintf("%d", i))).String()
+			darcs[next] = d
+		}
+		top := createDarc(1, "top").darc
+		require.Nil(t, top.Rules.AddRule("use", []byte(next)))
+		return top, func(s string) *Darc {
+			return darcs[s]
+		}
+	}
+
+	top, getDarc := chain(MaxDelegationDepth)
+	r, err := InitAndSignRequest(top.GetBaseID(), "use", []byte("msg"), owner)
+	require.Nil(t, err)
+	require.Nil(t, r.VerifyWithCB(top, getDarc))
+
+	top, getDarc = chain(MaxDelegationDepth + 1)
+	r, err = InitAndSignRequest(top.GetBaseID(), "use", []byte("msg"), owner)
+	require.Nil(t, err)
+	err = r.VerifyWithCB(top, getDarc)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "levels of delegation")
+}
+
+// TestDarc_DelegationErrors checks that the reason why a delegation failed
+// is returned.
+func TestDarc_DelegationErrors(t *testing.T) {
+	owner := createSigner()
+	idA := NewIdentityDarc([]byte("a")).String()
+	idB := NewIdentityDarc([]byte("b")).String()
+	b := createDarc(1, "b").darc
+	delete(b.Rules, sign)
+	getDarc := func(s string) *Darc {
+		if s == idB {
+			return b
+		}
+		return nil
+	}
+
+	d := createDarc(1, "d").darc
+	require.Nil(t, d.Rules.AddRule("use", []byte(idA)))
+	r, err := InitAndSignRequest(d.GetBaseID(), "use", []byte("msg"), owner)
+	require.Nil(t, err)
+	err = r.VerifyWithCB(d, getDarc)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), idA+": couldn't find darc")
+
+	require.Nil(t, d.Rules.UpdateRule("use", []byte(idB)))
+	err = r.VerifyWithCB(d, getDarc)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), idB+": darc has no _sign rule")
+
+	// A nil darc must not make the verification panic.
+	require.NotNil(t, r.VerifyWithCB(nil, getDarc))
+}
+
+// TestDarc_Threshold uses a threshold rule where one of the identities is a
+// darc, so that the delegation is counted like any other signer.
+func TestDarc_Threshold(t *testing.T) {
+	owners := []*Signer{createSigner(), createSigner(), createSigner()}
+	idA := NewIdentityDarc([]byte("a")).String()
+	a := createDarc(1, "a").darc
+	require.Nil(t, a.Rules.UpdateSign([]byte(owners[0].Identity().String())))
+	getDarc := func(s string) *Darc {
+		if s == idA {
+			return a
+		}
+		return nil
+	}
+
+	d := createDarc(1, "threshold").darc
+	require.Nil(t, d.Rules.AddRule("use", expression.InitThresholdExpr(2, idA,
+		owners[1].Identity().String(), owners[2].Identity().String())))
+	for _, signers := range [][]*Signer{
+		{owners[0], owners[1]},
+		{owners[1], owners[2]},
+		{owners[0], owners[1], owners[2]},
+	} {
+		r, err := InitAndSignRequest(d.GetBaseID(), "use", []byte("msg"), signers...)
+		require.Nil(t, err)
+		require.Nil(t, r.VerifyWithCB(d, getDarc))
+	}
+	for _, signers := range [][]*Signer{
+		{owners[0]},
+		{owners[2]},
+		{createSigner(), owners[1]},
+	} {
+		r, err := InitAndSignRequest(d.GetBaseID(), "use", []byte("msg"), signers...)
+		require.Nil(t, err)
+		require.NotNil(t, r.VerifyWithCB(d, getDarc))
+	}
+}
+
+func TestDarc_SignerSets(t *testing.T) {
+	owners := []*Signer{createSigner(), createSigner(), createSigner()}
+	ids := make([]string, len(owners))
+	for i, o := range owners {
+		ids[i] = o.Identity().String()
+	}
+	idA := NewIdentityDarc([]byte("a")).String()
+	a := createDarc(1, "a").darc
+	require.Nil(t, a.Rules.UpdateSign([]byte(ids[0])))
+	getDarc := func(s string) *Darc {
+		if s == idA {
+			return a
+		}
+		return nil
+	}
+
+	// The delegation is replaced by the signer of darc a, the unknown
+	// identity type and the missing darc are left out.
+	d := createDarc(1, "sets").darc
+	require.Nil(t, d.Rules.AddRule("use", []byte(
+		"["+idA+", "+ids[1]+", "+ids[2]+"]/2 | foo:ab | darc:ab")))
+	sets, err := d.SignerSets("use", getDarc)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(sets))
+	for _, pair := range [][]string{{ids[0], ids[1]}, {ids[0], ids[2]}, {ids[1], ids[2]}} {
+		sort.Strings(pair)
+		require.Contains(t, sets, pair)
+	}
+	require.Nil(t, d.CheckSatisfiable("use", getDarc))
+
+	sets, err = d.SignerSets(evolve, getDarc)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(sets))
+
+	_, err = d.SignerSets("unknown", getDarc)
+	require.NotNil(t, err)
+}
+
+func TestDarc_CheckSatisfiable(t *testing.T) {
+	owner := createSigner()
+	idA := NewIdentityDarc([]byte("a")).String()
+	a := createDarc(1, "a").darc
+	require.Nil(t, a.Rules.UpdateSign([]byte(idA)))
+	getDarc := func(s string) *Darc {
+		if s == idA {
+			return a
+		}
+		return nil
+	}
+	x509Signer := createSignerX509EC(t)
+
+	for _, tc := range []struct {
+		expr string
+		err  string
+	}{
+		{"darc:ab", "couldn't find darc"},
+		{idA, "delegation cycle"},
+		{"ed25519:00", "invalid ed25519 key"},
+		{"x509ec:00", "invalid x509ec key"},
+		{"foo:ab & " + owner.Identity().String(), "unknown identity type"},
+		{"[darc:ab, darc:cd, " + owner.Identity().String() + "]/2", "couldn't find darc"},
+		{owner.Identity().String() + " | darc:ab", ""},
+		{x509Signer.Identity().String(), ""},
+	} {
+		d := createDarc(1, "check").darc
+		require.Nil(t, d.Rules.UpdateEvolution([]byte(tc.expr)))
+		err := d.CheckSatisfiable(evolve, getDarc)
+		_, errSets := d.SignerSets(evolve, getDarc)
+		if tc.err == "" {
+			require.Nil(t, err, tc.expr)
+			require.Nil(t, errSets, tc.expr)
+			continue
+		}
+		require.NotNil(t, err, tc.expr)
+		require.Contains(t, err.Error(), tc.err)
+		require.NotNil(t, errSets, tc.expr)
+		require.Contains(t, errSets.Error(), tc.err)
+	}
+}
+
 func TestDarc_X509(t *testing.T) {
-	// TODO
+	signer := NewSignerX509EC()
+	require.NotNil(t, signer)
+	id := signer.Identity()
+	require.Equal(t, 2, id.Type())
+
+	msg := []byte("message")
+	sig, err := signer.Sign(msg)
+	require.Nil(t, err)
+	require.Nil(t, id.Verify(msg, sig))
+	require.NotNil(t, id.Verify([]byte("other message"), sig))
+	require.NotNil(t, createSignerX509EC(t).Identity().Verify(msg, sig))
+
+	// Requests and evolutions can be signed with X509EC keys.
+	owner := createSignerX509EC(t)
+	d := NewDarc(InitRules([]*Identity{owner.Identity()}, []*Identity{signer.Identity()}), []byte("x509"))
+	r, err := InitAndSignRequest(d.GetBaseID(), sign, []byte("msg"), signer)
+	require.Nil(t, err)
+	require.Nil(t, r.Verify(d))
+	r, err = InitAndSignRequest(d.GetBaseID(), sign, []byte("msg"), owner)
+	require.Nil(t, err)
+	require.NotNil(t, r.Verify(d))
+
+	d2 := d.Copy()
+	require.Nil(t, localEvolution(d2, []*Darc{d}, signer))
+	require.NotNil(t, d2.Verify())
+	require.Nil(t, localEvolution(d2, []*Darc{d}, owner))
+	require.Nil(t, d2.Verify())
+}
+
+func TestDarc_X509PEM(t *testing.T) {
+	signer := createSignerX509EC(t)
+	msg := []byte("message")
+
+	// PKCS#8 round-trip in memory and through a file.
+	loaded, err := NewSignerX509ECFromPEM(signer.X509EC.PEM())
+	require.Nil(t, err)
+	require.True(t, signer.Identity().Equal(loaded.Identity()))
+	sig, err := loaded.Sign(msg)
+	require.Nil(t, err)
+	require.Nil(t, signer.Identity().Verify(msg, sig))
+
+	dir, err := ioutil.TempDir("", "darc")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "key.pem")
+	require.Nil(t, signer.X509EC.Save(filename))
+	loaded, err = LoadSignerX509EC(filename)
+	require.Nil(t, err)
+	require.True(t, signer.Identity().Equal(loaded.Identity()))
+	sig, err = loaded.Sign(msg)
+	require.Nil(t, err)
+	require.Nil(t, signer.Identity().Verify(msg, sig))
+	_, err = LoadSignerX509EC(filepath.Join(dir, "missing.pem"))
+	require.NotNil(t, err)
+
+	// Keys in SEC 1 format, as written by "openssl ecparam -genkey".
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	sec1, err := x509.MarshalECPrivateKey(private)
+	require.Nil(t, err)
+	loaded, err = NewSignerX509ECFromPEM(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1}))
+	require.Nil(t, err)
+	sig, err = loaded.Sign(msg)
+	require.Nil(t, err)
+	require.Nil(t, loaded.Identity().Verify(msg, sig))
+
+	// Other keys are refused.
+	_, err = NewSignerX509ECFromPEM([]byte("not a pem"))
+	require.NotNil(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.Nil(t, err)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	require.Nil(t, err)
+	_, err = NewSignerX509ECFromPEM(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}))
+	require.NotNil(t, err)
+	_, err = NewSignerX509ECFromPEM(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pkcs8}))
+	require.NotNil(t, err)
+
+	// An identity holding an RSA key doesn't verify anything.
+	rsaPublic, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	require.Nil(t, err)
+	require.NotNil(t, NewIdentityX509EC(rsaPublic).Verify(msg, sig))
 }
 
 type testDarc struct {
@@ -433,6 +764,12 @@ func createDarc(nbrOwners int, desc string) *testDarc {
 	return td
 }
 
+func createSignerX509EC(t *testing.T) *Signer {
+	s := NewSignerX509EC()
+	require.NotNil(t, s)
+	return s
+}
+
 func createSigner() *Signer {
 	s, _ := createSignerIdentity()
 	return s
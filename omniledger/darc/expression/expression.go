@@ -5,30 +5,37 @@ the syntax we use is from: https://en.wikipedia.org/wiki/Extended_Backus%E2%80%9
 
 	expr = term, [ '&', term ]*
 	term = factor, [ '|', factor ]*
-	factor = '(', expr, ')' | id
+	factor = '(', expr, ')' | thexpr | id
+	thexpr = '[', id, [ ',', id ]*, ']', '/', [0-9]+
 	id = [0-9a-z]+, ':', [0-9a-f]+
 
 Examples:
 
         ed25519:deadbeef // every id evaluates to a boolean
 	(a:a & b:b) | (c:c & d:d)
+	[a:a, b:b, c:c]/2 & d:d
 
 In the simplest case, the evaluation of an expression is performed against a
 set of valid ids.  Suppose we have the expression (a:a & b:b) | (c:c & d:d),
 and the set of valid ids is [a:a, b:b], then the expression will evaluate to
 true.  If the set of valid ids is [a:a, c:c], then the expression will evaluate
 to false. However, the user is able to provide a ValueCheckFn to customise how
-the expressions are evaluated.
+the expressions are evaluated. If the ValueCheckFn returns an error for an id,
+the id evaluates to false. The error is only returned by Evaluate if the whole
+expression evaluates to false, so that the caller knows why.
 
-EXTENSION - NOT YET IMPLEMENTED:
-To support threshold signatures, we extend the syntax to include the following.
-	thexpr = '[', id, [ ',', id ]*, ']', '/', digit
+A threshold expression [id, ...]/k evaluates to true if at least k of the
+listed ids evaluate to true. The threshold must be between 1 and the number of
+ids, and every id may only appear once in the list.
 */
 package expression
 
 import (
 	"errors"
+	"fmt"
+	"strconv"
 	"strings"
+	"sync"
 
 	parsec "github.com/prataprc/goparsec"
 )
@@ -37,24 +44,52 @@ const scannerNotEmpty = "parsing failed - scanner is not empty"
 const failedToCast = "evauluation failed - result is not bool"
 
 // ValueCheckFn is a function that will be called when the parser is
-// parsing/evaluating an expression.
-// TODO it is useful if we can return (bool, error).
-type ValueCheckFn func(string) bool
+// parsing/evaluating an expression. It returns an error if the id cannot be
+// checked, for example because it refers to something that doesn't exist.
+type ValueCheckFn func(string) (bool, error)
 
 // Expr represents the unprocess expression of our DSL.
 type Expr []byte
 
+// ParseError is returned by Evaluate if the expression is not valid. Position
+// is the offset of the offending token in the expression, Token is empty if
+// the expression ended too early.
+type ParseError struct {
+	Position int
+	Token    string
+}
+
+func (e *ParseError) Error() string {
+	if e.Token == "" {
+		return fmt.Sprintf("parsing failed - unexpected end of expression at position %d", e.Position)
+	}
+	return fmt.Sprintf("parsing failed - unexpected '%s' at position %d", e.Token, e.Position)
+}
+
 // InitParser creates the root parser
 func InitParser(fn ValueCheckFn) parsec.Parser {
+	return initParser(boolValues{fn: fn})
+}
+
+// initParser creates the root parser for an expression that evaluates to
+// the values vals.
+func initParser(vals values) parsec.Parser {
+	ev := &evaluation{vals: vals}
 	// Y is root Parser, usually called as `s` in CFG theory.
 	var Y parsec.Parser
 	var sum, value parsec.Parser // circular rats
 
 	// Terminal rats
-	var openparan = parsec.Token(`\(`, "OPENPARAN")
-	var closeparan = parsec.Token(`\)`, "CLOSEPARAN")
-	var andop = parsec.Token(`&`, "AND")
-	var orop = parsec.Token(`\|`, "OR")
+	var openparan = ev.token(`\(`, "OPENPARAN")
+	var closeparan = ev.token(`\)`, "CLOSEPARAN")
+	var andop = ev.token(`&`, "AND")
+	var orop = ev.token(`\|`, "OR")
+	var openbracket = ev.token(`\[`, "OPENBRACKET")
+	var closebracket = ev.token(`\]`, "CLOSEBRACKET")
+	var comma = ev.token(`,`, "COMMA")
+	var slash = ev.token(`/`, "SLASH")
+	var threshold = ev.token(`[0-9]+`, "THRESHOLD")
+	var ident = ev.track(id())
 
 	// NonTerminal rats
 	// andop -> "&" |  "|"
@@ -63,24 +98,33 @@ func InitParser(fn ValueCheckFn) parsec.Parser {
 	// value -> "(" expr ")"
 	var groupExpr = parsec.And(exprNode, openparan, &sum, closeparan)
 
+	// thexpr -> "[" id ("," id)* "]" "/" threshold
+	var thExpr = parsec.And(thresholdNode(ev), openbracket, ident,
+		parsec.Kleene(nil, parsec.And(many2many, comma, ident), nil),
+		closebracket, slash, threshold)
+
 	// (andop prod)*
 	var prodK = parsec.Kleene(nil, parsec.And(many2many, sumOp, &value), nil)
 
 	// Circular rats come to life
 	// sum -> prod (andop prod)*
-	sum = parsec.And(sumNode(fn), &value, prodK)
-	// value -> id | "(" expr ")"
-	value = parsec.OrdChoice(exprValueNode(fn), id(), groupExpr)
+	sum = parsec.And(sumNode(vals), &value, prodK)
+	// value -> id | "(" expr ")" | thexpr
+	value = parsec.OrdChoice(exprValueNode(ev), ident, groupExpr, thExpr)
 	// expr  -> sum
 	Y = parsec.OrdChoice(one2one, sum)
-	return Y
+	return ev.root(Y)
 }
 
 // Evaluate uses the input parser to evaluate the expression expr. It returns
 // the result of the evaluate (a boolean), but the result is only valid if
-// there are no errors.
+// there are no errors. If the expression cannot be parsed, the error is a
+// *ParseError.
 func Evaluate(parser parsec.Parser, expr Expr) (bool, error) {
 	v, s := parser(parsec.NewScanner(expr))
+	if err, ok := v.(error); ok {
+		return false, err
+	}
 	_, s = s.SkipWS()
 	if !s.Endof() {
 		return false, errors.New(scannerNotEmpty)
@@ -95,13 +139,13 @@ func Evaluate(parser parsec.Parser, expr Expr) (bool, error) {
 // DefaultParser creates a parser and evaluates the expression expr, every id
 // in pks will evaluate to true.
 func DefaultParser(expr Expr, ids ...string) (bool, error) {
-	return Evaluate(InitParser(func(s string) bool {
+	return Evaluate(InitParser(func(s string) (bool, error) {
 		for _, k := range ids {
 			if k == s {
-				return true
+				return true, nil
 			}
 		}
-		return false
+		return false, nil
 	}), expr)
 }
 
@@ -117,6 +161,127 @@ func InitOrExpr(ids ...string) Expr {
 	return Expr(strings.Join(ids, " | "))
 }
 
+// InitThresholdExpr creates an expression that is true if at least k of the
+// IDs are true.
+func InitThresholdExpr(k int, ids ...string) Expr {
+	return Expr(fmt.Sprintf("[%s]/%d", strings.Join(ids, ", "), k))
+}
+
+// values defines what an expression evaluates to: how the value of an id is
+// found and how the operators combine the values. Any of the methods can
+// return an error instead of a value.
+type values interface {
+	id(ev *evaluation, id string) parsec.ParsecNode
+	and(a, b parsec.ParsecNode) parsec.ParsecNode
+	or(a, b parsec.ParsecNode) parsec.ParsecNode
+	threshold(k int, vs []parsec.ParsecNode) parsec.ParsecNode
+	// unsatisfied returns true if the expression cannot be true with the
+	// value v.
+	unsatisfied(v parsec.ParsecNode) bool
+}
+
+// boolValues evaluates an expression to a bool, calling fn for every id.
+type boolValues struct {
+	fn ValueCheckFn
+}
+
+func (bv boolValues) id(ev *evaluation, id string) parsec.ParsecNode {
+	ok, err := bv.fn(id)
+	if err != nil {
+		ev.fail(id, err)
+		return false
+	}
+	return ok
+}
+
+func (bv boolValues) and(a, b parsec.ParsecNode) parsec.ParsecNode {
+	return a.(bool) && b.(bool)
+}
+
+func (bv boolValues) or(a, b parsec.ParsecNode) parsec.ParsecNode {
+	return a.(bool) || b.(bool)
+}
+
+func (bv boolValues) threshold(k int, vs []parsec.ParsecNode) parsec.ParsecNode {
+	var count int
+	for _, v := range vs {
+		if v.(bool) {
+			count++
+		}
+	}
+	return count >= k
+}
+
+func (bv boolValues) unsatisfied(v parsec.ParsecNode) bool {
+	return v == false
+}
+
+// evaluation holds the state of a parser created by InitParser while it
+// evaluates an expression.
+type evaluation struct {
+	sync.Mutex
+	vals values
+	// farthest is the scanner after the last token that could be parsed.
+	// It points to the offending token if the parsing fails.
+	farthest parsec.Scanner
+	// errs holds the errors returned when looking up the ids.
+	errs []string
+}
+
+// root wraps the root parser, so that the state is reset for every
+// expression. Instead of a value, it returns a *ParseError if the expression
+// cannot be parsed completely, or the errors of the ids if the expression
+// evaluates to false.
+func (ev *evaluation) root(Y parsec.Parser) parsec.Parser {
+	return func(s parsec.Scanner) (parsec.ParsecNode, parsec.Scanner) {
+		ev.Lock()
+		defer ev.Unlock()
+		ev.farthest = s.Clone()
+		ev.errs = nil
+		v, news := Y(s)
+		_, end := news.Clone().SkipWS()
+		if v == nil || !end.Endof() {
+			return ev.parseError(), news
+		}
+		if len(ev.errs) > 0 && ev.vals.unsatisfied(v) {
+			return fmt.Errorf("expression is false - %s", strings.Join(ev.errs, "; ")), news
+		}
+		return v, news
+	}
+}
+
+// parseError returns the error pointing to the token after the part of the
+// expression that could be parsed.
+func (ev *evaluation) parseError() error {
+	s := ev.farthest.Clone()
+	_, s = s.SkipWS()
+	pos := s.GetCursor()
+	tok, _ := s.Match(`^(?:[0-9a-zA-Z:]+|\S)`)
+	return &ParseError{Position: pos, Token: string(tok)}
+}
+
+// token creates a terminal parser that is tracked for the error messages.
+func (ev *evaluation) token(pattern, name string) parsec.Parser {
+	return ev.track(parsec.Token(pattern, name))
+}
+
+// track remembers how far the parser p got in the expression.
+func (ev *evaluation) track(p parsec.Parser) parsec.Parser {
+	return func(s parsec.Scanner) (parsec.ParsecNode, parsec.Scanner) {
+		node, news := p(s)
+		if node != nil && news.GetCursor() > ev.farthest.GetCursor() {
+			ev.farthest = news.Clone()
+		}
+		return node, news
+	}
+}
+
+// fail keeps the error of an id that cannot be looked up, in case the whole
+// expression is false. The id itself evaluates to false.
+func (ev *evaluation) fail(id string, err error) {
+	ev.errs = append(ev.errs, fmt.Sprintf("%s: %v", id, err))
+}
+
 func id() parsec.Parser {
 	return func(s parsec.Scanner) (parsec.ParsecNode, parsec.Scanner) {
 		_, s = s.SkipAny(`^[  \n\t]+`)
@@ -125,18 +290,28 @@ func id() parsec.Parser {
 	}
 }
 
-func sumNode(fn ValueCheckFn) func(ns []parsec.ParsecNode) parsec.ParsecNode {
+func sumNode(vals values) func(ns []parsec.ParsecNode) parsec.ParsecNode {
 	return func(ns []parsec.ParsecNode) parsec.ParsecNode {
 		if len(ns) > 0 {
-			val := ns[0].(bool)
+			// An invalid threshold expression is passed on as
+			// an error, so that Evaluate can return it.
+			val := ns[0]
+			if _, ok := val.(error); ok {
+				return val
+			}
 			for _, x := range ns[1].([]parsec.ParsecNode) {
 				y := x.([]parsec.ParsecNode)
-				n := y[1].(bool)
+				if _, ok := y[1].(error); ok {
+					return y[1]
+				}
 				switch y[0].(*parsec.Terminal).Name {
 				case "AND":
-					val = val && n
+					val = vals.and(val, y[1])
 				case "OR":
-					val = val || n
+					val = vals.or(val, y[1])
+				}
+				if _, ok := val.(error); ok {
+					return val
 				}
 			}
 			return val
@@ -145,17 +320,51 @@ func sumNode(fn ValueCheckFn) func(ns []parsec.ParsecNode) parsec.ParsecNode {
 	}
 }
 
-func exprValueNode(fn ValueCheckFn) func(ns []parsec.ParsecNode) parsec.ParsecNode {
+func exprValueNode(ev *evaluation) func(ns []parsec.ParsecNode) parsec.ParsecNode {
 	return func(ns []parsec.ParsecNode) parsec.ParsecNode {
 		if len(ns) == 0 {
 			return nil
 		} else if term, ok := ns[0].(*parsec.Terminal); ok {
-			return fn(term.Value)
+			return ev.vals.id(ev, term.Value)
 		}
 		return ns[0]
 	}
 }
 
+func thresholdNode(ev *evaluation) func(ns []parsec.ParsecNode) parsec.ParsecNode {
+	return func(ns []parsec.ParsecNode) parsec.ParsecNode {
+		if len(ns) == 0 {
+			return nil
+		}
+		ids := []string{ns[1].(*parsec.Terminal).Value}
+		for _, x := range ns[2].([]parsec.ParsecNode) {
+			y := x.([]parsec.ParsecNode)
+			ids = append(ids, y[1].(*parsec.Terminal).Value)
+		}
+		k, err := strconv.Atoi(ns[5].(*parsec.Terminal).Value)
+		if err != nil {
+			return fmt.Errorf("invalid threshold: %v", err)
+		}
+		if k < 1 || k > len(ids) {
+			return fmt.Errorf("threshold %d is not between 1 and %d", k, len(ids))
+		}
+		// Counting an id twice would allow a single signer to reach
+		// the threshold on its own.
+		seen := make(map[string]bool)
+		for _, id := range ids {
+			if seen[id] {
+				return fmt.Errorf("id %s appears twice in threshold expression", id)
+			}
+			seen[id] = true
+		}
+		vs := make([]parsec.ParsecNode, len(ids))
+		for i, id := range ids {
+			vs[i] = ev.vals.id(ev, id)
+		}
+		return ev.vals.threshold(k, vs)
+	}
+}
+
 func exprNode(ns []parsec.ParsecNode) parsec.ParsecNode {
 	if len(ns) == 0 {
 		return nil
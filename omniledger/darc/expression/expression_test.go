@@ -1,17 +1,19 @@
 package expression
 
 import (
+	"errors"
+	"strings"
 	"testing"
 
 	parsec "github.com/prataprc/goparsec"
 )
 
-func trueFn(s string) bool {
-	return true
+func trueFn(s string) (bool, error) {
+	return true, nil
 }
 
-func falseFn(s string) bool {
-	return false
+func falseFn(s string) (bool, error) {
+	return false, nil
 }
 
 func TestExprAllTrue(t *testing.T) {
@@ -48,11 +50,11 @@ func TestInitAnd(t *testing.T) {
 
 func TestParsing_One(t *testing.T) {
 	expr := []byte("a:abc")
-	fn := func(s string) bool {
+	fn := func(s string) (bool, error) {
 		if s == "a:abc" {
-			return true
+			return true, nil
 		}
-		return false
+		return false, nil
 	}
 	v, s := InitParser(fn)(parsec.NewScanner(expr))
 	if v.(bool) != true {
@@ -65,11 +67,11 @@ func TestParsing_One(t *testing.T) {
 
 func TestParsing_Or(t *testing.T) {
 	expr := []byte("a:abc | b:abc | c:abc")
-	fn := func(s string) bool {
+	fn := func(s string) (bool, error) {
 		if s == "b:abc" {
-			return true
+			return true, nil
 		}
-		return false
+		return false, nil
 	}
 	v, s := InitParser(fn)(parsec.NewScanner(expr))
 	if v.(bool) != true {
@@ -86,8 +88,9 @@ func TestParsing_InvalidID_1(t *testing.T) {
 	if err == nil {
 		t.Fatal("expect an error")
 	}
-	if err.Error() != scannerNotEmpty {
-		t.Fatalf("wrong error message, got %s", err.Error())
+	perr, ok := err.(*ParseError)
+	if !ok || perr.Position != 0 || perr.Token != "x" {
+		t.Fatalf("wrong error, got %v", err)
 	}
 }
 
@@ -105,7 +108,7 @@ func TestParsing_InvalidOp(t *testing.T) {
 	if err == nil {
 		t.Fatal("expect an error")
 	}
-	if err.Error() != scannerNotEmpty {
+	if err.Error() != "parsing failed - unexpected '/' at position 6" {
 		t.Fatalf("wrong error message, got %s", err.Error())
 	}
 }
@@ -123,11 +126,11 @@ func TestParsing_Paran(t *testing.T) {
 
 func TestParsing_Nesting(t *testing.T) {
 	expr := []byte("(a:b | (b:c & c:d))")
-	x, err := Evaluate(InitParser(func(s string) bool {
+	x, err := Evaluate(InitParser(func(s string) (bool, error) {
 		if s == "b:c" || s == "c:d" {
-			return true
+			return true, nil
 		}
-		return false
+		return false, nil
 	}), expr)
 	if err != nil {
 		t.Fatal(err)
@@ -207,3 +210,168 @@ func TestEval_DefaultParser(t *testing.T) {
 		t.Fatal("evaluation should return false")
 	}
 }
+
+func TestParsing_Threshold(t *testing.T) {
+	keys := []string{"a:a", "b:b", "c:c"}
+	for _, tc := range []struct {
+		expr   string
+		result bool
+	}{
+		{"[a:a, b:b, c:c]/1", true},
+		{"[a:a, b:b, c:c]/3", true},
+		{"[a:a,b:b,c:c,d:d]/3", true},
+		{"[a:a, b:b, c:c, d:d]/4", false},
+		{"[d:d, e:e, a:a]/2", false},
+		{"[a:a]/1", true},
+	} {
+		ok, err := DefaultParser(Expr(tc.expr), keys...)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.expr, err)
+		}
+		if ok != tc.result {
+			t.Fatalf("%s should evaluate to %v", tc.expr, tc.result)
+		}
+	}
+}
+
+func TestParsing_ThresholdNesting(t *testing.T) {
+	keys := []string{"a:a", "b:b", "e:e"}
+	for _, tc := range []struct {
+		expr   string
+		result bool
+	}{
+		{"[a:a, b:b, c:c]/2 & e:e", true},
+		{"e:e & [a:a, c:c, d:d]/2", false},
+		{"f:f | [a:a, c:c, d:d]/2 | [b:b, e:e]/2", true},
+		{"([a:a, c:c]/2 | d:d) & e:e", false},
+		{"(f:f | [a:a, b:b, c:c]/2)", true},
+	} {
+		ok, err := DefaultParser(Expr(tc.expr), keys...)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.expr, err)
+		}
+		if ok != tc.result {
+			t.Fatalf("%s should evaluate to %v", tc.expr, tc.result)
+		}
+	}
+}
+
+func TestParsing_ThresholdInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"[a:a, b:b]/0",
+		"[a:a, b:b]/3",
+		"[a:a, a:a]/2",
+		"a:a | [a:a, a:a, b:b]/2",
+		"[]/1",
+		"[a:a, b:b]",
+		"[a:a, b:b]/",
+		"[a:a, b:b/1",
+		"[a:a & b:b]/1",
+	} {
+		if _, err := Evaluate(InitParser(trueFn), Expr(expr)); err == nil {
+			t.Fatalf("%s should fail", expr)
+		}
+	}
+}
+
+func TestInitThreshold(t *testing.T) {
+	keys := []string{"a:a", "b:b", "c:c", "d:d"}
+	expr := InitThresholdExpr(3, keys...)
+	if string(expr) != "[a:a, b:b, c:c, d:d]/3" {
+		t.Fatalf("wrong expression %s", expr)
+	}
+	ok, err := DefaultParser(expr, keys[:3]...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok != true {
+		t.Fatal("evaluation should return true")
+	}
+	ok, err = DefaultParser(expr, keys[:2]...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok != false {
+		t.Fatal("evaluation should return false")
+	}
+}
+
+func TestParsing_ErrorPosition(t *testing.T) {
+	for _, tc := range []struct {
+		expr     string
+		position int
+		token    string
+	}{
+		{"", 0, ""},
+		{"a:a &", 5, ""},
+		{"a:a & & b:b", 6, "&"},
+		{"a: b", 0, "a:"},
+		{"(a:b | b:c & c:d))", 17, ")"},
+		{"(a:b | b:c", 10, ""},
+		{"a:a | B:b", 6, "B:b"},
+		{"[a:a, b:b/1", 9, "/"},
+		{"[a:a, ]/1", 6, "]"},
+		{"a:a & [b:b, c:c]/x", 17, "x"},
+	} {
+		_, err := Evaluate(InitParser(trueFn), Expr(tc.expr))
+		perr, ok := err.(*ParseError)
+		if !ok {
+			t.Fatalf("%s: expected a parse error, got %v", tc.expr, err)
+		}
+		if perr.Position != tc.position || perr.Token != tc.token {
+			t.Fatalf("%s: wrong error %v", tc.expr, err)
+		}
+	}
+}
+
+func TestEval_CheckError(t *testing.T) {
+	errFn := func(valid ...string) ValueCheckFn {
+		return func(s string) (bool, error) {
+			if s == "c:c" {
+				return false, errors.New("unknown id")
+			}
+			for _, v := range valid {
+				if v == s {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+	}
+
+	// An error doesn't matter if the expression is true anyway.
+	ok, err := Evaluate(InitParser(errFn("a:a")), Expr("a:a | c:c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok != true {
+		t.Fatal("evaluation should return true")
+	}
+	ok, err = Evaluate(InitParser(errFn("a:a", "b:b")), Expr("[a:a, b:b, c:c]/2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok != true {
+		t.Fatal("evaluation should return true")
+	}
+
+	// If the expression is false, the error explains why.
+	for _, expr := range []string{"a:a & c:c", "[a:a, b:b, c:c]/2"} {
+		_, err = Evaluate(InitParser(errFn("a:a")), Expr(expr))
+		if err == nil {
+			t.Fatalf("%s: expected an error", expr)
+		}
+		if !strings.Contains(err.Error(), "c:c: unknown id") {
+			t.Fatalf("%s: wrong error message %s", expr, err)
+		}
+	}
+
+	// Without errors, a false expression is not an error.
+	ok, err = Evaluate(InitParser(errFn()), Expr("a:a | b:b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok != false {
+		t.Fatal("evaluation should return false")
+	}
+}
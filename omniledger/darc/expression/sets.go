@@ -0,0 +1,183 @@
+package expression
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	parsec "github.com/prataprc/goparsec"
+)
+
+// MaxSets is the maximum number of sets an expression may evaluate to with
+// EvaluateSets. The number of minimal sets grows exponentially with the size
+// of some expressions, for example (a:a | b:b) & (c:c | d:d) & ...
+const MaxSets = 1024
+
+// SetsFn is a function that returns the minimal sets of ids that satisfy the
+// given id. An id that stands for itself returns [][]string{{id}}. It returns
+// an error if the id can never be satisfied.
+type SetsFn func(string) ([][]string, error)
+
+// InitSetsParser creates a parser that evaluates an expression to the
+// minimal sets of ids that satisfy it, instead of a boolean. A set is minimal
+// if the expression becomes false when any id is removed from it.
+func InitSetsParser(fn SetsFn) parsec.Parser {
+	return initParser(setValues{fn: fn})
+}
+
+// EvaluateSets uses a parser created by InitSetsParser to evaluate the
+// expression expr. The ids in every set are sorted. An expression that can
+// never be true evaluates to no sets, and an error if fn returned errors.
+func EvaluateSets(parser parsec.Parser, expr Expr) ([][]string, error) {
+	v, s := parser(parsec.NewScanner(expr))
+	if err, ok := v.(error); ok {
+		return nil, err
+	}
+	_, s = s.SkipWS()
+	if !s.Endof() {
+		return nil, errors.New(scannerNotEmpty)
+	}
+	sets, ok := v.([][]string)
+	if !ok {
+		return nil, errors.New(failedToCast)
+	}
+	return sets, nil
+}
+
+// DefaultSets evaluates the expression expr to its minimal sets, where every
+// id stands for itself.
+func DefaultSets(expr Expr) ([][]string, error) {
+	return EvaluateSets(InitSetsParser(func(s string) ([][]string, error) {
+		return [][]string{{s}}, nil
+	}), expr)
+}
+
+// setValues evaluates an expression to its minimal sets of ids, calling fn
+// for every id.
+type setValues struct {
+	fn SetsFn
+}
+
+func (sv setValues) id(ev *evaluation, id string) parsec.ParsecNode {
+	sets, err := sv.fn(id)
+	if err != nil {
+		ev.fail(id, err)
+		return [][]string{}
+	}
+	return minimize(sets)
+}
+
+func (sv setValues) and(a, b parsec.ParsecNode) parsec.ParsecNode {
+	as, bs := a.([][]string), b.([][]string)
+	if len(as)*len(bs) > MaxSets {
+		return fmt.Errorf("expression has more than %d sets", MaxSets)
+	}
+	var sets [][]string
+	for _, x := range as {
+		for _, y := range bs {
+			sets = append(sets, append(append([]string{}, x...), y...))
+		}
+	}
+	return minimize(sets)
+}
+
+func (sv setValues) or(a, b parsec.ParsecNode) parsec.ParsecNode {
+	as, bs := a.([][]string), b.([][]string)
+	return minimize(append(append([][]string{}, as...), bs...))
+}
+
+// threshold returns the sets that satisfy at least k of the values. Instead
+// of going through all combinations, sets[j] holds the sets that satisfy j
+// of the values seen so far. The sets that cannot reach k with the remaining
+// values are dropped, so they don't count against MaxSets.
+func (sv setValues) threshold(k int, vs []parsec.ParsecNode) parsec.ParsecNode {
+	sets := make([]parsec.ParsecNode, k+1)
+	sets[0] = [][]string{{}}
+	for j := 1; j <= k; j++ {
+		sets[j] = [][]string{}
+	}
+	for i, v := range vs {
+		low := k - (len(vs) - i - 1)
+		for j := k; j >= 1 && j >= low; j-- {
+			with := sv.and(sets[j-1], v)
+			if _, ok := with.(error); ok {
+				return with
+			}
+			sets[j] = sv.or(sets[j], with)
+			if _, ok := sets[j].(error); ok {
+				return sets[j]
+			}
+		}
+		for j := 0; j < low && j <= k; j++ {
+			sets[j] = [][]string{}
+		}
+	}
+	return sets[k]
+}
+
+func (sv setValues) unsatisfied(v parsec.ParsecNode) bool {
+	sets, ok := v.([][]string)
+	return ok && len(sets) == 0
+}
+
+// minimize sorts the ids of every set and removes the sets that hold all ids
+// of another set, as they are not minimal. The sets are sorted by size.
+func minimize(in [][]string) parsec.ParsecNode {
+	sets := make([][]string, len(in))
+	for i, set := range in {
+		sets[i] = sortedSet(set)
+	}
+	sort.SliceStable(sets, func(i, j int) bool {
+		if len(sets[i]) != len(sets[j]) {
+			return len(sets[i]) < len(sets[j])
+		}
+		for n := range sets[i] {
+			if sets[i][n] != sets[j][n] {
+				return sets[i][n] < sets[j][n]
+			}
+		}
+		return false
+	})
+	res := [][]string{}
+	for _, set := range sets {
+		minimal := true
+		for _, r := range res {
+			if isSubset(r, set) {
+				minimal = false
+				break
+			}
+		}
+		if minimal {
+			res = append(res, set)
+		}
+	}
+	if len(res) > MaxSets {
+		return fmt.Errorf("expression has more than %d sets", MaxSets)
+	}
+	return res
+}
+
+// sortedSet returns a sorted copy of the set without duplicate ids.
+func sortedSet(set []string) []string {
+	s := append([]string{}, set...)
+	sort.Strings(s)
+	res := []string{}
+	for i, id := range s {
+		if i == 0 || id != s[i-1] {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// isSubset returns true if all ids of the sorted set a are in the sorted set
+// b.
+func isSubset(a, b []string) bool {
+	var i int
+	for _, id := range b {
+		if i < len(a) && a[i] == id {
+			i++
+		}
+	}
+	return i == len(a)
+}
@@ -0,0 +1,85 @@
+package expression
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSets(t *testing.T) {
+	for _, tc := range []struct {
+		expr string
+		sets [][]string
+	}{
+		{"a:a", [][]string{{"a:a"}}},
+		{"b:b & a:a", [][]string{{"a:a", "b:b"}}},
+		{"a:a | b:b", [][]string{{"a:a"}, {"b:b"}}},
+		{"a:a | a:a & b:b", [][]string{{"a:a", "b:b"}}},
+		{"a:a & b:b | a:a", [][]string{{"a:a"}}},
+		{"(a:a | b:b) & (c:c | d:d)", [][]string{
+			{"a:a", "c:c"}, {"a:a", "d:d"}, {"b:b", "c:c"}, {"b:b", "d:d"}}},
+		{"[a:a, b:b, c:c]/2", [][]string{
+			{"a:a", "b:b"}, {"a:a", "c:c"}, {"b:b", "c:c"}}},
+		{"[a:a, b:b, c:c]/3 | a:a & b:b", [][]string{{"a:a", "b:b"}}},
+		{"[a:a, b:b]/1 & c:c", [][]string{{"a:a", "c:c"}, {"b:b", "c:c"}}},
+	} {
+		sets, err := DefaultSets(Expr(tc.expr))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.expr, err)
+		}
+		if !reflect.DeepEqual(sets, tc.sets) {
+			t.Fatalf("%s: wrong sets %v", tc.expr, sets)
+		}
+	}
+}
+
+func TestSets_Lookup(t *testing.T) {
+	fn := func(s string) ([][]string, error) {
+		switch s {
+		case "x:a":
+			return [][]string{{"a:a", "b:b"}, {"c:c"}}, nil
+		case "x:b":
+			return nil, errors.New("unknown id")
+		}
+		return [][]string{{s}}, nil
+	}
+	sets, err := EvaluateSets(InitSetsParser(fn), Expr("x:a & d:d | x:b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sets, [][]string{{"c:c", "d:d"}, {"a:a", "b:b", "d:d"}}) {
+		t.Fatalf("wrong sets %v", sets)
+	}
+
+	_, err = EvaluateSets(InitSetsParser(fn), Expr("x:b & d:d"))
+	if err == nil || !strings.Contains(err.Error(), "x:b: unknown id") {
+		t.Fatalf("wrong error %v", err)
+	}
+}
+
+func TestSets_TooMany(t *testing.T) {
+	var terms []string
+	for i := 0; i < 11; i++ {
+		terms = append(terms, "("+string(InitOrExpr("a:"+strings.Repeat("a", i+1),
+			"b:"+strings.Repeat("b", i+1)))+")")
+	}
+	_, err := DefaultSets(InitAndExpr(terms...))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	// A threshold over many ids is not a problem, as long as the result
+	// is small enough.
+	var ids []string
+	for i := 0; i < 40; i++ {
+		ids = append(ids, "a:"+strings.Repeat("a", i+1))
+	}
+	sets, err := DefaultSets(InitThresholdExpr(40, ids...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sets) != 1 || len(sets[0]) != 40 {
+		t.Fatal("wrong sets")
+	}
+}
@@ -6,13 +6,18 @@ package service
  */
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
+	"time"
 
+	"github.com/dedis/protobuf"
 	"github.com/dedis/student_18_omniledger/omniledger/darc"
 
 	"gopkg.in/dedis/cothority.v2"
 	"gopkg.in/dedis/cothority.v2/skipchain"
 	"gopkg.in/dedis/onet.v2"
+	"gopkg.in/dedis/onet.v2/network"
 )
 
 // ServiceName is used for registration on the onet.
@@ -40,17 +45,45 @@ func (c *Client) CreateGenesisBlock(r *onet.Roster, msg *CreateGenesisBlock) (*C
 }
 
 // AddTransaction adds a transaction. It does not return any feedback
-// on the transaction. Use GetProof to find out if the transaction
-// was committed.
+// on the transaction. Use GetTxStatus to find out if the transaction
+// was committed or rejected. The transaction is sent to the first node of the roster,
+// use AddTransactionTo to send it to another node.
 func (c *Client) AddTransaction(r *onet.Roster, id skipchain.SkipBlockID,
 	tx ClientTransaction) (*AddTxResponse, error) {
-	reply := &AddTxResponse{}
-	err := c.SendProtobuf(r.List[0], &AddTxRequest{
+	return c.AddTransactionTo(r.List[0], id, tx)
+}
+
+// AddTransactionTo sends the transaction to the given node, which can be any
+// node of the roster. The node will forward the transaction to the current
+// leader.
+func (c *Client) AddTransactionTo(si *network.ServerIdentity, id skipchain.SkipBlockID,
+	tx ClientTransaction) (*AddTxResponse, error) {
+	return c.sendTransaction(si, &AddTxRequest{
 		Version:     CurrentVersion,
 		SkipchainID: id,
 		Transaction: tx,
-	}, reply)
-	if err != nil {
+	})
+}
+
+// AddTransactionAndWait sends the transaction and only returns once it has
+// been included in a block or rejected, or if this didn't happen during wait
+// block intervals. The receipt in the reply tells which of these happened.
+func (c *Client) AddTransactionAndWait(r *onet.Roster, id skipchain.SkipBlockID,
+	tx ClientTransaction, wait int) (*AddTxResponse, error) {
+	if wait <= 0 {
+		return nil, errors.New("wait must be bigger than 0")
+	}
+	return c.sendTransaction(r.List[0], &AddTxRequest{
+		Version:       CurrentVersion,
+		SkipchainID:   id,
+		Transaction:   tx,
+		InclusionWait: wait,
+	})
+}
+
+func (c *Client) sendTransaction(si *network.ServerIdentity, req *AddTxRequest) (*AddTxResponse, error) {
+	reply := &AddTxResponse{}
+	if err := c.SendProtobuf(si, req, reply); err != nil {
 		return nil, err
 	}
 	return reply, nil
@@ -72,6 +105,313 @@ func (c *Client) GetProof(r *onet.Roster, id skipchain.SkipBlockID, key []byte)
 	return reply, nil
 }
 
+// GetProofs returns one proof for all keys stored in the skipchain. It can
+// hold at most MaxProofKeys keys and is verified with MultiProof.Verify.
+func (c *Client) GetProofs(r *onet.Roster, id skipchain.SkipBlockID, keys ...[]byte) (*GetProofsResponse, error) {
+	reply := &GetProofsResponse{}
+	err := c.SendProtobuf(r.List[0], &GetProofs{
+		Version: CurrentVersion,
+		ID:      id,
+		Keys:    keys,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Proof.Len() != len(keys) {
+		return nil, errors.New("got a proof for the wrong number of keys")
+	}
+	for i, key := range keys {
+		ip, err := reply.Proof.InclusionProofs.Proof(i)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(ip.Key, key) {
+			return nil, errors.New("got a proof for another key")
+		}
+	}
+	return reply, nil
+}
+
+// GetProofAt returns a proof for the key as it was stored after the block
+// blockID. The Latest block of the proof is this block, so the proof can be
+// verified against its CollectionRoot.
+func (c *Client) GetProofAt(r *onet.Roster, id skipchain.SkipBlockID, key []byte, blockID skipchain.SkipBlockID) (*GetProofResponse, error) {
+	reply := &GetProofResponse{}
+	err := c.SendProtobuf(r.List[0], &GetProof{
+		Version: CurrentVersion,
+		ID:      id,
+		Key:     key,
+		BlockID: blockID,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	if !reply.Proof.Latest.Hash.Equal(blockID) {
+		return nil, errors.New("got a proof for another block")
+	}
+	return reply, nil
+}
+
+// GetProofAtIndex returns a proof for the key as it was stored after the
+// block with the given index. Use GetProofAt for the genesis block.
+func (c *Client) GetProofAtIndex(r *onet.Roster, id skipchain.SkipBlockID, key []byte, index int) (*GetProofResponse, error) {
+	if index <= 0 {
+		return nil, errors.New("index must be bigger than zero")
+	}
+	reply := &GetProofResponse{}
+	err := c.SendProtobuf(r.List[0], &GetProof{
+		Version:    CurrentVersion,
+		ID:         id,
+		Key:        key,
+		BlockIndex: index,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Proof.Latest.Index != index {
+		return nil, errors.New("got a proof for another block")
+	}
+	return reply, nil
+}
+
+// GetSnapshot asks the node si for a chunk of its latest snapshot of the
+// skipchain id that is not after the block with the given index.
+func (c *Client) GetSnapshot(si *network.ServerIdentity, id skipchain.SkipBlockID, index, chunk int) (*GetSnapshotResponse, error) {
+	reply := &GetSnapshotResponse{}
+	err := c.SendProtobuf(si, &GetSnapshot{
+		Version:     CurrentVersion,
+		SkipchainID: id,
+		BlockIndex:  index,
+		Chunk:       chunk,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// GetDarc returns the latest version of the darc with the base ID dID, after
+// verifying the proof sent by the node.
+func (c *Client) GetDarc(r *onet.Roster, id skipchain.SkipBlockID, dID darc.ID) (*darc.Darc, error) {
+	key := toObjectID(dID).Slice()
+	reply, err := c.GetProof(r, id, key)
+	if err != nil {
+		return nil, err
+	}
+	if err = reply.Proof.Verify(id); err != nil {
+		return nil, err
+	}
+	if !reply.Proof.InclusionProof.Match() {
+		return nil, errors.New("darc is not on the ledger")
+	}
+	k, vs, err := reply.Proof.KeyValue()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(k, key) || len(vs) < 2 || string(vs[1]) != ContractDarcID {
+		return nil, errors.New("proof doesn't hold the darc")
+	}
+	return darc.NewDarcFromProto(vs[0])
+}
+
+// GetTxStatus returns the receipt of the client transaction with the given
+// hash. The request can be sent to any node of the roster, here the first
+// node is used.
+func (c *Client) GetTxStatus(r *onet.Roster, id skipchain.SkipBlockID, txHash []byte) (*GetTxStatusResponse, error) {
+	reply := &GetTxStatusResponse{}
+	err := c.SendProtobuf(r.List[0], &GetTxStatus{
+		Version:     CurrentVersion,
+		SkipchainID: id,
+		TxHash:      txHash,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// GetNonce returns the nonce to use in the next instruction for the given
+// darc.
+func (c *Client) GetNonce(r *onet.Roster, id skipchain.SkipBlockID, dID darc.ID) (*GetNonceResponse, error) {
+	reply := &GetNonceResponse{}
+	err := c.SendProtobuf(r.List[0], &GetNonce{
+		Version:     CurrentVersion,
+		SkipchainID: id,
+		DarcID:      dID,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// SpawnDarcInstruction returns an instruction that creates the new darc d on
+// the ledger with the skipchain ID scID. The signers must fulfill the "Spawn_darc" rule of the darc
+// parent. The instruction has Index 0 and Length 1, so it has to be signed
+// again if it is used in a bigger client transaction.
+func SpawnDarcInstruction(scID skipchain.SkipBlockID, parent darc.ID, d *darc.Darc, nonce Nonce, signers ...*darc.Signer) (*Instruction, error) {
+	darcBuf, err := d.ToProto()
+	if err != nil {
+		return nil, err
+	}
+	instr := &Instruction{
+		ObjectID: ObjectID{
+			DarcID:     parent,
+			InstanceID: GenNonce(),
+		},
+		Nonce:  nonce,
+		Index:  0,
+		Length: 1,
+		Spawn: &Spawn{
+			ContractID: ContractDarcID,
+			Args:       Arguments{{Name: "darc", Value: darcBuf}},
+		},
+	}
+	if err = instr.SignBy(scID, signers...); err != nil {
+		return nil, err
+	}
+	return instr, nil
+}
+
+// EvolveDarcInstruction evolves newDarc from prev, the latest version of the
+// darc as stored on the ledger scID, and returns the instruction that stores it.
+// The signers must fulfill the "_evolve" rule of prev. The instruction has
+// Index 0 and Length 1, so it has to be signed again if it is used in a
+// bigger client transaction.
+func EvolveDarcInstruction(scID skipchain.SkipBlockID, newDarc, prev *darc.Darc, nonce Nonce, signers ...*darc.Signer) (*Instruction, error) {
+	if err := newDarc.EvolveFrom(darcPath(prev)); err != nil {
+		return nil, err
+	}
+	r, _, err := newDarc.MakeEvolveRequest(signers...)
+	if err != nil {
+		return nil, err
+	}
+	newDarc.Signatures = make([]*darc.Signature, len(r.Signatures))
+	for i := range r.Signatures {
+		newDarc.Signatures[i] = &darc.Signature{
+			Signature: r.Signatures[i],
+			Signer:    *r.Identities[i],
+		}
+	}
+	// The path is not sent, as the ledger already knows it.
+	d := *newDarc
+	d.Path = nil
+	darcBuf, err := protobuf.Encode(&d)
+	if err != nil {
+		return nil, err
+	}
+	instr := &Instruction{
+		ObjectID: toObjectID(newDarc.GetBaseID()),
+		Nonce:    nonce,
+		Index:    0,
+		Length:   1,
+		Invoke: &Invoke{
+			Command: CmdDarcEvolve,
+			Args:    Arguments{{Name: "darc", Value: darcBuf}},
+		},
+	}
+	if err = instr.SignBy(scID, signers...); err != nil {
+		return nil, err
+	}
+	return instr, nil
+}
+
+// UpdateConfigInstruction returns an instruction that changes the
+// configuration of the ledger scID created with the genesis darc. Parameters that
+// are zero are not changed. The signers must fulfill the "Invoke_UpdateConfig"
+// rule of the genesis darc. The instruction has Index 0 and Length 1, so it
+// has to be signed again if it is used in a bigger client transaction.
+func UpdateConfigInstruction(scID skipchain.SkipBlockID, genesis darc.ID, interval time.Duration, maxBlockSize int, nonce Nonce, signers ...*darc.Signer) (*Instruction, error) {
+	var args Arguments
+	if interval != 0 {
+		buf := make([]byte, binary.MaxVarintLen64)
+		args = append(args, Argument{Name: "block_interval",
+			Value: buf[:binary.PutVarint(buf, int64(interval))]})
+	}
+	if maxBlockSize != 0 {
+		buf := make([]byte, binary.MaxVarintLen64)
+		args = append(args, Argument{Name: "max_block_size",
+			Value: buf[:binary.PutVarint(buf, int64(maxBlockSize))]})
+	}
+	if len(args) == 0 {
+		return nil, errors.New("nothing to update")
+	}
+	instr := &Instruction{
+		ObjectID: ObjectID{
+			DarcID:     genesis,
+			InstanceID: OneNonce,
+		},
+		Nonce:  nonce,
+		Index:  0,
+		Length: 1,
+		Invoke: &Invoke{
+			Command: CmdConfigUpdate,
+			Args:    args,
+		},
+	}
+	if err := instr.SignBy(scID, signers...); err != nil {
+		return nil, err
+	}
+	return instr, nil
+}
+
+// UpgradeVersionInstruction returns an instruction that upgrades the ledger
+// scID created with the genesis darc to CurrentVersion. Ledgers of version 1
+// accept the signatures on Instruction.Hash, which can be replayed on other
+// ledgers using the same darcs. The signers must fulfill the
+// "Invoke_UpdateConfig" rule of the genesis darc.
+func UpgradeVersionInstruction(scID skipchain.SkipBlockID, genesis darc.ID, nonce Nonce, signers ...*darc.Signer) (*Instruction, error) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	instr := &Instruction{
+		ObjectID: ObjectID{
+			DarcID:     genesis,
+			InstanceID: OneNonce,
+		},
+		Nonce:  nonce,
+		Index:  0,
+		Length: 1,
+		Invoke: &Invoke{
+			Command: CmdConfigUpdate,
+			Args: Arguments{{Name: "version",
+				Value: buf[:binary.PutVarint(buf, int64(CurrentVersion))]}},
+		},
+	}
+	if err := instr.SignBy(scID, signers...); err != nil {
+		return nil, err
+	}
+	return instr, nil
+}
+
+// ChangeRosterInstruction returns an instruction that changes the roster of
+// the ledger scID created with the genesis darc. The command cmd is one of
+// CmdAddNode, CmdRemoveNode or CmdRotateLeader, and the signers must fulfill
+// the corresponding rule of the genesis darc, e.g. "Invoke_add_node". The
+// instruction has Index 0 and Length 1, so it has to be signed again if it is
+// used in a bigger client transaction.
+func ChangeRosterInstruction(scID skipchain.SkipBlockID, genesis darc.ID, cmd string, node *network.ServerIdentity, nonce Nonce, signers ...*darc.Signer) (*Instruction, error) {
+	nodeBuf, err := protobuf.Encode(node)
+	if err != nil {
+		return nil, err
+	}
+	instr := &Instruction{
+		ObjectID: ObjectID{
+			DarcID:     genesis,
+			InstanceID: OneNonce,
+		},
+		Nonce:  nonce,
+		Index:  0,
+		Length: 1,
+		Invoke: &Invoke{
+			Command: cmd,
+			Args:    Arguments{{Name: "node", Value: nodeBuf}},
+		},
+	}
+	if err = instr.SignBy(scID, signers...); err != nil {
+		return nil, err
+	}
+	return instr, nil
+}
+
 // DefaultGenesisMsg creates the message that is used to for creating the
 // genesis darc and block.
 func DefaultGenesisMsg(v Version, r *onet.Roster, rules []string, ids ...*darc.Identity) (*CreateGenesisBlock, error) {
@@ -84,10 +424,12 @@ func DefaultGenesisMsg(v Version, r *onet.Roster, rules []string, ids ...*darc.I
 	}
 
 	m := CreateGenesisBlock{
-		Version:       v,
-		Roster:        *r,
-		GenesisDarc:   *d,
-		BlockInterval: defaultInterval,
+		Version:          v,
+		Roster:           *r,
+		GenesisDarc:      *d,
+		BlockInterval:    defaultInterval,
+		MaxBlockSize:     defaultMaxBlockSize,
+		SnapshotInterval: defaultSnapshotInterval,
 	}
 	return &m, nil
 }
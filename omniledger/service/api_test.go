@@ -34,29 +34,43 @@ func TestClient_GetProof(t *testing.T) {
 	// Create a new transaction.
 	value := []byte{5, 6, 7, 8}
 	kind := "dummy"
-	tx, err := createOneClientTx(d.GetBaseID(), kind, value, signer)
+	tx, err := createOneClientTx(csr.Skipblock.SkipChainID(), d.GetBaseID(), kind, value, signer)
 	require.Nil(t, err)
-	_, err = c.AddTransaction(roster, csr.Skipblock.SkipChainID(), tx)
+	resp, err := c.AddTransactionAndWait(roster, csr.Skipblock.SkipChainID(), tx, 10)
 	require.Nil(t, err)
+	require.Equal(t, TxIncluded, resp.Receipt.Status)
 
 	// We should have a proof of our transaction in the skipchain.
-	var p *GetProofResponse
-	var i int
-	for i = 0; i < 10; i++ {
-		time.Sleep(4 * msg.BlockInterval)
-		var err error
-		p, err = c.GetProof(roster, csr.Skipblock.SkipChainID(), tx.Instructions[0].ObjectID.Slice())
-		if err != nil {
-			continue
-		}
-		if p.Proof.InclusionProof.Match() {
-			break
-		}
-	}
-	require.NotEqual(t, 10, i, "didn't get proof in time")
+	p, err := c.GetProof(roster, csr.Skipblock.SkipChainID(), tx.Instructions[0].ObjectID.Slice())
+	require.Nil(t, err)
+	require.True(t, p.Proof.InclusionProof.Match())
 	require.Nil(t, p.Proof.Verify(csr.Skipblock.SkipChainID()))
 	k, vs, err := p.Proof.KeyValue()
 	require.Nil(t, err)
 	require.Equal(t, k, tx.Instructions[0].ObjectID.Slice())
 	require.Equal(t, value, vs[0])
+
+	// The genesis darc can be fetched, but not a darc that doesn't exist.
+	gd, err := c.GetDarc(roster, csr.Skipblock.SkipChainID(), d.GetBaseID())
+	require.Nil(t, err)
+	require.True(t, gd.Equal(&d))
+	_, err = c.GetDarc(roster, csr.Skipblock.SkipChainID(), darc.ID(value))
+	require.NotNil(t, err)
+
+	// Both keys and an absent one in a single proof.
+	keys := [][]byte{tx.Instructions[0].ObjectID.Slice(), toObjectID(d.GetBaseID()).Slice(), value}
+	ps, err := c.GetProofs(roster, csr.Skipblock.SkipChainID(), keys...)
+	require.Nil(t, err)
+	require.Nil(t, ps.Proof.Verify(csr.Skipblock.SkipChainID()))
+	k, vs, err = ps.Proof.KeyValue(0)
+	require.Nil(t, err)
+	require.Equal(t, keys[0], k)
+	require.Equal(t, value, vs[0])
+	_, vs, err = ps.Proof.KeyValue(1)
+	require.Nil(t, err)
+	require.Equal(t, []byte(ContractDarcID), vs[1])
+	_, _, err = ps.Proof.KeyValue(2)
+	require.NotNil(t, err)
+	_, err = c.GetProofs(roster, csr.Skipblock.SkipChainID())
+	require.NotNil(t, err)
 }
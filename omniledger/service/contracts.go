@@ -1,6 +1,7 @@
 package service
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"time"
@@ -8,7 +9,10 @@ import (
 	"github.com/dedis/protobuf"
 	"github.com/dedis/student_18_omniledger/omniledger/collection"
 	"github.com/dedis/student_18_omniledger/omniledger/darc"
+	"gopkg.in/dedis/cothority.v2"
+	"gopkg.in/dedis/onet.v2"
 	"gopkg.in/dedis/onet.v2/log"
+	"gopkg.in/dedis/onet.v2/network"
 )
 
 // Here we give a definition of pre-defined contracts.
@@ -23,6 +27,10 @@ var OneNonce = Nonce(func() [32]byte {
 	return nonce
 }())
 
+// NonceInstanceID is the InstanceID under which the last nonce used with a
+// darc is stored, together with the DarcID of that darc.
+var NonceInstanceID = Nonce(sha256.Sum256([]byte("nonce")))
+
 // ZeroDarc is a DarcID with all zeroes.
 var ZeroDarc = darc.ID(make([]byte, 32))
 
@@ -36,21 +44,80 @@ var ContractConfigID = "config"
 // ContractDarcID denotes a darc-contract
 var ContractDarcID = "darc"
 
+// ContractNonceID denotes the objects holding the last nonce of a darc. There
+// is no contract registered for it, so no instruction can change them.
+var ContractNonceID = "nonce"
+
 // CmdDarcEvolve is needed to evolve a darc.
 var CmdDarcEvolve = "Evolve"
 
+// CmdConfigUpdate is needed to change the configuration of a skipchain.
+var CmdConfigUpdate = "UpdateConfig"
+
+// CmdAddNode adds the node given in the argument "node" to the roster.
+var CmdAddNode = "add_node"
+
+// CmdRemoveNode removes the node given in the argument "node" from the
+// roster.
+var CmdRemoveNode = "remove_node"
+
+// CmdRotateLeader makes the node given in the argument "node" the leader.
+var CmdRotateLeader = "rotate_leader"
+
 // Config stores all the configuration information for one skipchain. It will
 // be stored under the key "GenesisDarcID || OneNonce", in the collections. The
 // GenesisDarcID is the value of GenesisReferenceID.
 type Config struct {
 	BlockInterval time.Duration
+	// MaxBlockSize is the maximum size in bytes of the client transactions
+	// of one block.
+	MaxBlockSize int
+	// Roster holds the nodes of the skipchain. The roster of the blocks
+	// always has the same nodes, but the order changes with view-changes.
+	Roster onet.Roster
+	// Version is the protocol version of the skipchain. It defines which
+	// signatures of the instructions are accepted. Skipchains created
+	// before the version was stored have the version 0, which is treated
+	// as version 1.
+	Version Version
+	// SnapshotInterval is the number of blocks between two snapshots of
+	// the state, which are given to the nodes catching up. If it is 0, no
+	// snapshots are created.
+	SnapshotInterval int
+}
+
+// version returns the protocol version of the skipchain.
+func (c *Config) version() Version {
+	if c.Version == 0 {
+		return 1
+	}
+	return c.Version
+}
+
+// decodeConfig returns the config stored in buf.
+func decodeConfig(buf []byte) (*Config, error) {
+	config := &Config{}
+	err := protobuf.DecodeWithConstructors(buf, config, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
 }
 
 // ContractConfig can only be instantiated once per skipchain, and only for
-// the genesis block.
+// the genesis block. Afterwards, the parameters can be changed with
+// Invoke.UpdateConfig, which needs to be signed according to the rule
+// "Invoke_UpdateConfig" of the genesis darc. Skipchains of version 1 are
+// upgraded by setting the argument "version" to 2. The roster is changed with
+// Invoke.add_node, Invoke.remove_node and Invoke.rotate_leader, which need
+// the corresponding rules of the genesis darc. The service applies these
+// changes to the roster of the block holding the instruction.
 func (s *Service) ContractConfig(cdb collection.Collection, tx Instruction, coins []Coin) (sc []StateChange, c []Coin, err error) {
+	if tx.Invoke != nil {
+		return updateConfig(cdb, tx)
+	}
 	if tx.Spawn == nil {
-		return nil, nil, errors.New("Config can only be spawned")
+		return nil, nil, errors.New("Config can only be spawned or updated")
 	}
 	darcBuf := tx.Spawn.Args.Search("darc")
 	d, err := darc.NewDarcFromProto(darcBuf)
@@ -66,17 +133,22 @@ func (s *Service) ContractConfig(cdb collection.Collection, tx Instruction, coin
 		return
 	}
 
-	// sanity check the block interval
-	intervalBuf := tx.Spawn.Args.Search("block_interval")
-	interval, _ := binary.Varint(intervalBuf)
-	if interval == 0 {
+	// create the config to be stored by state changes
+	config := Config{
+		MaxBlockSize: defaultMaxBlockSize,
+	}
+	if err = config.update(tx.Spawn.Args); err != nil {
+		return
+	}
+	if config.BlockInterval == 0 {
 		err = errors.New("block interval is zero")
 		return
 	}
-
-	// create the config to be stored by state changes
-	config := Config{
-		BlockInterval: time.Duration(interval),
+	if buf := tx.Spawn.Args.Search("roster"); buf != nil {
+		if err = protobuf.DecodeWithConstructors(buf, &config.Roster,
+			network.DefaultConstructors(cothority.Suite)); err != nil {
+			return
+		}
 	}
 	configBuf, err := protobuf.Encode(&config)
 	if err != nil {
@@ -94,9 +166,209 @@ func (s *Service) ContractConfig(cdb collection.Collection, tx Instruction, coin
 	}, nil, nil
 }
 
+// updateConfig changes the parameters given in the arguments of the
+// instruction and keeps the others.
+func updateConfig(cdb collection.Collection, tx Instruction) ([]StateChange, []Coin, error) {
+	// Only the config instance can be updated, not the reference to the
+	// genesis darc.
+	if tx.ObjectID.InstanceID != OneNonce {
+		return nil, nil, errors.New("not a config instance")
+	}
+	configBuf, _, err := getValueContract(cdb, tx.ObjectID.Slice())
+	if err != nil {
+		return nil, nil, err
+	}
+	config, err := decodeConfig(configBuf)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch tx.Invoke.Command {
+	case CmdConfigUpdate:
+		err = config.update(tx.Invoke.Args)
+	case CmdAddNode, CmdRemoveNode, CmdRotateLeader:
+		var node *network.ServerIdentity
+		node, err = nodeArgument(tx.Invoke.Args)
+		if err != nil {
+			break
+		}
+		var r *onet.Roster
+		r, err = changeRoster(&config.Roster, tx.Invoke.Command, node)
+		if err == nil {
+			config.Roster = *r
+		}
+	default:
+		err = errors.New("unknown command for config: " + tx.Invoke.Command)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	configBuf, err = protobuf.Encode(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []StateChange{
+		NewStateChange(Update, tx.ObjectID, ContractConfigID, configBuf),
+	}, nil, nil
+}
+
+// update sets the parameters that are present in the arguments. The values
+// are encoded as varints. The version can only be increased, up to
+// CurrentVersion.
+func (c *Config) update(args Arguments) error {
+	if buf := args.Search("block_interval"); buf != nil {
+		interval, n := binary.Varint(buf)
+		if n <= 0 || interval <= 0 {
+			return errors.New("invalid block interval")
+		}
+		c.BlockInterval = time.Duration(interval)
+	}
+	if buf := args.Search("max_block_size"); buf != nil {
+		size, n := binary.Varint(buf)
+		if n <= 0 || size <= 0 {
+			return errors.New("invalid maximum block size")
+		}
+		c.MaxBlockSize = int(size)
+	}
+	if buf := args.Search("version"); buf != nil {
+		v, n := binary.Varint(buf)
+		if n <= 0 || Version(v) < c.version() || Version(v) > CurrentVersion {
+			return errors.New("invalid version")
+		}
+		c.Version = Version(v)
+	}
+	if buf := args.Search("snapshot_interval"); buf != nil {
+		interval, n := binary.Varint(buf)
+		if n <= 0 || interval < 0 {
+			return errors.New("invalid snapshot interval")
+		}
+		c.SnapshotInterval = int(interval)
+	}
+	return nil
+}
+
+// nodeArgument returns the server identity stored in the argument "node".
+func nodeArgument(args Arguments) (*network.ServerIdentity, error) {
+	buf := args.Search("node")
+	if buf == nil {
+		return nil, errors.New("missing argument node")
+	}
+	si := &network.ServerIdentity{}
+	err := protobuf.DecodeWithConstructors(buf, si, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, errors.New("couldn't decode node: " + err.Error())
+	}
+	if si.Public == nil {
+		return nil, errors.New("node has no public key")
+	}
+	return si, nil
+}
+
+// changeRoster returns a new roster where the command cmd has been applied
+// with node. It is used by the config contract on the roster of the config
+// and by the service on the roster of the new block.
+func changeRoster(r *onet.Roster, cmd string, node *network.ServerIdentity) (*onet.Roster, error) {
+	idx, _ := r.Search(node.ID)
+	switch cmd {
+	case CmdAddNode:
+		if idx >= 0 {
+			return nil, errors.New("node is already in the roster")
+		}
+		list := append([]*network.ServerIdentity{}, r.List...)
+		return onet.NewRoster(append(list, node)), nil
+	case CmdRemoveNode:
+		if idx < 0 {
+			return nil, errors.New("node is not in the roster")
+		}
+		if len(r.List) == 1 {
+			return nil, errors.New("cannot remove the last node")
+		}
+		list := append([]*network.ServerIdentity{}, r.List[:idx]...)
+		return onet.NewRoster(append(list, r.List[idx+1:]...)), nil
+	case CmdRotateLeader:
+		if idx < 0 {
+			return nil, errors.New("node is not in the roster")
+		}
+		return rotateRoster(r, idx), nil
+	default:
+		return nil, errors.New("not a roster command: " + cmd)
+	}
+}
+
 // ContractDarc accepts the following instructions:
 //   - Spawn - creates a new darc
-//   - Invoke.Evolve - evolves an existing darc
+//   - Invoke.Evolve - evolves an existing darc, as long as the "_evolve" rule
+//     of the new version can still be satisfied
+//
+// The darcs are stored under their base ID, so that the latest version of a
+// darc can always be found. Only the latest version is stored, without its
+// path and signatures: an evolution is verified against it, and the previous
+// versions are in the blocks.
 func (s *Service) ContractDarc(cdb collection.Collection, tx Instruction, coins []Coin) (sc []StateChange, c []Coin, err error) {
-	return nil, nil, errors.New("Not yet implemented")
+	switch {
+	case tx.Spawn != nil:
+		d, err := darc.NewDarcFromProto(tx.Spawn.Args.Search("darc"))
+		if err != nil {
+			return nil, nil, errors.New("couldn't decode darc: " + err.Error())
+		}
+		if d.Version != 0 {
+			return nil, nil, errors.New("can only spawn darcs with version 0")
+		}
+		if !d.Rules.Contains(darc.Action("_evolve")) || !d.Rules.Contains(darc.Action("_sign")) {
+			return nil, nil, errors.New("darc needs an _evolve and a _sign rule")
+		}
+		if err = d.VerifyWithCB(darcCallback(cdb)); err != nil {
+			return nil, nil, err
+		}
+		darcBuf, err := d.ToProto()
+		if err != nil {
+			return nil, nil, err
+		}
+		return []StateChange{
+			NewStateChange(Create, toObjectID(d.GetBaseID()), ContractDarcID, darcBuf),
+		}, coins, nil
+	case tx.Invoke != nil:
+		if tx.Invoke.Command != CmdDarcEvolve {
+			return nil, nil, errors.New("unknown command for darc: " + tx.Invoke.Command)
+		}
+		prev, err := loadDarc(cdb, tx.ObjectID.DarcID)
+		if err != nil {
+			return nil, nil, err
+		}
+		d, err := darc.NewDarcFromProto(tx.Invoke.Args.Search("darc"))
+		if err != nil {
+			return nil, nil, errors.New("couldn't decode darc: " + err.Error())
+		}
+		if !d.GetBaseID().Equal(tx.ObjectID.DarcID) {
+			return nil, nil, errors.New("cannot evolve a darc with a different base ID")
+		}
+		// The previous version is taken from the ledger, so the
+		// client cannot give a forged one.
+		if err = d.VerifyEvolution(prev, darcCallback(cdb)); err != nil {
+			return nil, nil, errors.New("invalid evolution: " + err.Error())
+		}
+		// Nobody could evolve the darc anymore after such an
+		// evolution.
+		if err = d.CheckSatisfiable(darc.Action("_evolve"), darcCallback(cdb)); err != nil {
+			return nil, nil, errors.New("evolution would lock the darc: " + err.Error())
+		}
+		darcBuf, err := d.ToProto()
+		if err != nil {
+			return nil, nil, err
+		}
+		return []StateChange{
+			NewStateChange(Update, tx.ObjectID, ContractDarcID, darcBuf),
+		}, coins, nil
+	default:
+		return nil, nil, errors.New("darcs can only be spawned or evolved")
+	}
+}
+
+// darcPath returns the path used to evolve a darc from d, the version stored
+// on the ledger. It holds the path stored with d, which is empty unless d was
+// stored by an older version of the darc contract, followed by d without its
+// path.
+func darcPath(d *darc.Darc) []*darc.Darc {
+	latest := *d
+	latest.Path = nil
+	return append(append([]*darc.Darc{}, d.Path...), &latest)
 }
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/protobuf"
+	"gopkg.in/dedis/cothority.v2/skipchain"
+)
+
+// journalDB stores the state changes of every block applied to the
+// collection, so that the state at an earlier block can be rebuilt without
+// calling the contracts again.
+type journalDB struct {
+	db         *bolt.DB
+	bucketName []byte
+}
+
+// journalEntry holds the state changes of one block.
+type journalEntry struct {
+	StateChanges StateChanges
+}
+
+// newJournalDB makes sure the bucket exists and returns a journalDB.
+func newJournalDB(db *bolt.DB, name []byte) *journalDB {
+	j := &journalDB{
+		db:         db,
+		bucketName: name,
+	}
+	j.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(name)
+		return err
+	})
+	return j
+}
+
+// journalKey returns the key under which the state changes of the block with
+// the given index are stored.
+func journalKey(scID skipchain.SkipBlockID, index int) []byte {
+	key := make([]byte, len(scID)+4)
+	copy(key, scID)
+	binary.BigEndian.PutUint32(key[len(scID):], uint32(index))
+	return key
+}
+
+// store saves the state changes of the block with the given index and
+// overwrites the older ones.
+func (j *journalDB) store(scID skipchain.SkipBlockID, index int, scs StateChanges) error {
+	buf, err := protobuf.Encode(&journalEntry{StateChanges: scs})
+	if err != nil {
+		return err
+	}
+	return j.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(j.bucketName).Put(journalKey(scID, index), buf)
+	})
+}
+
+// get returns the state changes of the block with the given index. found is
+// false if they are not in the journal.
+func (j *journalDB) get(scID skipchain.SkipBlockID, index int) (scs StateChanges, found bool, err error) {
+	var buf []byte
+	err = j.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(j.bucketName)
+		if b == nil {
+			return errors.New("missing journal bucket")
+		}
+		v := b.Get(journalKey(scID, index))
+		if v != nil {
+			buf = make([]byte, len(v))
+			copy(buf, v)
+		}
+		return nil
+	})
+	if err != nil || buf == nil {
+		return nil, false, err
+	}
+	entry := &journalEntry{}
+	if err = protobuf.Decode(buf, entry); err != nil {
+		return nil, false, err
+	}
+	return entry.StateChanges, true, nil
+}
@@ -18,6 +18,8 @@ func init() {
 	network.RegisterMessages(
 		&CreateGenesisBlock{}, &CreateGenesisBlockResponse{},
 		&AddTxRequest{}, &AddTxResponse{},
+		&GetTxStatus{}, &GetTxStatusResponse{},
+		&GetNonce{}, &GetNonceResponse{},
 	)
 }
 
@@ -26,8 +28,11 @@ func init() {
 // new versions might correctly interpret earlier versions.
 type Version int
 
-// CurrentVersion is what we're running now
-const CurrentVersion Version = 1
+// CurrentVersion is what we're running now. Since version 2 the instructions
+// are signed with Instruction.SigningDigest, which binds them to one
+// skipchain. Skipchains created with version 1 still accept the signatures on
+// Instruction.Hash, until their config is updated to version 2.
+const CurrentVersion Version = 2
 
 // PROTOSTART
 // import "skipblock.proto";
@@ -50,6 +55,12 @@ type CreateGenesisBlock struct {
 	GenesisDarc darc.Darc
 	// BlockInterval in int64.
 	BlockInterval time.Duration
+	// MaxBlockSize is the maximum size in bytes of the client transactions
+	// of a block.
+	MaxBlockSize int
+	// SnapshotInterval is the number of blocks between two snapshots of
+	// the state. If it is 0, no snapshots are created.
+	SnapshotInterval int
 }
 
 // CreateGenesisBlockResponse holds the genesis-block of the new skipchain.
@@ -68,12 +79,20 @@ type AddTxRequest struct {
 	SkipchainID skipchain.SkipBlockID
 	// Transaction to be applied to the kv-store
 	Transaction ClientTransaction
+	// InclusionWait is the number of block intervals to wait for the
+	// transaction to be included or rejected, at most MaxInclusionWait. If
+	// it is 0, the reply is sent immediately.
+	InclusionWait int
 }
 
 // AddTxResponse is the reply after an AddTxRequest is finished.
 type AddTxResponse struct {
 	// Version of the protocol
 	Version Version
+	// Receipt is only set if InclusionWait was given in the request. Its
+	// status is TxIncluded or TxRejected, or TxPending if the transaction
+	// didn't get in a block in time.
+	Receipt *TxReceipt
 }
 
 // GetProof returns the proof that the given key is in the collection.
@@ -83,8 +102,16 @@ type GetProof struct {
 	// Key is the key we want to look up
 	Key []byte
 	// ID is any block that is know to us in the skipchain, can be the genesis
-	// block or any later block. The proof returned will be starting at this block.
+	// block or any later block. The proof returned will be starting at the
+	// genesis block of this skipchain.
 	ID skipchain.SkipBlockID
+	// BlockID is the block whose state is proven. If it is empty, the block
+	// with index BlockIndex is used.
+	BlockID skipchain.SkipBlockID
+	// BlockIndex is the index of the block whose state is proven. If it and
+	// BlockID are zero, the latest block is used. The genesis block can only
+	// be given with BlockID.
+	BlockIndex int
 }
 
 // GetProofResponse can be used together with the Genesis block to proof that
@@ -96,3 +123,144 @@ type GetProofResponse struct {
 	// of the included key/value pair given a genesis skipblock.
 	Proof Proof
 }
+
+// GetProofs returns one proof for the presence or absence of several keys.
+// It works like GetProof, but the links and the latest block are only sent
+// once.
+type GetProofs struct {
+	// Version of the protocol
+	Version Version
+	// Keys are the keys we want to look up. There can be at most
+	// MaxProofKeys keys.
+	Keys [][]byte
+	// ID is any block that is know to us in the skipchain, like in
+	// GetProof.
+	ID skipchain.SkipBlockID
+	// BlockID is the block whose state is proven, like in GetProof.
+	BlockID skipchain.SkipBlockID
+	// BlockIndex is the index of the block whose state is proven, like in
+	// GetProof.
+	BlockIndex int
+}
+
+// GetProofsResponse holds the proof of all requested keys.
+type GetProofsResponse struct {
+	// Version of the protocol
+	Version Version
+	// Proof contains the proofs of the keys, in the order of the request.
+	Proof MultiProof
+}
+
+// GetSnapshot asks a node for a chunk of its snapshot of the state. It is
+// sent by the nodes catching up on a skipchain.
+type GetSnapshot struct {
+	// Version of the protocol
+	Version Version
+	// SkipchainID is the hash of the first skipblock
+	SkipchainID skipchain.SkipBlockID
+	// BlockIndex is the index of the latest block the snapshot can be of.
+	// The latest snapshot that is not after this block is returned.
+	BlockIndex int
+	// Chunk is the index of the requested chunk.
+	Chunk int
+}
+
+// GetSnapshotResponse holds one chunk of a snapshot.
+type GetSnapshotResponse struct {
+	// Version of the protocol
+	Version Version
+	// BlockIndex is the index of the block whose state is in the snapshot.
+	BlockIndex int
+	// BlockID is the ID of the block whose state is in the snapshot.
+	BlockID skipchain.SkipBlockID
+	// Chunks is the number of chunks of the snapshot.
+	Chunks int
+	// Entries are the key/value pairs of the requested chunk.
+	Entries []SnapshotEntry
+}
+
+// GetTxStatus asks for the status of a client transaction. It can be sent to
+// any node of the roster.
+type GetTxStatus struct {
+	// Version of the protocol
+	Version Version
+	// SkipchainID is the hash of the first skipblock
+	SkipchainID skipchain.SkipBlockID
+	// TxHash is the hash of the client transaction, as returned by
+	// ClientTransaction.Hash.
+	TxHash []byte
+}
+
+// GetTxStatusResponse holds the receipt of the requested transaction.
+type GetTxStatusResponse struct {
+	// Version of the protocol
+	Version Version
+	// Receipt describes what happened to the transaction.
+	Receipt TxReceipt
+}
+
+// TxStatus is the state of a client transaction.
+type TxStatus int
+
+const (
+	// TxUnknown is returned if the node never saw the transaction.
+	TxUnknown TxStatus = iota
+	// TxPending means that the transaction waits to be included in a block.
+	TxPending
+	// TxIncluded means that the transaction has been applied in a block.
+	TxIncluded
+	// TxRejected means that the leader refused the transaction.
+	TxRejected
+)
+
+// String returns a readable output of the status.
+func (ts TxStatus) String() string {
+	switch ts {
+	case TxPending:
+		return "Pending"
+	case TxIncluded:
+		return "Included"
+	case TxRejected:
+		return "Rejected"
+	default:
+		return "Unknown"
+	}
+}
+
+// TxReceipt describes the outcome of a client transaction.
+type TxReceipt struct {
+	// TxHash is the hash of the client transaction.
+	TxHash []byte
+	// Status of the transaction.
+	Status TxStatus
+	// BlockIndex is the index of the block holding the transaction. It is
+	// only set if the status is TxIncluded.
+	BlockIndex int
+	// BlockID is the hash of the block holding the transaction. It is only
+	// set if the status is TxIncluded or TxRejected, and is missing for a
+	// rejection that is not yet recorded in a block.
+	BlockID skipchain.SkipBlockID
+	// Error is the reason why the transaction has been rejected.
+	Error string
+}
+
+// GetNonce asks for the nonce to use in the next instruction for a darc.
+type GetNonce struct {
+	// Version of the protocol
+	Version Version
+	// SkipchainID is the hash of the first skipblock
+	SkipchainID skipchain.SkipBlockID
+	// DarcID is the base ID of the darc in the ObjectID of the instruction.
+	DarcID darc.ID
+}
+
+// GetNonceResponse holds the next nonce of the darc.
+type GetNonceResponse struct {
+	// Version of the protocol
+	Version Version
+	// Nonce is the last nonce used with the darc plus one. If more than one
+	// instruction is sent before they are included, each of them needs a
+	// bigger nonce than the one before, at most MaxNonceStep above the last
+	// nonce.
+	Nonce Nonce
+}
@@ -3,6 +3,8 @@ package service
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"time"
 
 	"github.com/dedis/student_18_omniledger/omniledger/collection"
 	"gopkg.in/dedis/cothority.v2"
@@ -23,7 +25,8 @@ import (
 type Proof struct {
 	// InclusionProof is the deserialized InclusionProof
 	InclusionProof collection.Proof
-	// Providing the latest skipblock to retrieve the Merkle tree root.
+	// Providing the latest skipblock to retrieve the Merkle tree root. For
+	// proofs of an earlier state, it is the block holding this state.
 	Latest skipchain.SkipBlock
 	// Proving the path to the latest skipblock. The first ForwardLink has an
 	// empty-sliced `From` and the genesis-block in `To`, together with the
@@ -36,31 +39,88 @@ type Proof struct {
 // proof for the forward links.
 func NewProof(c *collectionDB, s *skipchain.SkipBlockDB, id skipchain.SkipBlockID,
 	key []byte) (p *Proof, err error) {
+	sb := s.GetByID(id)
+	if sb == nil {
+		return nil, errors.New("didn't find skipchain")
+	}
+	latest, err := s.GetLatest(sb)
+	if err != nil {
+		return nil, err
+	}
+	return newProof(c.coll, s, sb, latest, key)
+}
+
+// newProof creates a proof for key in coll, which must hold the state of the
+// block target. The links go from the block first to target, always taking
+// the highest forward link that doesn't pass target. So the number of links
+// grows with the logarithm of the length of the skipchain.
+func newProof(coll collection.Collection, s *skipchain.SkipBlockDB, first,
+	target *skipchain.SkipBlock, key []byte) (p *Proof, err error) {
 	p = &Proof{}
-	p.InclusionProof, err = c.coll.Get(key).Proof()
+	p.InclusionProof, err = coll.Get(key).Proof()
 	if err != nil {
 		return
 	}
-	sb := s.GetByID(id)
-	if sb == nil {
-		return nil, errors.New("didn't find skipchain")
+	p.Links, err = proofLinks(s, first, target)
+	if err != nil {
+		return nil, err
 	}
-	p.Links = []skipchain.ForwardLink{{
+	p.Latest = *target
+	// p.ProofBytes = p.proof.Consistent()
+	return
+}
+
+// proofLinks returns the links of a proof from the block first to target.
+func proofLinks(s *skipchain.SkipBlockDB, first, target *skipchain.SkipBlock) ([]skipchain.ForwardLink, error) {
+	sb := first
+	links := []skipchain.ForwardLink{{
 		From:      []byte{},
-		To:        id,
+		To:        sb.Hash,
 		NewRoster: sb.Roster,
 	}}
-	for len(sb.ForwardLink) > 0 {
-		link := sb.ForwardLink[len(sb.ForwardLink)-1]
-		p.Links = append(p.Links, *link)
-		sb = s.GetByID(link.To)
-		if sb == nil {
+	for !sb.Hash.Equal(target.Hash) {
+		link, next := nextLink(s, sb, target.Index)
+		if link == nil {
 			return nil, errors.New("missing block in chain")
 		}
+		links = append(links, *link)
+		sb = next
 	}
-	p.Latest = *sb
-	// p.ProofBytes = p.proof.Consistent()
-	return
+	return links, nil
+}
+
+// nextLink returns the highest forward link of sb that doesn't go past the
+// block with the given index, together with the block it points to. It
+// returns nil if there is no such link, or if the block is not in s.
+func nextLink(s *skipchain.SkipBlockDB, sb *skipchain.SkipBlock, index int) (*skipchain.ForwardLink, *skipchain.SkipBlock) {
+	for h := len(sb.ForwardLink) - 1; h >= 0; h-- {
+		link := sb.ForwardLink[h]
+		if link == nil {
+			continue
+		}
+		next := s.GetByID(link.To)
+		if next != nil && next.Index <= index {
+			return link, next
+		}
+	}
+	return nil, nil
+}
+
+// blockByIndex returns the block with the given index in the skipchain
+// starting with the block first.
+func blockByIndex(s *skipchain.SkipBlockDB, first *skipchain.SkipBlock, index int) (*skipchain.SkipBlock, error) {
+	sb := first
+	for sb.Index < index {
+		_, next := nextLink(s, sb, index)
+		if next == nil {
+			return nil, fmt.Errorf("no block with index %d", index)
+		}
+		sb = next
+	}
+	if sb.Index != index {
+		return nil, fmt.Errorf("no block with index %d", index)
+	}
+	return sb, nil
 }
 
 // ErrorVerifyCollection is returned if the collection-proof itself
@@ -75,27 +135,52 @@ var ErrorVerifyCollectionRoot = errors.New("root of collection is not in skipblo
 // have a proper proof that it comes from the genesis block.
 var ErrorVerifySkipchain = errors.New("stored skipblock is not properly evolved from genesis block")
 
+// ErrorVerifyLatest is returned if the latest skipblock doesn't hash to its
+// ID, or if it is not the block the last link points to.
+var ErrorVerifyLatest = errors.New("latest skipblock is not the end of the links")
+
+// ErrorVerifyStale is returned by VerifyFresh if the latest skipblock is
+// older than the allowed age.
+var ErrorVerifyStale = errors.New("latest skipblock is too old")
+
 // Verify takes a skipchain id and verifies that the proof is valid for this skipchain.
 // It verifies the collection-proof, that the merkle-root is stored in the skipblock
 // of the proof and the fact that the skipblock is indeed part of the skipchain.
+// The hash of the latest skipblock is recomputed, so that it cannot be
+// replaced by another block with the same links.
 // If all verifications are correct, the error will be nil.
 func (p Proof) Verify(scID skipchain.SkipBlockID) error {
 	if !p.InclusionProof.Consistent() {
 		return ErrorVerifyCollection
 	}
-	_, d, err := network.Unmarshal(p.Latest.Data, cothority.Suite)
+	return verifyChain(scID, p.InclusionProof.TreeRootHash(), &p.Latest, p.Links)
+}
+
+// verifyChain verifies that root is the collection root of the block latest,
+// and that the links go from the genesis block of scID to latest.
+func verifyChain(scID skipchain.SkipBlockID, root []byte, latest *skipchain.SkipBlock, links []skipchain.ForwardLink) error {
+	header, err := blockHeader(latest)
 	if err != nil {
 		return err
 	}
-	if !bytes.Equal(p.InclusionProof.TreeRootHash(), d.(*DataHeader).CollectionRoot) {
+	if !bytes.Equal(root, header.CollectionRoot) {
 		return ErrorVerifyCollectionRoot
 	}
+	if !latest.CalculateHash().Equal(latest.Hash) {
+		return ErrorVerifyLatest
+	}
+	if len(links) == 0 {
+		return ErrorVerifySkipchain
+	}
 	var sbID skipchain.SkipBlockID
 	var publics []kyber.Point
-	for i, l := range p.Links {
+	for i, l := range links {
 		if i == 0 {
 			// The first forward link is a pointer from []byte{} to the genesis
 			// block and holds the roster of the genesis block.
+			if l.NewRoster == nil {
+				return ErrorVerifySkipchain
+			}
 			sbID = scID
 			publics = l.NewRoster.Publics()
 			continue
@@ -107,16 +192,139 @@ func (p Proof) Verify(scID skipchain.SkipBlockID) error {
 			return ErrorVerifySkipchain
 		}
 		sbID = l.To
+		// The links can skip many blocks, so the roster of the next
+		// link is the one of the block the link points to.
 		if l.NewRoster != nil {
 			publics = l.NewRoster.Publics()
 		}
 	}
+	if !sbID.Equal(latest.Hash) {
+		return ErrorVerifyLatest
+	}
+	return nil
+}
+
+// VerifyFresh verifies the proof like Verify, and that the timestamp of the
+// latest skipblock is not older than maxAge. It makes sure that a node
+// doesn't return the proof of an old state.
+func (p Proof) VerifyFresh(scID skipchain.SkipBlockID, maxAge time.Duration) error {
+	if err := p.Verify(scID); err != nil {
+		return err
+	}
+	return verifyFresh(&p.Latest, maxAge)
+}
+
+// verifyFresh returns an error if the timestamp of the block is older than
+// maxAge.
+func verifyFresh(sb *skipchain.SkipBlock, maxAge time.Duration) error {
+	header, err := blockHeader(sb)
+	if err != nil {
+		return err
+	}
+	if time.Since(time.Unix(0, header.Timestamp)) > maxAge {
+		return ErrorVerifyStale
+	}
 	return nil
 }
 
+// blockHeader returns the header stored in the block.
+func blockHeader(sb *skipchain.SkipBlock) (*DataHeader, error) {
+	_, d, err := network.Unmarshal(sb.Data, cothority.Suite)
+	if err != nil {
+		return nil, err
+	}
+	header, ok := d.(*DataHeader)
+	if !ok {
+		return nil, errors.New("skipblock has no header")
+	}
+	return header, nil
+}
+
 // KeyValue returns the key and the values stored in the proof.
 func (p Proof) KeyValue() (key []byte, values [][]byte, err error) {
 	key = p.InclusionProof.Key
 	values, err = p.InclusionProof.RawValues()
 	return
 }
+
+// MultiProof represents everything necessary to verify the presence or
+// absence of several keys in a skipchain. It is like a Proof, but the links
+// and the latest block are shared by all keys, and the steps the collection
+// proofs have in common are only stored once.
+type MultiProof struct {
+	// InclusionProofs holds the collection proofs of all keys.
+	InclusionProofs collection.MultiProof
+	// Providing the latest skipblock to retrieve the Merkle tree root.
+	Latest skipchain.SkipBlock
+	// Proving the path to the latest skipblock, like in Proof.
+	Links []skipchain.ForwardLink
+}
+
+// newMultiProof creates a proof for all keys in coll, which must hold the
+// state of the block target. The links go from the block first to target.
+func newMultiProof(coll collection.Collection, s *skipchain.SkipBlockDB, first,
+	target *skipchain.SkipBlock, keys [][]byte) (*MultiProof, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no keys")
+	}
+	mp := &MultiProof{Latest: *target}
+	var err error
+	mp.InclusionProofs, err = coll.Proofs(keys...)
+	if err != nil {
+		return nil, err
+	}
+	mp.Links, err = proofLinks(s, first, target)
+	if err != nil {
+		return nil, err
+	}
+	return mp, nil
+}
+
+// Verify takes a skipchain id and verifies that the proofs of all keys are
+// valid for this skipchain, the same way as Proof.Verify.
+func (p MultiProof) Verify(scID skipchain.SkipBlockID) error {
+	if !p.InclusionProofs.Consistent() {
+		return ErrorVerifyCollection
+	}
+	return verifyChain(scID, p.InclusionProofs.TreeRootHash(), &p.Latest, p.Links)
+}
+
+// VerifyFresh verifies the proof like Verify, and that the timestamp of the
+// latest skipblock is not older than maxAge.
+func (p MultiProof) VerifyFresh(scID skipchain.SkipBlockID, maxAge time.Duration) error {
+	if err := p.Verify(scID); err != nil {
+		return err
+	}
+	return verifyFresh(&p.Latest, maxAge)
+}
+
+// Len returns the number of keys in the proof.
+func (p MultiProof) Len() int {
+	return len(p.InclusionProofs.Keys)
+}
+
+// Proof returns the proof of the key with the given index, holding the same
+// latest block and links.
+func (p MultiProof) Proof(i int) (*Proof, error) {
+	ip, err := p.InclusionProofs.Proof(i)
+	if err != nil {
+		return nil, err
+	}
+	return &Proof{
+		InclusionProof: ip,
+		Latest:         p.Latest,
+		Links:          p.Links,
+	}, nil
+}
+
+// KeyValue returns the key with the given index and the values stored under
+// it. An error is returned if the key is absent.
+func (p MultiProof) KeyValue(i int) (key []byte, values [][]byte, err error) {
+	ip, err := p.InclusionProofs.Proof(i)
+	if err != nil {
+		return nil, nil, err
+	}
+	key = ip.Key
+	values, err = ip.RawValues()
+	return
+}
@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"testing"
+	"time"
 
 	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/student_18_omniledger/omniledger/collection"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/dedis/cothority.v2"
 	"gopkg.in/dedis/cothority.v2/byzcoinx"
@@ -30,6 +32,69 @@ func TestNewProof(t *testing.T) {
 	require.True(t, p.InclusionProof.Match())
 }
 
+func TestNewProof_Target(t *testing.T) {
+	s := createSC(t)
+	empty := collection.New(collection.Data{}, collection.Data{})
+	p, err := newProof(empty, s.s, s.genesis, s.genesis, s.key)
+	require.Nil(t, err)
+	require.False(t, p.InclusionProof.Match())
+	require.Equal(t, 1, len(p.Links))
+	require.True(t, p.Latest.Hash.Equal(s.genesis.Hash))
+
+	p, err = newProof(s.c.coll, s.s, s.genesis, s.sb2, s.key)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(p.Links))
+	require.Nil(t, p.Verify(s.genesis.SkipChainID()))
+
+	// A block that cannot be reached from the first block.
+	_, err = newProof(s.c.coll, s.s, s.genesis, s.genesis2, s.key)
+	require.NotNil(t, err)
+
+	sb, err := blockByIndex(s.s, s.genesis, 1)
+	require.Nil(t, err)
+	require.True(t, sb.Hash.Equal(s.sb2.Hash))
+	sb, err = blockByIndex(s.s, s.genesis, 0)
+	require.Nil(t, err)
+	require.True(t, sb.Hash.Equal(s.genesis.Hash))
+	_, err = blockByIndex(s.s, s.genesis, 2)
+	require.NotNil(t, err)
+}
+
+func TestNewProof_Compact(t *testing.T) {
+	s := createSC(t)
+	n := 500
+	blocks := genChain(t, s.s, n, 3, 10, s.c.RootHash(), 100, 333)
+	scID := blocks[0].Hash
+
+	for _, target := range []int{0, 1, 99, 100, 101, 332, 333, n - 1} {
+		p, err := newProof(s.c.coll, s.s, blocks[0], blocks[target], s.key)
+		require.Nil(t, err)
+		require.Nil(t, p.Verify(scID), "target %d", target)
+		require.Equal(t, target, p.Latest.Index)
+		// The links follow the highest levels, so there are at most
+		// base-1 links per level.
+		require.True(t, len(p.Links) <= 1+2*6, "%d links for target %d", len(p.Links), target)
+	}
+
+	// NewProof goes to the latest block.
+	p, err := NewProof(s.c, s.s, scID, s.key)
+	require.Nil(t, err)
+	require.Equal(t, n-1, p.Latest.Index)
+	require.Nil(t, p.Verify(scID))
+
+	// The proof must pass the new rosters to the verifier.
+	var changed bool
+	for i := range p.Links[1:] {
+		if p.Links[i+1].NewRoster != nil {
+			changed = true
+			p.Links[i+1].NewRoster = nil
+			require.Equal(t, ErrorVerifySkipchain, p.Verify(scID))
+			break
+		}
+	}
+	require.True(t, changed, "no roster change in the links")
+}
+
 func TestVerify(t *testing.T) {
 	s := createSC(t)
 	p, err := NewProof(s.c, s.s, s.genesis.Hash, s.key)
@@ -50,6 +115,138 @@ func TestVerify(t *testing.T) {
 	require.Equal(t, ErrorVerifyCollectionRoot, p.Verify(s.genesis.SkipChainID()))
 }
 
+func TestVerify_Tampering(t *testing.T) {
+	s := createSC(t)
+	scID := s.genesis.SkipChainID()
+	newP := func() *Proof {
+		p, err := NewProof(s.c, s.s, s.genesis.Hash, s.key)
+		require.Nil(t, err)
+		require.Nil(t, p.Verify(scID))
+		return p
+	}
+
+	// A forged latest block with the root of another collection, even if
+	// its hash is correct.
+	other := collection.New(collection.Data{}, collection.Data{})
+	require.Nil(t, other.Add(s.key, []byte("forged"), []byte{}))
+	p := newP()
+	p.InclusionProof, _ = other.Get(s.key).Proof()
+	var err error
+	p.Latest.Data, err = network.Marshal(&DataHeader{CollectionRoot: other.GetRoot()})
+	require.Nil(t, err)
+	require.Equal(t, ErrorVerifyLatest, p.Verify(scID))
+	p.Latest.Hash = p.Latest.CalculateHash()
+	require.Equal(t, ErrorVerifyLatest, p.Verify(scID))
+
+	// A latest block that has been changed without changing its hash.
+	p = newP()
+	p.Latest.Index++
+	require.Equal(t, ErrorVerifyLatest, p.Verify(scID))
+
+	// The genesis block, which has no header, instead of the latest block.
+	p = newP()
+	p.Latest = *s.genesis
+	require.NotNil(t, p.Verify(scID))
+
+	// Links that don't end at the latest block.
+	p = newP()
+	p.Links = p.Links[:1]
+	require.Equal(t, ErrorVerifyLatest, p.Verify(scID))
+	p.Links = nil
+	require.Equal(t, ErrorVerifySkipchain, p.Verify(scID))
+
+	// A link pointing somewhere else, or missing the roster of the genesis
+	// block.
+	p = newP()
+	p.Links[1].To = s.genesis2.Hash
+	require.Equal(t, ErrorVerifySkipchain, p.Verify(scID))
+	p = newP()
+	p.Links[0].NewRoster = nil
+	require.Equal(t, ErrorVerifySkipchain, p.Verify(scID))
+	p = newP()
+	p.Links[0].NewRoster = s.genesis2.Roster
+	require.Equal(t, ErrorVerifySkipchain, p.Verify(scID))
+
+	// A wrong skipchain.
+	p = newP()
+	require.Equal(t, ErrorVerifySkipchain, p.Verify(s.genesis2.SkipChainID()))
+
+	// An inconsistent collection proof.
+	p = newP()
+	p.InclusionProof.Steps = nil
+	require.Equal(t, ErrorVerifyCollection, p.Verify(scID))
+
+	// A latest block without a header.
+	p = newP()
+	p.Latest.Data, err = network.Marshal(&DataBody{})
+	require.Nil(t, err)
+	require.NotNil(t, p.Verify(scID))
+}
+
+func TestVerifyFresh(t *testing.T) {
+	s := createSC(t)
+	scID := s.genesis.SkipChainID()
+	p, err := NewProof(s.c, s.s, s.genesis.Hash, s.key)
+	require.Nil(t, err)
+	require.Nil(t, p.VerifyFresh(scID, time.Minute))
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, ErrorVerifyStale, p.VerifyFresh(scID, time.Millisecond))
+
+	// The freshness check doesn't replace the other checks.
+	require.Equal(t, ErrorVerifySkipchain, p.VerifyFresh(s.genesis2.SkipChainID(), time.Minute))
+}
+
+func TestMultiProof(t *testing.T) {
+	s := createSC(t)
+	for i := 0; i < 50; i++ {
+		s.c.Store(&StateChange{StateAction: Create, ObjectID: []byte(fmt.Sprintf("key%d", i)),
+			Value: []byte{byte(i)}})
+	}
+	blocks := genChain(t, s.s, 5, 2, 10, s.c.RootHash(), 3)
+	scID := blocks[0].Hash
+	keys := [][]byte{s.key, []byte("key1"), []byte("absent"), []byte("key49")}
+	p, err := newMultiProof(s.c.coll, s.s, blocks[0], blocks[4], keys)
+	require.Nil(t, err)
+	require.Nil(t, p.Verify(scID))
+	require.Equal(t, len(keys), p.Len())
+
+	for i, key := range keys {
+		single, err := p.Proof(i)
+		require.Nil(t, err)
+		require.Nil(t, single.Verify(scID))
+		require.Equal(t, key, single.InclusionProof.Key)
+		k, values, err := p.KeyValue(i)
+		if string(key) == "absent" {
+			require.False(t, single.InclusionProof.Match())
+			require.NotNil(t, err)
+			continue
+		}
+		require.Nil(t, err)
+		require.Equal(t, key, k)
+		k2, values2, err := single.KeyValue()
+		require.Nil(t, err)
+		require.Equal(t, k, k2)
+		require.Equal(t, values, values2)
+	}
+	_, err = p.Proof(len(keys))
+	require.NotNil(t, err)
+	_, err = newMultiProof(s.c.coll, s.s, blocks[0], blocks[4], nil)
+	require.NotNil(t, err)
+
+	// The shared parts are verified like in a single proof.
+	require.Equal(t, ErrorVerifySkipchain, p.Verify(s.genesis.SkipChainID()))
+	tampered := *p
+	tampered.Latest.Index++
+	require.Equal(t, ErrorVerifyLatest, tampered.Verify(scID))
+	tampered = *p
+	tampered.Links = tampered.Links[:1]
+	require.Equal(t, ErrorVerifyLatest, tampered.Verify(scID))
+	tampered = *p
+	tampered.InclusionProofs.Paths = tampered.InclusionProofs.Paths[1:]
+	require.Equal(t, ErrorVerifyCollection, tampered.Verify(scID))
+	require.Nil(t, p.VerifyFresh(scID, time.Minute))
+}
+
 type sc struct {
 	c            *collectionDB          // a usable collectionDB to store key/value pairs
 	s            *skipchain.SkipBlockDB // a usable skipchain DB to store blocks
@@ -99,8 +296,10 @@ func createSC(t *testing.T) (s sc) {
 
 	s.sb2 = skipchain.NewSkipBlock()
 	s.sb2.Roster, _ = genRoster(2)
+	s.sb2.Index = 1
 	s.sb2.Data, err = network.Marshal(&DataHeader{
 		CollectionRoot: s.c.RootHash(),
+		Timestamp:      time.Now().UnixNano(),
 	})
 	require.Nil(t, err)
 	s.sb2.Hash = s.sb2.CalculateHash()
@@ -117,6 +316,12 @@ func createSC(t *testing.T) (s sc) {
 }
 
 func genForwardLink(t *testing.T, from, to *skipchain.SkipBlock, privs []kyber.Scalar) []*skipchain.ForwardLink {
+	return []*skipchain.ForwardLink{signForwardLink(t, from, to, privs)}
+}
+
+// signForwardLink returns the forward link from the block from to the block
+// to, signed by the first node of the roster of from.
+func signForwardLink(t *testing.T, from, to *skipchain.SkipBlock, privs []kyber.Scalar) *skipchain.ForwardLink {
 	fwd := &skipchain.ForwardLink{
 		From: from.Hash,
 		To:   to.Hash,
@@ -138,7 +343,50 @@ func genForwardLink(t *testing.T, from, to *skipchain.SkipBlock, privs []kyber.S
 		Sig: sig,
 	}
 	require.Nil(t, err)
-	return []*skipchain.ForwardLink{fwd}
+	return fwd
+}
+
+// genChain stores a skipchain of n blocks in db with the given base and
+// maximum height, and all the forward links between them. The roster
+// changes at every index in changes. All blocks hold root in their header.
+func genChain(t *testing.T, db *skipchain.SkipBlockDB, n, base, maxHeight int, root []byte, changes ...int) []*skipchain.SkipBlock {
+	roster, privs := genRoster(1)
+	var blocks []*skipchain.SkipBlock
+	var blockPrivs [][]kyber.Scalar
+	for i := 0; i < n; i++ {
+		for _, c := range changes {
+			if c == i {
+				roster, privs = genRoster(1)
+			}
+		}
+		sb := skipchain.NewSkipBlock()
+		sb.Index = i
+		sb.BaseHeight = base
+		sb.MaximumHeight = maxHeight
+		sb.Height = maxHeight
+		if i > 0 {
+			sb.Height = 1
+			for h, step := 1, base; h < maxHeight && i%step == 0; h, step = h+1, step*base {
+				sb.Height = h + 1
+			}
+		}
+		sb.Roster = roster
+		var err error
+		sb.Data, err = network.Marshal(&DataHeader{CollectionRoot: root,
+			Timestamp: time.Now().UnixNano()})
+		require.Nil(t, err)
+		sb.Hash = sb.CalculateHash()
+		blocks = append(blocks, sb)
+		blockPrivs = append(blockPrivs, privs)
+	}
+	for i, sb := range blocks {
+		for h, step := 0, 1; h < sb.Height && i+step < n; h, step = h+1, step*base {
+			sb.ForwardLink = append(sb.ForwardLink,
+				signForwardLink(t, sb, blocks[i+step], blockPrivs[i]))
+		}
+		db.Store(sb)
+	}
+	return blocks
 }
 
 func getSBID(s string) skipchain.SkipBlockID {
@@ -0,0 +1,130 @@
+package service
+
+import (
+	"errors"
+	"sync"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/protobuf"
+	"gopkg.in/dedis/cothority.v2/skipchain"
+)
+
+// receiptDB stores the outcome of every client transaction that has been
+// handled by the leader, so that all nodes can answer GetTxStatus requests.
+type receiptDB struct {
+	db         *bolt.DB
+	bucketName []byte
+}
+
+// newReceiptDB makes sure the bucket exists and returns a receiptDB.
+func newReceiptDB(db *bolt.DB, name []byte) *receiptDB {
+	r := &receiptDB{
+		db:         db,
+		bucketName: name,
+	}
+	r.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(name)
+		return err
+	})
+	return r
+}
+
+// receiptKey returns the key under which the receipt of a transaction is
+// stored.
+func receiptKey(scID skipchain.SkipBlockID, txHash []byte) []byte {
+	return append(append([]byte{}, scID...), txHash...)
+}
+
+// store saves the receipt and overwrites any older receipt of the same
+// transaction.
+func (r *receiptDB) store(scID skipchain.SkipBlockID, rc *TxReceipt) error {
+	buf, err := protobuf.Encode(rc)
+	if err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(r.bucketName).Put(receiptKey(scID, rc.TxHash), buf)
+	})
+}
+
+// get returns the receipt of the transaction, or nil if there is none.
+func (r *receiptDB) get(scID skipchain.SkipBlockID, txHash []byte) (*TxReceipt, error) {
+	var buf []byte
+	err := r.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(r.bucketName)
+		if b == nil {
+			return errors.New("missing receipt bucket")
+		}
+		v := b.Get(receiptKey(scID, txHash))
+		if v != nil {
+			buf = make([]byte, len(v))
+			copy(buf, v)
+		}
+		return nil
+	})
+	if err != nil || buf == nil {
+		return nil, err
+	}
+	rc := &TxReceipt{}
+	if err := protobuf.Decode(buf, rc); err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+// txWaiters holds the channels of the clients waiting for the receipt of a
+// transaction.
+type txWaiters struct {
+	sync.Mutex
+	waiters map[string][]chan TxReceipt
+}
+
+func newTxWaiters() *txWaiters {
+	return &txWaiters{
+		waiters: make(map[string][]chan TxReceipt),
+	}
+}
+
+// add returns a channel that will get the receipt of the transaction.
+func (w *txWaiters) add(scID skipchain.SkipBlockID, txHash []byte) chan TxReceipt {
+	w.Lock()
+	defer w.Unlock()
+	// The channel is buffered so that notify never blocks.
+	c := make(chan TxReceipt, 1)
+	key := string(receiptKey(scID, txHash))
+	w.waiters[key] = append(w.waiters[key], c)
+	return c
+}
+
+// remove deletes the channel from the waiters.
+func (w *txWaiters) remove(scID skipchain.SkipBlockID, txHash []byte, c chan TxReceipt) {
+	w.Lock()
+	defer w.Unlock()
+	key := string(receiptKey(scID, txHash))
+	cs := w.waiters[key]
+	for i := range cs {
+		if cs[i] == c {
+			cs = append(cs[:i], cs[i+1:]...)
+			break
+		}
+	}
+	if len(cs) == 0 {
+		delete(w.waiters, key)
+	} else {
+		w.waiters[key] = cs
+	}
+}
+
+// notify sends the receipt to all clients waiting for it.
+func (w *txWaiters) notify(scID skipchain.SkipBlockID, rc TxReceipt) {
+	w.Lock()
+	defer w.Unlock()
+	key := string(receiptKey(scID, rc.TxHash))
+	for _, c := range w.waiters[key] {
+		select {
+		case c <- rc:
+		default:
+		}
+	}
+	delete(w.waiters, key)
+}
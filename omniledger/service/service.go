@@ -4,8 +4,10 @@ package service
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -51,12 +53,21 @@ type Service struct {
 	// collections cannot be stored, so they will be re-created whenever the
 	// service reloads.
 	collectionDB map[string]*collectionDB
+	// collectionDBMu protects access to collectionDB
+	collectionDBMu sync.Mutex
+	// syncMu makes sure the blocks are applied to the collections one
+	// after the other, and that no block is applied while state changes
+	// are created from a collection.
+	syncMu sync.Mutex
 
 	// wokersMu protects access to queueWorkers
 	workersMu sync.Mutex
 	// queueWorkers is a map that points to channels that handle queueing and
 	// starting of new blocks.
 	queueWorkers map[string]chan ClientTransaction
+	// queueClosing holds for every queue worker a channel that is closed
+	// once the worker stops, because this node is not the leader anymore.
+	queueClosing map[string]chan bool
 
 	// CloseQueues is closed when the queues should stop - this is mostly for
 	// testing and there should be a better way to clean up services for testing...
@@ -69,6 +80,25 @@ type Service struct {
 	storage *storage
 
 	createSkipChainMut sync.Mutex
+
+	// viewChange monitors the leaders of all skipchains and handles the
+	// view-change if a leader fails.
+	viewChange *viewChange
+	// txPool holds the transactions received by this node that are not
+	// yet included in a block.
+	txPool *txPool
+	// receipts stores the outcome of all transactions handled by the
+	// leaders.
+	receipts *receiptDB
+	// txWaiters holds the channels of the AddTransaction requests waiting
+	// for the inclusion of their transaction.
+	txWaiters *txWaiters
+	// journal stores the state changes of every applied block, to create
+	// proofs for earlier blocks.
+	journal *journalDB
+	// snapshots stores the state of the collections at some blocks, for
+	// the nodes catching up.
+	snapshots *snapshotDB
 }
 
 // storageID reflects the data we're storing - we could store more
@@ -79,6 +109,31 @@ const storageID = "main"
 // transaction is not set.
 var defaultInterval = 5 * time.Second
 
+// defaultMaxBlockSize is used if the MaxBlockSize field in the genesis
+// transaction is not set.
+var defaultMaxBlockSize = 4 * 1000 * 1000
+
+// defaultSnapshotInterval is the number of blocks between two snapshots used
+// by DefaultGenesisMsg.
+var defaultSnapshotInterval = 1000
+
+// MaxProofKeys is the maximum number of keys in a GetProofs request.
+const MaxProofKeys = 1000
+
+// maxProofReplay is the maximum number of blocks replayed to create the
+// proof of an earlier block.
+const maxProofReplay = 10 * 1000
+
+// MaxInclusionWait is the maximum number of block intervals an AddTransaction
+// request waits for its receipt. Bigger values of InclusionWait are reduced
+// to it.
+const MaxInclusionWait = 2 * maxPoolAge
+
+// RebuildCollections can be set before the service starts, so that the
+// collections of all skipchains are dropped and rebuilt by replaying the
+// blocks, even if their roots are correct.
+var RebuildCollections = false
+
 // storage is used to save our data locally.
 type storage struct {
 	sync.Mutex
@@ -122,12 +177,32 @@ func (s *Service) CreateGenesisBlock(req *CreateGenesisBlock) (
 	}
 	intervalBuf := make([]byte, 8)
 	binary.PutVarint(intervalBuf, int64(req.BlockInterval))
+	if req.MaxBlockSize == 0 {
+		req.MaxBlockSize = defaultMaxBlockSize
+	}
+	sizeBuf := make([]byte, 8)
+	binary.PutVarint(sizeBuf, int64(req.MaxBlockSize))
+	if req.SnapshotInterval < 0 {
+		return nil, errors.New("negative snapshot interval")
+	}
+	snapshotBuf := make([]byte, 8)
+	binary.PutVarint(snapshotBuf, int64(req.SnapshotInterval))
+	rosterBuf, err := protobuf.Encode(&req.Roster)
+	if err != nil {
+		return nil, err
+	}
+	versionBuf := make([]byte, 8)
+	binary.PutVarint(versionBuf, int64(CurrentVersion))
 
 	spawn := &Spawn{
 		ContractID: ContractConfigID,
 		Args: Arguments{
 			{Name: "darc", Value: darcBuf},
 			{Name: "block_interval", Value: intervalBuf},
+			{Name: "max_block_size", Value: sizeBuf},
+			{Name: "roster", Value: rosterBuf},
+			{Name: "version", Value: versionBuf},
+			{Name: "snapshot_interval", Value: snapshotBuf},
 		},
 	}
 
@@ -136,7 +211,7 @@ func (s *Service) CreateGenesisBlock(req *CreateGenesisBlock) (
 	transaction := []ClientTransaction{{
 		Instructions: []Instruction{{
 			ObjectID: ObjectID{DarcID: req.GenesisDarc.GetID()},
-			Nonce:    ZeroNonce,
+			Nonce:    OneNonce,
 			Index:    0,
 			Length:   1,
 			Spawn:    spawn,
@@ -149,9 +224,7 @@ func (s *Service) CreateGenesisBlock(req *CreateGenesisBlock) (
 	}
 	s.save()
 
-	s.workersMu.Lock()
-	s.queueWorkers[string(sb.SkipChainID())] = s.createQueueWorker(sb.SkipChainID(), req.BlockInterval)
-	s.workersMu.Unlock()
+	s.startQueueWorker(sb.SkipChainID())
 
 	return &CreateGenesisBlockResponse{
 		Version:   CurrentVersion,
@@ -159,42 +232,121 @@ func (s *Service) CreateGenesisBlock(req *CreateGenesisBlock) (
 	}, nil
 }
 
-// AddTransaction requests to apply a new transaction to the ledger.
+// AddTransaction requests to apply a new transaction to the ledger. It can be
+// sent to any node of the roster. The transaction is kept in the pending pool
+// of the node and forwarded to the leader. If InclusionWait is set in the
+// request, the reply is only sent once the transaction has been included or
+// rejected, or if it didn't get in a block during InclusionWait block
+// intervals, but at most MaxInclusionWait. A transaction that has been
+// rejected before is sent to the leader again, as the reason of its rejection
+// might be gone.
 func (s *Service) AddTransaction(req *AddTxRequest) (*AddTxResponse, error) {
 	if req.Version != CurrentVersion {
 		return nil, errors.New("version mismatch")
 	}
 
-	s.workersMu.Lock()
-	c, ok := s.queueWorkers[string(req.SkipchainID)]
-	s.workersMu.Unlock()
-	if !ok {
+	sb := s.db().GetByID(req.SkipchainID)
+	if sb == nil {
 		return nil, fmt.Errorf("we don't know skipchain ID %x", req.SkipchainID)
 	}
 
 	if len(req.Transaction.Instructions) == 0 {
 		return nil, errors.New("no transactions to add")
 	}
+	size, err := req.Transaction.Size()
+	if err != nil {
+		return nil, err
+	}
+	if maxSize, _ := s.loadMaxBlockSize(sb.SkipChainID()); size > maxSize {
+		return nil, fmt.Errorf("transaction of %d bytes is bigger than the maximum block size of %d bytes",
+			size, maxSize)
+	}
 
-	c <- req.Transaction
+	latest, err := s.db().GetLatest(sb)
+	if err != nil {
+		return nil, err
+	}
+	scID := latest.SkipChainID()
+	txHash := req.Transaction.Hash()
+
+	// The waiter has to be registered before the transaction is sent to
+	// the leader, else we might miss the new block.
+	var done chan TxReceipt
+	if req.InclusionWait > 0 {
+		done = s.txWaiters.add(scID, txHash)
+		defer s.txWaiters.remove(scID, txHash, done)
+	}
+
+	// A transaction that is already included would only be rejected
+	// because of its nonce, and its receipt overwritten.
+	rc, err := s.receipts.get(scID, txHash)
+	if err != nil {
+		return nil, err
+	}
+	resubmitted := rc != nil && rc.Status == TxRejected
+	if rc != nil && rc.Status == TxIncluded {
+		log.Lvl2(s.ServerIdentity(), "transaction is already included")
+	} else if !s.txPool.add(scID, req.Transaction) {
+		log.Lvl2(s.ServerIdentity(), "transaction is already pending")
+	} else if err := s.forwardToLeader(latest, ClientTransactions{req.Transaction}); err != nil {
+		// The transaction stays in the pool and will be forwarded
+		// again if the leader changes.
+		log.Lvl2(s.ServerIdentity(), "couldn't forward transaction to leader:", err)
+	}
+
+	if req.InclusionWait <= 0 {
+		return &AddTxResponse{
+			Version: CurrentVersion,
+		}, nil
+	}
 
+	// The transaction might have been handled already, e.g. if it has
+	// been sent twice. The receipt of an earlier rejection is replaced
+	// by the one of the new block.
+	rc, err = s.receipts.get(scID, txHash)
+	if err != nil {
+		return nil, err
+	}
+	if rc == nil || resubmitted && rc.Status == TxRejected {
+		interval, err := s.loadBlockInterval(scID)
+		if err != nil {
+			return nil, err
+		}
+		wait := req.InclusionWait
+		if wait > MaxInclusionWait {
+			wait = MaxInclusionWait
+		}
+		select {
+		case r := <-done:
+			rc = &r
+		case <-time.After(time.Duration(wait) * interval):
+			rc = &TxReceipt{
+				TxHash: txHash,
+				Status: TxPending,
+			}
+		case <-s.CloseQueues:
+			return nil, errors.New("queues are closed")
+		}
+	}
 	return &AddTxResponse{
 		Version: CurrentVersion,
+		Receipt: rc,
 	}, nil
 }
 
 // GetProof searches for a key and returns a proof of the
-// presence or the absence of this key.
+// presence or the absence of this key. The proof is for the latest block,
+// unless the request asks for an earlier block.
 func (s *Service) GetProof(req *GetProof) (resp *GetProofResponse, err error) {
 	if req.Version != CurrentVersion {
 		return nil, errors.New("version mismatch")
 	}
 	log.Lvlf2("%s: Getting proof for key %x on sc %x", s.ServerIdentity(), req.Key, req.ID)
-	latest, err := s.db().GetLatest(s.db().GetByID(req.ID))
+	coll, genesis, target, err := s.proofState(req.ID, req.BlockID, req.BlockIndex)
 	if err != nil {
 		return
 	}
-	proof, err := NewProof(s.getCollection(req.ID), s.db(), latest.Hash, req.Key)
+	proof, err := newProof(coll, s.db(), genesis, target, req.Key)
 	if err != nil {
 		return
 	}
@@ -205,6 +357,155 @@ func (s *Service) GetProof(req *GetProof) (resp *GetProofResponse, err error) {
 	return
 }
 
+// GetProofs returns one proof of the presence or the absence of all the
+// requested keys.
+func (s *Service) GetProofs(req *GetProofs) (resp *GetProofsResponse, err error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	if len(req.Keys) == 0 || len(req.Keys) > MaxProofKeys {
+		return nil, fmt.Errorf("need between 1 and %d keys", MaxProofKeys)
+	}
+	log.Lvlf2("%s: Getting proof for %d keys on sc %x", s.ServerIdentity(), len(req.Keys), req.ID)
+	coll, genesis, target, err := s.proofState(req.ID, req.BlockID, req.BlockIndex)
+	if err != nil {
+		return
+	}
+	proof, err := newMultiProof(coll, s.db(), genesis, target, req.Keys)
+	if err != nil {
+		return
+	}
+	resp = &GetProofsResponse{
+		Version: CurrentVersion,
+		Proof:   *proof,
+	}
+	return
+}
+
+// proofState returns the collection holding the state of the block to be
+// proven, together with the genesis block and this block. It is the latest
+// block of the skipchain of id, unless blockID or index are given.
+func (s *Service) proofState(id, blockID skipchain.SkipBlockID, index int) (coll collection.Collection,
+	genesis, target *skipchain.SkipBlock, err error) {
+	sb := s.db().GetByID(id)
+	if sb == nil {
+		err = errors.New("didn't find skipchain")
+		return
+	}
+	genesis = s.db().GetByID(sb.SkipChainID())
+	if genesis == nil {
+		err = errors.New("didn't find genesis block")
+		return
+	}
+	latest, err := s.db().GetLatest(sb)
+	if err != nil {
+		return
+	}
+	target = latest
+	switch {
+	case len(blockID) > 0:
+		target = s.db().GetByID(blockID)
+		if target == nil || !target.SkipChainID().Equal(genesis.Hash) {
+			err = errors.New("didn't find block in skipchain")
+			return
+		}
+	case index > 0:
+		target, err = blockByIndex(s.db(), genesis, index)
+		if err != nil {
+			return
+		}
+	}
+	coll = s.getCollection(genesis.Hash).coll
+	if !target.Hash.Equal(latest.Hash) {
+		coll, err = s.collectionAt(target)
+	}
+	return
+}
+
+// GetTxStatus returns the receipt of a client transaction. The receipts are
+// taken from the blocks, so every node can answer this request.
+func (s *Service) GetTxStatus(req *GetTxStatus) (*GetTxStatusResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	if s.db().GetByID(req.SkipchainID) == nil {
+		return nil, fmt.Errorf("we don't know skipchain ID %x", req.SkipchainID)
+	}
+	resp := &GetTxStatusResponse{
+		Version: CurrentVersion,
+		Receipt: TxReceipt{
+			TxHash: req.TxHash,
+			Status: TxUnknown,
+		},
+	}
+	rc, err := s.receipts.get(req.SkipchainID, req.TxHash)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case rc != nil:
+		resp.Receipt = *rc
+	case s.txPool.has(req.SkipchainID, req.TxHash):
+		resp.Receipt.Status = TxPending
+	}
+	return resp, nil
+}
+
+// GetSnapshot returns a chunk of the latest snapshot of the skipchain that is
+// not after the requested block.
+func (s *Service) GetSnapshot(req *GetSnapshot) (*GetSnapshotResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	if s.db().GetByID(req.SkipchainID) == nil {
+		return nil, fmt.Errorf("we don't know skipchain ID %x", req.SkipchainID)
+	}
+	index, info, err := s.snapshots.latest(req.SkipchainID, req.BlockIndex)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, fmt.Errorf("no snapshot until block %d", req.BlockIndex)
+	}
+	if req.Chunk < 0 || req.Chunk >= info.Chunks {
+		return nil, fmt.Errorf("snapshot has no chunk %d", req.Chunk)
+	}
+	entries, err := s.snapshots.chunk(req.SkipchainID, index, req.Chunk)
+	if err != nil {
+		return nil, err
+	}
+	return &GetSnapshotResponse{
+		Version:    CurrentVersion,
+		BlockIndex: index,
+		BlockID:    info.BlockID,
+		Chunks:     info.Chunks,
+		Entries:    entries,
+	}, nil
+}
+
+// GetNonce returns the nonce to use in the next instruction for the given
+// darc.
+func (s *Service) GetNonce(req *GetNonce) (*GetNonceResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	if s.db().GetByID(req.SkipchainID) == nil {
+		return nil, fmt.Errorf("we don't know skipchain ID %x", req.SkipchainID)
+	}
+	last, _, err := loadNonce(s.getCollection(req.SkipchainID).coll, req.DarcID)
+	if err != nil {
+		return nil, err
+	}
+	next, err := last.Next()
+	if err != nil {
+		return nil, err
+	}
+	return &GetNonceResponse{
+		Version: CurrentVersion,
+		Nonce:   next,
+	}, nil
+}
+
 // SetPropagationTimeout overrides the default propagation timeout that is used
 // when a new block is announced to the nodes.
 func (s *Service) SetPropagationTimeout(p time.Duration) {
@@ -220,19 +521,26 @@ func toObjectID(dID darc.ID) ObjectID {
 	}
 }
 
-func (s *Service) verifyAndFilterTxs(scID skipchain.SkipBlockID, ts []ClientTransaction) []ClientTransaction {
+// verifyAndFilterTxs returns the transactions that are correctly signed and
+// the reasons why the other transactions have been rejected.
+func (s *Service) verifyAndFilterTxs(scID skipchain.SkipBlockID, ts []ClientTransaction) ([]ClientTransaction, []RejectedTx) {
 	var validTxs []ClientTransaction
+	var rejected []RejectedTx
 	for _, t := range ts {
 		if err := s.verifyClientTx(scID, t); err != nil {
 			log.Error(err)
+			rejected = append(rejected, RejectedTx{TxHash: t.Hash(), Error: err.Error()})
 			continue
 		}
 		validTxs = append(validTxs, t)
 	}
-	return validTxs
+	return validTxs, rejected
 }
 
 func (s *Service) verifyClientTx(scID skipchain.SkipBlockID, tx ClientTransaction) error {
+	if err := tx.verifyIndices(); err != nil {
+		return err
+	}
 	for _, instr := range tx.Instructions {
 		if err := s.verifyInstruction(scID, instr); err != nil {
 			return err
@@ -242,16 +550,41 @@ func (s *Service) verifyClientTx(scID skipchain.SkipBlockID, tx ClientTransactio
 }
 
 func (s *Service) verifyInstruction(scID skipchain.SkipBlockID, instr Instruction) error {
+	// The nonce is checked again when the instruction is applied, because
+	// another transaction might use it first.
+	if _, err := instr.checkNonce(s.getCollection(scID).coll); err != nil {
+		return err
+	}
+	// The darc is always the latest version, as evolutions are stored
+	// under the base ID.
 	d, err := s.loadLatestDarc(scID, instr.ObjectID.DarcID)
 	if err != nil {
 		return err
 	}
-	req, err := instr.ToDarcRequest()
+	config, err := s.loadConfig(scID)
+	if err != nil {
+		return err
+	}
+	req, err := instr.ToDarcRequest(scID)
 	if err != nil {
 		return err
 	}
-	// TODO we need to use req.VerifyWithCB to search for missing darcs
-	return req.Verify(d)
+	// Delegated darcs are looked up the same way as in loadLatestDarc.
+	cb := darcCallback(s.getCollection(scID).coll)
+	err = req.VerifyWithCB(d, cb)
+	if err == nil || config.version() > 1 {
+		return err
+	}
+	// Skipchains of version 1 still accept the signatures on the old
+	// digest, which doesn't cover the skipchain.
+	reqV1, errV1 := instr.toDarcRequest(scID, 1)
+	if errV1 != nil {
+		return errV1
+	}
+	if reqV1.VerifyWithCB(d, cb) == nil {
+		return nil
+	}
+	return err
 }
 
 // createNewBlock creates a new block and proposes it to the
@@ -262,6 +595,10 @@ func (s *Service) createNewBlock(scID skipchain.SkipBlockID, r *onet.Roster, cts
 	var sb *skipchain.SkipBlock
 	var mr []byte
 	var coll collection.Collection
+	var rejected RejectedTxs
+	// A block without transactions is only allowed if it changes the
+	// roster, e.g. for a view-change.
+	var rosterChange bool
 
 	if scID.IsNull() {
 		// For a genesis block, we create a throwaway collection.
@@ -286,12 +623,10 @@ func (s *Service) createNewBlock(scID skipchain.SkipBlockID, r *onet.Roster, cts
 		}
 		sb = sbLatest.Copy()
 		if r != nil {
+			rosterChange = !r.ID.Equal(sbLatest.Roster.ID)
 			sb.Roster = r
 		}
-		cts = s.verifyAndFilterTxs(sb.SkipChainID(), cts)
-		if len(cts) == 0 {
-			return nil, errors.New("no valid transaction")
-		}
+		cts, rejected = s.verifyAndFilterTxs(sb.SkipChainID(), cts)
 		coll = s.getCollection(scID).coll
 	}
 
@@ -299,28 +634,52 @@ func (s *Service) createNewBlock(scID skipchain.SkipBlockID, r *onet.Roster, cts
 	if err := sortTransactions(cts); err != nil {
 		return nil, err
 	}
+	sortNonces(cts)
 
 	// Create header of skipblock containing only hashes
 	var scs StateChanges
 	var err error
 	var ctsOK ClientTransactions
-	mr, ctsOK, scs, err = s.createStateChanges(coll, cts)
+	var rejectedSC []RejectedTx
+	s.syncMu.Lock()
+	mr, ctsOK, scs, rejectedSC, err = s.createStateChanges(coll, cts)
+	s.syncMu.Unlock()
 	if err != nil {
 		return nil, err
 	}
+	rejected = append(rejected, rejectedSC...)
+	if !scID.IsNull() && len(ctsOK) == 0 && !rosterChange {
+		// The rejected transactions are not worth a block on their
+		// own. They get their receipts right away, and are recorded
+		// in the next block.
+		s.txPool.reject(scID, rejected)
+		s.announceRejected(sb, rejected)
+		return nil, errors.New("no valid transaction")
+	}
+	if !scID.IsNull() {
+		// The roster changes of the config contract take effect in
+		// the block holding them.
+		sb.Roster, _, err = nextRoster(coll, sb.Roster, ctsOK)
+		if err != nil {
+			return nil, err
+		}
+		rejected = append(s.txPool.takeRejected(scID), rejected...)
+	}
 	header := &DataHeader{
 		CollectionRoot:        mr,
 		ClientTransactionHash: ctsOK.Hash(),
 		StateChangesHash:      scs.Hash(),
-		Timestamp:             time.Now().Unix(),
+		Timestamp:             time.Now().UnixNano(),
+		RejectedHash:          rejected.Hash(),
 	}
 	sb.Data, err = network.Marshal(header)
 	if err != nil {
 		return nil, errors.New("Couldn't marshal data: " + err.Error())
 	}
 
-	// Store transactions in the body
-	body := &DataBody{Transactions: ctsOK}
+	// Store transactions in the body, together with the reasons why
+	// the other transactions have been rejected.
+	body := &DataBody{Transactions: ctsOK, Rejected: rejected}
 	sb.Payload, err = network.Marshal(body)
 	if err != nil {
 		return nil, errors.New("Couldn't marshal data: " + err.Error())
@@ -333,6 +692,9 @@ func (s *Service) createNewBlock(scID skipchain.SkipBlockID, r *onet.Roster, cts
 	log.Lvlf2("Storing skipblock with transactions %+v", ctsOK)
 	ssbReply, err := s.skService().StoreSkipBlock(&ssb)
 	if err != nil {
+		if !scID.IsNull() {
+			s.txPool.reject(scID, rejected)
+		}
 		return nil, err
 	}
 
@@ -360,30 +722,66 @@ func (s *Service) updateCollection(msg network.Message) {
 		return
 	}
 
-	sb, err := s.db().GetLatestByID(uc.ID)
-	if err != nil {
-		log.Errorf("didn't find latest block for %x", uc.ID)
+	sb := s.db().GetByID(uc.ID)
+	if sb == nil {
+		log.Errorf("didn't find block %x", uc.ID)
 		return
 	}
-	_, dataI, err := network.Unmarshal(sb.Data, cothority.Suite)
-	data, ok := dataI.(*DataHeader)
-	if err != nil || !ok {
-		log.Error("couldn't unmarshal header")
+	// A node that just joined the roster, or that missed some blocks,
+	// applies the previous blocks first.
+	log.Lvlf2("%s: Updating transactions for %x", s.ServerIdentity(), sb.SkipChainID())
+	if err := s.syncCollection(sb); err != nil {
+		log.Error(s.ServerIdentity(), "couldn't update collection:", err)
 		return
 	}
-	_, bodyI, err := network.Unmarshal(sb.Payload, cothority.Suite)
-	body, ok := bodyI.(*DataBody)
-	if err != nil || !ok {
-		log.Error("couldn't unmarshal body", err, ok)
+	_, body, err := decodeBlock(sb)
+	if err != nil {
+		log.Error(s.ServerIdentity(), err)
 		return
 	}
+	// Every new block shows that the leader is alive. If this node became
+	// the leader through a view-change, it takes over the queue.
+	s.viewChange.newBlock(sb.SkipChainID())
+	s.startMonitor(sb.SkipChainID())
+	if sb.Roster.List[0].Equal(s.ServerIdentity()) {
+		s.startQueueWorker(sb.SkipChainID())
+	}
+	for _, rt := range body.Rejected {
+		s.txPool.remove(sb.SkipChainID(), rt.TxHash)
+	}
+
+	// Remove the included transactions from the pool and give the
+	// pending ones to the new leader, if it changed.
+	s.txPool.update(sb.SkipChainID(), body.Transactions)
+	if sb.Index > 0 && len(sb.BackLinkIDs) > 0 {
+		prev := s.db().GetByID(sb.BackLinkIDs[0])
+		if prev != nil && !prev.Roster.List[0].Equal(sb.Roster.List[0]) {
+			go func() {
+				if err := s.forwardToLeader(sb, s.txPool.get(sb.SkipChainID())); err != nil {
+					log.Error("couldn't forward pending transactions to new leader:", err)
+				}
+			}()
+		}
+	}
+}
 
-	log.Lvlf2("%s: Updating transactions for %x", s.ServerIdentity(), sb.SkipChainID())
-	cdb := s.getCollection(sb.SkipChainID())
-	_, _, scs, err := s.createStateChanges(cdb.coll, body.Transactions)
+// applyBlock applies the transactions of the block to the collection and
+// stores the receipts of all transactions handled in the block.
+func (s *Service) applyBlock(sb *skipchain.SkipBlock) (*DataBody, error) {
+	header, body, err := decodeBlock(sb)
 	if err != nil {
-		log.Error("Couldn't recreate state changes:", err.Error())
-		return
+		return nil, err
+	}
+	// The state changes of a block that has already been applied are
+	// taken from the journal, so that replaying the blocks doesn't depend
+	// on the contracts.
+	cdb := s.getCollection(sb.SkipChainID())
+	scs, found, err := s.journal.get(sb.SkipChainID(), sb.Index)
+	if err != nil || !found || !bytes.Equal(scs.Hash(), header.StateChangesHash) {
+		_, _, scs, _, err = s.createStateChanges(cdb.coll, body.Transactions)
+		if err != nil {
+			return nil, errors.New("couldn't recreate state changes: " + err.Error())
+		}
 	}
 	for _, sc := range scs {
 		log.Lvl2("Storing statechange", sc)
@@ -392,13 +790,255 @@ func (s *Service) updateCollection(msg network.Message) {
 			log.Error("error while storing in collection: " + err.Error())
 		}
 	}
-	if !bytes.Equal(cdb.RootHash(), data.CollectionRoot) {
-		log.Error("hash of collection doesn't correspond to root hash")
+	if !bytes.Equal(cdb.RootHash(), header.CollectionRoot) {
+		return nil, fmt.Errorf("hash of collection doesn't correspond to root hash of block %d", sb.Index)
+	}
+	if err = s.journal.store(sb.SkipChainID(), sb.Index, scs); err != nil {
+		log.Error("couldn't store state changes in journal: " + err.Error())
+	}
+	if err = cdb.setLatest(sb.Index); err != nil {
+		return nil, errors.New("couldn't store index of applied block: " + err.Error())
+	}
+	if err = s.createSnapshot(sb); err != nil {
+		log.Error("couldn't create snapshot: " + err.Error())
+	}
+
+	for _, ct := range body.Transactions {
+		s.storeReceipt(sb.SkipChainID(), &TxReceipt{
+			TxHash:     ct.Hash(),
+			Status:     TxIncluded,
+			BlockIndex: sb.Index,
+			BlockID:    sb.Hash,
+		})
+	}
+	for _, rt := range body.Rejected {
+		s.storeReceipt(sb.SkipChainID(), &TxReceipt{
+			TxHash:  rt.TxHash,
+			Status:  TxRejected,
+			BlockID: sb.Hash,
+			Error:   rt.Error,
+		})
+	}
+	return body, nil
+}
+
+// syncCollection makes sure the collection holds the state after the block
+// sb. The blocks following the latest block applied to the collection are
+// fetched from the roster of sb if they are missing, and applied in order,
+// checking the collection root after every one of them. If the root of the
+// collection is not the one of the latest applied block, or if this index is
+// not known, the collection is rebuilt from the genesis block.
+func (s *Service) syncCollection(sb *skipchain.SkipBlock) error {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+	cdb := s.getCollection(sb.SkipChainID())
+	latest := cdb.latestIndex()
+	if latest > sb.Index {
+		return nil
+	}
+	if latest < sb.Index-1 {
+		log.Lvlf2("%s: catching up on %x from block %d until block %d", s.ServerIdentity(),
+			sb.SkipChainID(), latest+1, sb.Index)
+		// A snapshot of a later block saves replaying the blocks
+		// until it.
+		if err := s.loadSnapshot(sb, latest); err != nil {
+			log.Lvl2(s.ServerIdentity(), "no snapshot to catch up:", err)
+		}
+		latest = cdb.latestIndex()
+	}
+	from := latest
+	if from < 0 {
+		from = 0
+	}
+	blocks, err := s.fetchBlocks(sb, from)
+	if err != nil {
+		return err
+	}
+	blocks = append(blocks, sb)
+	if latest >= 0 {
+		header, _, err := decodeBlock(blocks[0])
+		if err == nil && bytes.Equal(header.CollectionRoot, cdb.RootHash()) {
+			blocks = blocks[1:]
+		} else {
+			log.Warnf("%s: collection of %x doesn't match block %d, rebuilding it",
+				s.ServerIdentity(), sb.SkipChainID(), latest)
+			previous, err := s.fetchBlocks(blocks[0], 0)
+			if err != nil {
+				return err
+			}
+			blocks = append(previous, blocks...)
+			latest = -1
+		}
+	}
+	if latest < 0 {
+		if err = cdb.reset(); err != nil {
+			return err
+		}
+	}
+	for _, b := range blocks {
+		if _, err = s.applyBlock(b); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// collectionAt returns a new collection holding the state after the block
+// sb. It starts from the latest local snapshot that is not after sb, or from
+// an empty collection, and refuses to replay more than maxProofReplay blocks.
+// The state changes of the blocks up to sb are taken from the journal, or
+// recreated from the transactions if they are missing, and the root of the
+// collection is checked against the header of every block.
+func (s *Service) collectionAt(sb *skipchain.SkipBlock) (collection.Collection, error) {
+	coll := collection.New(collection.Data{}, collection.Data{})
+	from := 0
+	snapshot, index, err := s.localSnapshot(sb)
+	if err != nil {
+		log.Lvl2(s.ServerIdentity(), "couldn't use local snapshot:", err)
+	} else if snapshot != nil {
+		coll = *snapshot
+		from = index + 1
+	}
+	if sb.Index+1-from > maxProofReplay {
+		return collection.Collection{}, fmt.Errorf("block %d is too old for a proof", sb.Index)
+	}
+	var blocks []*skipchain.SkipBlock
+	if from <= sb.Index {
+		blocks, err = s.fetchBlocks(sb, from)
+		if err != nil {
+			return collection.Collection{}, err
+		}
+		blocks = append(blocks, sb)
+	}
+	for _, b := range blocks {
+		header, body, err := decodeBlock(b)
+		if err != nil {
+			return collection.Collection{}, err
+		}
+		scs, found, err := s.journal.get(b.SkipChainID(), b.Index)
+		if err != nil || !found || !bytes.Equal(scs.Hash(), header.StateChangesHash) {
+			_, _, scs, _, err = s.createStateChanges(coll, body.Transactions)
+			if err != nil {
+				return collection.Collection{}, errors.New("couldn't recreate state changes: " + err.Error())
+			}
+		}
+		for _, sc := range scs {
+			if err = storeInColl(coll, &sc); err != nil {
+				return collection.Collection{}, err
+			}
+		}
+		if !bytes.Equal(coll.GetRoot(), header.CollectionRoot) {
+			return collection.Collection{}, fmt.Errorf("hash of collection doesn't correspond to root hash of block %d", b.Index)
+		}
+	}
+	return coll, nil
+}
+
+// fetchBlocks returns all blocks before sb, starting with the block with the
+// index from. The blocks missing in the local database are fetched from the
+// roster of sb and checked against the back-links, starting from sb.
+func (s *Service) fetchBlocks(sb *skipchain.SkipBlock, from int) ([]*skipchain.SkipBlock, error) {
+	if from > sb.Index {
+		return nil, fmt.Errorf("block %d is after block %d", from, sb.Index)
+	}
+	blocks := make([]*skipchain.SkipBlock, sb.Index-from)
+	cl := skipchain.NewClient()
+	next := sb
+	for i := sb.Index - 1; i >= from; i-- {
+		if len(next.BackLinkIDs) == 0 {
+			return nil, fmt.Errorf("block %d has no back-link", next.Index)
+		}
+		id := next.BackLinkIDs[0]
+		b := s.db().GetByID(id)
+		if b == nil {
+			var err error
+			b, err = cl.GetSingleBlock(sb.Roster, id)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't fetch block %d: %s", i, err)
+			}
+			if !b.CalculateHash().Equal(id) || b.Index != i {
+				return nil, fmt.Errorf("got a wrong block for index %d", i)
+			}
+			s.db().Store(b)
+		}
+		blocks[i-from] = b
+		next = b
+	}
+	return blocks, nil
+}
+
+// decodeBlock returns the header and the body of the block.
+func decodeBlock(sb *skipchain.SkipBlock) (*DataHeader, *DataBody, error) {
+	_, headerI, err := network.Unmarshal(sb.Data, cothority.Suite)
+	if err != nil {
+		return nil, nil, errors.New("couldn't unmarshal header: " + err.Error())
+	}
+	header, ok := headerI.(*DataHeader)
+	if !ok {
+		return nil, nil, errors.New("block has no header")
+	}
+	_, bodyI, err := network.Unmarshal(sb.Payload, cothority.Suite)
+	if err != nil {
+		return nil, nil, errors.New("couldn't unmarshal body: " + err.Error())
+	}
+	body, ok := bodyI.(*DataBody)
+	if !ok {
+		return nil, nil, errors.New("block has no body")
+	}
+	// The body is not signed, so the rejected transactions are only
+	// trusted if the header commits to them.
+	if !bytes.Equal(header.RejectedHash, body.Rejected.Hash()) {
+		body.Rejected = nil
+	}
+	return header, body, nil
+}
+
+// nextRoster returns the roster of the block holding the transactions cts,
+// where r is the roster of the previous block and coll the collection before
+// the block. The roster changes of the config instructions are applied in
+// order. changed is false if no instruction changes the roster.
+func nextRoster(coll collection.Collection, r *onet.Roster, cts ClientTransactions) (roster *onet.Roster, changed bool, err error) {
+	configID, err := configObjectID(coll)
+	if err != nil {
+		return nil, false, err
+	}
+	roster = r
+	for _, ct := range cts {
+		for _, instr := range ct.Instructions {
+			if instr.Invoke == nil || !bytes.Equal(instr.ObjectID.Slice(), configID.Slice()) {
+				continue
+			}
+			switch instr.Invoke.Command {
+			case CmdAddNode, CmdRemoveNode, CmdRotateLeader:
+			default:
+				continue
+			}
+			node, err := nodeArgument(instr.Invoke.Args)
+			if err != nil {
+				return nil, false, err
+			}
+			roster, err = changeRoster(roster, instr.Invoke.Command, node)
+			if err != nil {
+				return nil, false, err
+			}
+			changed = true
+		}
+	}
+	return roster, changed, nil
+}
+
+// storeReceipt saves the receipt and informs all clients waiting for it.
+func (s *Service) storeReceipt(scID skipchain.SkipBlockID, rc *TxReceipt) {
+	if err := s.receipts.store(scID, rc); err != nil {
+		log.Error("couldn't store receipt:", err)
+	}
+	s.txWaiters.notify(scID, *rc)
 }
 
 func (s *Service) getCollection(id skipchain.SkipBlockID) *collectionDB {
 	idStr := fmt.Sprintf("%x", id)
+	s.collectionDBMu.Lock()
+	defer s.collectionDBMu.Unlock()
 	col := s.collectionDB[idStr]
 	if col == nil {
 		db, name := s.GetAdditionalBucket([]byte(idStr))
@@ -420,35 +1060,38 @@ func (s *Service) db() *skipchain.SkipBlockDB {
 
 func (s *Service) loadConfig(scID skipchain.SkipBlockID) (*Config, error) {
 	coll := s.getCollection(scID)
-	// Find the genesis-darc ID.
-	val, contract, err := coll.GetValueContract(GenesisReferenceID.Slice())
+	configID, err := configObjectID(coll.coll)
 	if err != nil {
 		return nil, err
 	}
-	if string(contract) != ContractConfigID {
-		return nil, errors.New("did not get " + ContractConfigID)
-	}
-	if len(val) != 32 {
-		return nil, errors.New("value has a invalid length")
-	}
-	// Use the genesis-darc ID to create the config key and read the config.
-	configID := ObjectID{
-		DarcID:     darc.ID(val),
-		InstanceID: OneNonce,
-	}
-	val, contract, err = coll.GetValueContract(configID.Slice())
+	val, contract, err := coll.GetValueContract(configID.Slice())
 	if err != nil {
 		return nil, err
 	}
 	if string(contract) != ContractConfigID {
 		return nil, errors.New("did not get " + ContractConfigID)
 	}
-	config := Config{}
-	err = protobuf.Decode(val, &config)
+	return decodeConfig(val)
+}
+
+// configObjectID returns the key of the config instance in the collection.
+func configObjectID(coll collection.Collection) (ObjectID, error) {
+	// Find the genesis-darc ID.
+	val, contract, err := getValueContract(coll, GenesisReferenceID.Slice())
 	if err != nil {
-		return nil, err
+		return ObjectID{}, err
+	}
+	if string(contract) != ContractConfigID {
+		return ObjectID{}, errors.New("did not get " + ContractConfigID)
+	}
+	if len(val) != 32 {
+		return ObjectID{}, errors.New("value has a invalid length")
 	}
-	return &config, nil
+	// Use the genesis-darc ID to create the config key.
+	return ObjectID{
+		DarcID:     darc.ID(val),
+		InstanceID: OneNonce,
+	}, nil
 }
 
 func (s *Service) loadBlockInterval(scID skipchain.SkipBlockID) (time.Duration, error) {
@@ -459,50 +1102,157 @@ func (s *Service) loadBlockInterval(scID skipchain.SkipBlockID) (time.Duration,
 	return config.BlockInterval, nil
 }
 
+func (s *Service) loadMaxBlockSize(scID skipchain.SkipBlockID) (int, error) {
+	config, err := s.loadConfig(scID)
+	if err != nil {
+		return defaultMaxBlockSize, err
+	}
+	// Skipchains created before the maximum block size was introduced
+	// don't have it in their config.
+	if config.MaxBlockSize <= 0 {
+		return defaultMaxBlockSize, nil
+	}
+	return config.MaxBlockSize, nil
+}
+
 func (s *Service) loadLatestDarc(sid skipchain.SkipBlockID, dID darc.ID) (*darc.Darc, error) {
 	colldb := s.getCollection(sid)
 	if colldb == nil {
 		return nil, fmt.Errorf("collection for skipchain ID %s does not exist", sid.Short())
 	}
-	value, contract, err := colldb.GetValueContract(toObjectID(dID).Slice())
+	return loadDarc(colldb.coll, dID)
+}
+
+// loadDarc returns the latest version of the darc with the given base ID
+// stored in the collection.
+func loadDarc(coll collection.Collection, dID darc.ID) (*darc.Darc, error) {
+	value, contract, err := getValueContract(coll, toObjectID(dID).Slice())
 	if err != nil {
 		return nil, err
 	}
-	if string(contract) != "darc" {
+	if string(contract) != ContractDarcID {
 		return nil, fmt.Errorf("for darc %x, expected Kind to be 'darc' but got '%v'", dID, string(contract))
 	}
 	return darc.NewDarcFromProto(value)
 }
 
+// darcCallback returns the callback used by the darc package to look up the
+// latest version of delegated darcs in the collection.
+func darcCallback(coll collection.Collection) func(string) *darc.Darc {
+	return func(id string) *darc.Darc {
+		dID, err := darcIDFromString(id)
+		if err != nil {
+			return nil
+		}
+		d, err := loadDarc(coll, dID)
+		if err != nil {
+			return nil
+		}
+		return d
+	}
+}
+
+// darcIDFromString returns the darc ID of an identity string of the form
+// "darc:<hex>".
+func darcIDFromString(id string) (darc.ID, error) {
+	if !strings.HasPrefix(id, "darc:") {
+		return nil, errors.New("not a darc identity: " + id)
+	}
+	return hex.DecodeString(strings.TrimPrefix(id, "darc:"))
+}
+
+// startQueueWorker creates a queue worker for the given skipchain, if none
+// is running yet.
+func (s *Service) startQueueWorker(scID skipchain.SkipBlockID) {
+	s.workersMu.Lock()
+	defer s.workersMu.Unlock()
+	if _, ok := s.queueWorkers[string(scID)]; ok {
+		return
+	}
+	interval, err := s.loadBlockInterval(scID)
+	if err != nil {
+		log.Lvl2(s.ServerIdentity(), "couldn't load block interval:", err)
+	}
+	closing := make(chan bool)
+	s.queueWorkers[string(scID)] = s.createQueueWorker(scID, interval, closing)
+	s.queueClosing[string(scID)] = closing
+}
+
+// stopQueueWorker removes the queue worker of the given skipchain and
+// closes its closing-channel, so that no more transactions are sent to it.
+func (s *Service) stopQueueWorker(scID skipchain.SkipBlockID) {
+	s.workersMu.Lock()
+	defer s.workersMu.Unlock()
+	if closing, ok := s.queueClosing[string(scID)]; ok {
+		close(closing)
+	}
+	delete(s.queueWorkers, string(scID))
+	delete(s.queueClosing, string(scID))
+}
+
 // createQueueWorker sets up a worker that will listen on a channel for
-// incoming requests and then create a new block every epoch.
-func (s *Service) createQueueWorker(scID skipchain.SkipBlockID, interval time.Duration) chan ClientTransaction {
+// incoming requests and then create a new block every epoch. The worker
+// stops as soon as this node is not the leader of the skipchain anymore, and
+// forwards the transactions still in its queue to the new leader.
+// The configuration is read again after every epoch, so that changes of the
+// block interval or the maximum block size are used from the next block on.
+func (s *Service) createQueueWorker(scID skipchain.SkipBlockID, interval time.Duration, closing chan bool) chan ClientTransaction {
 	c := make(chan ClientTransaction)
 	go func() {
 		ts := []ClientTransaction{}
+		// queued is used to ignore transactions that are forwarded
+		// more than once.
+		queued := map[string]bool{}
 		to := time.After(interval)
 		for {
 			select {
 			case t := <-c:
+				key := string(t.Hash())
+				if queued[key] {
+					continue
+				}
+				queued[key] = true
 				ts = append(ts, t)
 				log.Lvlf2("%x: Stored transaction %+v - length is %d: %+v", scID, t, len(ts), ts)
 			case <-to:
 				log.Lvlf2("%x: New epoch and transaction-length: %d", scID, len(ts))
+				sb, err := s.db().GetLatest(s.db().GetByID(scID))
+				if err != nil {
+					panic("DB is in bad state and cannot find skipchain anymore: " + err.Error())
+				}
+				if !sb.Roster.List[0].Equal(s.ServerIdentity()) {
+					log.Lvlf2("%s: not leader of %x anymore, forwarding %d transactions",
+						s.ServerIdentity(), scID, len(ts))
+					s.stopQueueWorker(scID)
+					if err := s.forwardToLeader(sb, ts); err != nil {
+						log.Error("couldn't forward queued transactions to new leader:", err)
+					}
+					return
+				}
 				if len(ts) > 0 {
-					sb, err := s.db().GetLatest(s.db().GetByID(scID))
-					if err != nil {
-						panic("DB is in bad state and cannot find skipchain anymore: " + err.Error())
+					// The transactions that don't fit in this
+					// block stay in the queue for the next one.
+					// Only those are still ignored if they are
+					// forwarded again, as the others are either
+					// in the block or dropped.
+					var block ClientTransactions
+					block, ts = s.fillBlock(scID, ts)
+					queued = map[string]bool{}
+					for _, t := range ts {
+						queued[string(t.Hash())] = true
 					}
-					_, err = s.createNewBlock(scID, sb.Roster, ts)
-					// We empty ts because createNewBlock only returns an error only if it's a critical failure.
-					ts = []ClientTransaction{}
-					if err != nil {
+					// createNewBlock only returns an error if it is a critical failure, so the transactions of the block are dropped.
+					if _, err = s.createNewBlock(scID, sb.Roster, block); err != nil {
 						log.Error("couldn't create new block: " + err.Error())
-						to = time.After(interval)
-						continue
 					}
 				}
+				interval, err = s.loadBlockInterval(scID)
+				if err != nil {
+					log.Error("couldn't load block interval:", err)
+				}
 				to = time.After(interval)
+			case <-closing:
+				return
 			case <-s.CloseQueues:
 				log.Lvlf2("closing queues...")
 				return
@@ -512,6 +1262,32 @@ func (s *Service) createQueueWorker(scID skipchain.SkipBlockID, interval time.Du
 	return c
 }
 
+// fillBlock returns the transactions of the queue that fit in the next block,
+// and the ones that have to wait for a later block. The transactions of every
+// darc are kept in the order of their nonces. A transaction bigger than the
+// maximum block size is dropped.
+func (s *Service) fillBlock(scID skipchain.SkipBlockID, ts ClientTransactions) (block, rest ClientTransactions) {
+	maxSize, err := s.loadMaxBlockSize(scID)
+	if err != nil {
+		log.Error("couldn't load maximum block size:", err)
+	}
+	sortNonces(ts)
+	var size int
+	for _, t := range ts {
+		tSize, err := t.Size()
+		switch {
+		case err != nil || tSize > maxSize:
+			log.Lvlf2("%x: dropping transaction %x that is bigger than the maximum block size", scID, t.Hash())
+		case len(rest) == 0 && size+tSize <= maxSize:
+			size += tSize
+			block = append(block, t)
+		default:
+			rest = append(rest, t)
+		}
+	}
+	return block, rest
+}
+
 // We use the omniledger as a receiver (as is done in the identity service),
 // so we can access e.g. the collectionDBs of the service.
 func (s *Service) verifySkipBlock(newID []byte, newSB *skipchain.SkipBlock) bool {
@@ -532,13 +1308,90 @@ func (s *Service) verifySkipBlock(newID []byte, newSB *skipchain.SkipBlock) bool
 		log.Lvl2(s.ServerIdentity(), "Client Transaction Hash doesn't verify")
 		return false
 	}
+	if bytes.Compare(header.RejectedHash, body.Rejected.Hash()) != 0 {
+		log.Lvl2(s.ServerIdentity(), "Rejected Transaction Hash doesn't verify")
+		return false
+	}
+	// A follower that missed some blocks first needs the state before the
+	// new block.
+	if newSB.Index > 0 && len(newSB.BackLinkIDs) > 0 {
+		if prev := s.db().GetByID(newSB.BackLinkIDs[0]); prev != nil {
+			if err = s.syncCollection(prev); err != nil {
+				log.Lvl2(s.ServerIdentity(), "Couldn't catch up:", err)
+				return false
+			}
+		}
+	}
+	// The leader must not include partial or reordered client
+	// transactions, nor instructions that are not authorised by their
+	// darc. The followers run the same checks as the leader against their
+	// own collection, except for the genesis transaction, which is not
+	// signed.
+	maxSize, _ := s.loadMaxBlockSize(newSB.SkipChainID())
+	var size int
+	for _, ct := range body.Transactions {
+		if newSB.Index == 0 {
+			err = ct.verifyIndices()
+		} else {
+			err = s.verifyClientTx(newSB.SkipChainID(), ct)
+		}
+		if err != nil {
+			log.Lvl2(s.ServerIdentity(), "Invalid client transaction:", err)
+			return false
+		}
+		ctSize, err := ct.Size()
+		if err != nil {
+			log.Lvl2(s.ServerIdentity(), "Couldn't encode client transaction:", err)
+			return false
+		}
+		size += ctSize
+	}
+	if size > maxSize {
+		log.Lvl2(s.ServerIdentity(), "Block is bigger than the maximum block size")
+		return false
+	}
+	cdb := s.getCollection(newSB.SkipChainID())
+	if newSB.Index > 0 && len(newSB.BackLinkIDs) > 0 {
+		prev := s.db().GetByID(newSB.BackLinkIDs[0])
+		if prev == nil {
+			log.Lvl2(s.ServerIdentity(), "Don't have previous block")
+			return false
+		}
+		roster, changed, err := nextRoster(cdb.coll, prev.Roster, body.Transactions)
+		if err != nil {
+			log.Lvl2(s.ServerIdentity(), "Invalid roster change:", err)
+			return false
+		}
+		switch {
+		case changed:
+			if !sameRoster(roster, newSB.Roster) {
+				log.Lvl2(s.ServerIdentity(), "Roster doesn't match the roster changes of the block")
+				return false
+			}
+		case !prev.Roster.List[0].Equal(newSB.Roster.List[0]):
+			if err := s.verifyViewChange(prev, newSB, body); err != nil {
+				log.Lvl2(s.ServerIdentity(), "Refusing view-change:", err)
+				return false
+			}
+		case !sameRoster(prev.Roster, newSB.Roster):
+			log.Lvl2(s.ServerIdentity(), "Roster changed without an instruction")
+			return false
+		}
+	}
 	ctx := body.Transactions
-	cdb := s.getCollection(newSB.Hash)
-	mtr, _, scs, err := s.createStateChanges(cdb.coll, ctx)
+	s.syncMu.Lock()
+	mtr, _, scs, rejected, err := s.createStateChanges(cdb.coll, ctx)
+	s.syncMu.Unlock()
 	if err != nil {
 		log.Error("Couldn't create state changes:", err)
 		return false
 	}
+	// An honest leader only includes transactions that can be applied,
+	// e.g. none with a stale nonce.
+	if len(rejected) > 0 {
+		log.Lvl2(s.ServerIdentity(), "Block contains invalid transaction:", rejected[0].Error)
+		return false
+	}
 	if bytes.Compare(header.CollectionRoot, mtr) != 0 {
 		log.Lvl2(s.ServerIdentity(), "Collection root doesn't verify")
 		return false
@@ -551,22 +1404,37 @@ func (s *Service) verifySkipBlock(newID []byte, newSB *skipchain.SkipBlock) bool
 }
 
 // createStateChanges goes through all ClientTransactions and creates
-// the appropriate StateChanges. If any of the transactions are invalid,
-// it returns an error.
-func (s *Service) createStateChanges(coll collection.Collection, cts ClientTransactions) (merkleRoot []byte, ctsOK ClientTransactions, states StateChanges, err error) {
-
-	// TODO: Because we depend on making at least one clone per transaction
-	// we need to find out if this is as expensive as it looks, and if so if
-	// we could use some kind of copy-on-write technique.
-
+// the appropriate StateChanges. The transactions that cannot be applied are
+// returned in rejected, together with the reason of the failure. The caller
+// must hold syncMu if coll is the collection of a skipchain.
+func (s *Service) createStateChanges(coll collection.Collection, cts ClientTransactions) (merkleRoot []byte, ctsOK ClientTransactions, states StateChanges, rejected []RejectedTx, err error) {
+	// The clones share their nodes until they change them, so making one
+	// per transaction only costs the nodes on the paths of its changes.
+	// They are closed once they are not used anymore, so that the storage
+	// doesn't keep their nodes.
 	cdbTemp := coll.Clone()
+	defer func() { cdbTemp.Close() }()
 clientTransactions:
 	for _, ct := range cts {
 		cdbI := cdbTemp.Clone()
+		reject := func(reason string) {
+			cdbI.Close()
+			rejected = append(rejected, RejectedTx{TxHash: ct.Hash(), Error: reason})
+		}
+		// The state changes are only kept if all instructions of the
+		// client transaction succeed.
+		var ctStates StateChanges
 		for _, instr := range ct.Instructions {
+			nonceSC, err := instr.checkNonce(cdbI)
+			if err != nil {
+				log.Lvl1("Refusing instruction:", err)
+				reject(err.Error())
+				continue clientTransactions
+			}
 			kind, _, err := instr.GetContractState(cdbI)
 			if err != nil {
 				log.Lvl1("Couldn't get kind of instruction")
+				reject("couldn't get kind of instruction: " + err.Error())
 				continue clientTransactions
 			}
 
@@ -575,6 +1443,7 @@ clientTransactions:
 			// transaction.
 			if !exists {
 				log.Lvl1("Leader is dropping instruction of unknown kind:", kind)
+				reject("unknown contract: " + kind)
 				continue clientTransactions
 			}
 			// Now we call the contract function with the data of the key:
@@ -582,20 +1451,32 @@ clientTransactions:
 			scs, _, err := f(cdbI, instr, nil)
 			if err != nil {
 				log.Lvl1("Call to contract returned error:", err)
+				reject("contract " + kind + " returned error: " + err.Error())
 				continue clientTransactions
 			}
+			// The nonces can only be changed by the service.
+			for _, sc := range scs {
+				if isNonceKey(sc.ObjectID) {
+					reject("contract " + kind + " tried to change a nonce")
+					continue clientTransactions
+				}
+			}
+			scs = append(scs, nonceSC)
 			for _, sc := range scs {
 				if err := storeInColl(cdbI, &sc); err != nil {
 					log.Lvl1("failed to add to collections with error: " + err.Error())
+					reject("failed to apply state change: " + err.Error())
 					continue clientTransactions
 				}
 			}
-			states = append(states, scs...)
+			ctStates = append(ctStates, scs...)
 		}
+		cdbTemp.Close()
 		cdbTemp = cdbI
 		ctsOK = append(ctsOK, ct)
+		states = append(states, ctStates...)
 	}
-	return cdbTemp.GetRoot(), ctsOK, states, nil
+	return cdbTemp.GetRoot(), ctsOK, states, rejected, nil
 }
 
 // registerContract stores the contract in a map and will
@@ -625,8 +1506,13 @@ func (s *Service) tryLoad() error {
 	if s.storage == nil {
 		s.storage = &storage{}
 	}
+	s.collectionDBMu.Lock()
 	s.collectionDB = map[string]*collectionDB{}
+	s.collectionDBMu.Unlock()
+	s.workersMu.Lock()
 	s.queueWorkers = map[string]chan ClientTransaction{}
+	s.queueClosing = map[string]chan bool{}
+	s.workersMu.Unlock()
 
 	gas := &skipchain.GetAllSkipchains{}
 	gasr, err := s.skService().GetAllSkipchains(gas)
@@ -634,19 +1520,53 @@ func (s *Service) tryLoad() error {
 		return err
 	}
 
+	// The configuration of a collection stored in an older format is
+	// missing until syncAll rebuilt it. In the meantime, the queue workers
+	// and the monitors use the default block interval.
 	for _, sb := range gasr.SkipChains {
-		interval, err := s.loadBlockInterval(sb.Hash)
+		latest, err := s.db().GetLatest(sb)
 		if err != nil {
 			return err
 		}
-		// At this point the service is not yet up, so no need to
-		// protect access to queueWorkers with a mutex.
-		s.queueWorkers[string(sb.Hash)] = s.createQueueWorker(sb.Hash, interval)
+		// Only the leader creates new blocks, all the others monitor
+		// it and start a view-change if it fails.
+		if latest.Roster.List[0].Equal(s.ServerIdentity()) {
+			s.startQueueWorker(sb.Hash)
+		}
+		s.startMonitor(sb.Hash)
 	}
 
 	return nil
 }
 
+// syncAll makes sure the collections of all skipchains hold the state of
+// their latest block. The node might have been down while new blocks were
+// added, or stopped while applying a block. The collections read from the
+// disk are also checked against the root of their latest block. It needs the
+// contracts, so it is called once they are registered.
+func (s *Service) syncAll() error {
+	gasr, err := s.skService().GetAllSkipchains(&skipchain.GetAllSkipchains{})
+	if err != nil {
+		return err
+	}
+	for _, sb := range gasr.SkipChains {
+		latest, err := s.db().GetLatest(sb)
+		if err != nil {
+			return err
+		}
+		if RebuildCollections {
+			log.Lvlf1("%s: rebuilding collection of %x", s.ServerIdentity(), sb.Hash)
+			if err = s.getCollection(sb.Hash).reset(); err != nil {
+				return err
+			}
+		}
+		if err = s.syncCollection(latest); err != nil {
+			log.Error(s.ServerIdentity(), "couldn't catch up:", err)
+		}
+	}
+	return nil
+}
+
 // saves all skipblocks.
 func (s *Service) save() {
 	s.storage.Lock()
@@ -666,11 +1586,24 @@ func newService(c *onet.Context) (onet.Service, error) {
 		ServiceProcessor: onet.NewServiceProcessor(c),
 		CloseQueues:      make(chan bool),
 		contracts:        make(map[string]OmniLedgerContract),
-	}
+		viewChange:       newViewChange(),
+		txPool:           newTxPool(),
+		txWaiters:        newTxWaiters(),
+	}
+	db, name := s.GetAdditionalBucket([]byte("receipts"))
+	s.receipts = newReceiptDB(db, name)
+	db, name = s.GetAdditionalBucket([]byte("journal"))
+	s.journal = newJournalDB(db, name)
+	db, name = s.GetAdditionalBucket([]byte("snapshots"))
+	s.snapshots = newSnapshotDB(db, name)
 	if err := s.RegisterHandlers(s.CreateGenesisBlock, s.AddTransaction,
-		s.GetProof); err != nil {
+		s.GetProof, s.GetProofs, s.GetTxStatus, s.GetNonce, s.GetSnapshot); err != nil {
 		log.ErrFatal(err, "Couldn't register messages")
 	}
+	s.RegisterProcessorFunc(heartbeatID, s.handleHeartbeat)
+	s.RegisterProcessorFunc(viewChangeReqID, s.handleViewChangeReq)
+	s.RegisterProcessorFunc(forwardTxsID, s.handleForwardTxs)
+	s.RegisterProcessorFunc(rejectedTxsID, s.handleRejectedTxs)
 	if err := s.tryLoad(); err != nil {
 		log.Error(err)
 		return nil, err
@@ -685,5 +1618,9 @@ func newService(c *onet.Context) (onet.Service, error) {
 	s.registerContract(ContractConfigID, s.ContractConfig)
 	s.registerContract(ContractDarcID, s.ContractDarc)
 	skipchain.RegisterVerification(c, verifyOmniLedger, s.verifySkipBlock)
+	if err := s.syncAll(); err != nil {
+		log.Error(err)
+		return nil, err
+	}
 	return s, nil
 }
@@ -4,18 +4,23 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"reflect"
 	"testing"
 	"time"
 
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/protobuf"
 	"github.com/dedis/student_18_omniledger/omniledger/collection"
 	"github.com/dedis/student_18_omniledger/omniledger/darc"
+	"github.com/dedis/student_18_omniledger/omniledger/darc/expression"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/dedis/cothority.v2/skipchain"
 	"gopkg.in/dedis/kyber.v2/suites"
 	"gopkg.in/dedis/onet.v2"
 	"gopkg.in/dedis/onet.v2/log"
+	"gopkg.in/dedis/onet.v2/network"
 )
 
 var tSuite = suites.MustFind("Ed25519")
@@ -91,7 +96,7 @@ func TestService_AddKeyValue(t *testing.T) {
 
 	// the operations below should succeed
 	// add the first tx
-	tx1, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	tx1, err := createOneClientTx(s.sb.SkipChainID(), s.darc.GetBaseID(), dummyKind, s.value, s.signer)
 	require.Nil(t, err)
 	akvresp, err = s.service().AddTransaction(&AddTxRequest{
 		Version:     CurrentVersion,
@@ -104,7 +109,7 @@ func TestService_AddKeyValue(t *testing.T) {
 
 	// add the second tx
 	value2 := []byte("value2")
-	tx2, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, value2, s.signer)
+	tx2, err := createOneClientTx(s.sb.SkipChainID(), s.darc.GetBaseID(), dummyKind, value2, s.signer)
 	require.Nil(t, err)
 	akvresp, err = s.service().AddTransaction(&AddTxRequest{
 		Version:     CurrentVersion,
@@ -149,6 +154,78 @@ func TestService_AddKeyValue(t *testing.T) {
 	}
 }
 
+func TestService_AddTransactionFollower(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+
+	// The follower must accept the transaction and forward it to the
+	// leader.
+	value := []byte("follower")
+	tx, err := createOneClientTx(s.sb.SkipChainID(), s.darc.GetBaseID(), dummyKind, value, s.signer)
+	require.Nil(t, err)
+	resp, err := s.services[1].AddTransaction(&AddTxRequest{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		Transaction: tx,
+	})
+	require.Nil(t, err)
+	require.Equal(t, CurrentVersion, resp.Version)
+	require.Equal(t, 1, len(s.services[1].txPool.get(s.sb.SkipChainID())))
+
+	var i int
+	for i = 0; i < 10; i++ {
+		time.Sleep(2 * s.interval)
+		pr, err := s.services[1].GetProof(&GetProof{
+			Version: CurrentVersion,
+			ID:      s.sb.SkipChainID(),
+			Key:     tx.Instructions[0].ObjectID.Slice(),
+		})
+		require.Nil(t, err)
+		if pr.Proof.InclusionProof.Match() {
+			_, vs, err := pr.Proof.KeyValue()
+			require.Nil(t, err)
+			require.Equal(t, value, vs[0])
+			break
+		}
+	}
+	require.NotEqual(t, 10, i, "transaction didn't get included")
+
+	// Once included, the transaction must be removed from the pool.
+	require.Equal(t, 0, len(s.services[1].txPool.get(s.sb.SkipChainID())))
+}
+
+func TestTxPool(t *testing.T) {
+	p := newTxPool()
+	scID := getSBID("pool")
+	tx1, err := createOneClientTx(scID, darcidStr("darc"), dummyKind, []byte("1"), darc.NewSignerEd25519(nil, nil))
+	require.Nil(t, err)
+	tx2, err := createOneClientTx(scID, darcidStr("darc"), dummyKind, []byte("2"), darc.NewSignerEd25519(nil, nil))
+	require.Nil(t, err)
+
+	// A copy of a transaction with forged signatures doesn't take the
+	// place of the transaction.
+	instr := tx2.Instructions[0]
+	instr.Signatures = []darc.Signature{{Signature: []byte("forged"), Signer: instr.Signatures[0].Signer}}
+	forged := ClientTransaction{Instructions: Instructions{instr}}
+	require.True(t, p.add(scID, forged))
+
+	require.True(t, p.add(scID, tx1))
+	require.False(t, p.add(scID, tx1))
+	require.True(t, p.add(scID, tx2))
+	require.Equal(t, 3, len(p.get(scID)))
+
+	p.update(scID, ClientTransactions{tx1, forged})
+	require.Equal(t, 1, len(p.get(scID)))
+	require.Equal(t, tx2.Hash(), p.get(scID)[0].Hash())
+
+	// tx2 is never included and must be dropped after some blocks.
+	for i := 0; i < maxPoolAge; i++ {
+		p.update(scID, nil)
+	}
+	require.Equal(t, 0, len(p.get(scID)))
+}
+
 func TestService_GetProof(t *testing.T) {
 	s := newSer(t, 2, testInterval)
 	defer s.local.CloseAll()
@@ -190,6 +267,217 @@ func TestService_GetProof(t *testing.T) {
 	require.NotNil(t, err)
 }
 
+func TestService_ProofFresh(t *testing.T) {
+	s := newSer(t, 2, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+
+	scID := s.sb.SkipChainID()
+	serKey := s.tx.Instructions[0].ObjectID.Slice()
+	rep, err := s.service().GetProof(&GetProof{
+		Version: CurrentVersion,
+		ID:      scID,
+		Key:     serKey,
+	})
+	require.Nil(t, err)
+	require.Nil(t, rep.Proof.VerifyFresh(scID, time.Minute))
+
+	reps, err := s.service().GetProofs(&GetProofs{
+		Version: CurrentVersion,
+		ID:      scID,
+		Keys:    [][]byte{serKey, append(serKey, byte(0))},
+	})
+	require.Nil(t, err)
+	require.Nil(t, reps.Proof.VerifyFresh(scID, time.Minute))
+
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, ErrorVerifyStale, rep.Proof.VerifyFresh(scID, time.Millisecond))
+	require.Equal(t, ErrorVerifyStale, reps.Proof.VerifyFresh(scID, time.Millisecond))
+}
+
+func TestService_HistoricalProof(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+
+	scID := s.sb.SkipChainID()
+	send := func(value []byte) (ClientTransaction, *TxReceipt) {
+		tx, err := createOneClientTx(scID, s.darc.GetBaseID(), dummyKind, value, s.signer)
+		require.Nil(t, err)
+		resp, err := s.service().AddTransaction(&AddTxRequest{
+			Version:       CurrentVersion,
+			SkipchainID:   scID,
+			Transaction:   tx,
+			InclusionWait: 10,
+		})
+		require.Nil(t, err)
+		require.Equal(t, TxIncluded, resp.Receipt.Status)
+		return tx, resp.Receipt
+	}
+	tx1, rc1 := send([]byte("first"))
+	tx2, rc2 := send([]byte("second"))
+	require.True(t, rc1.BlockIndex < rc2.BlockIndex)
+	key1 := tx1.Instructions[0].ObjectID.Slice()
+	key2 := tx2.Instructions[0].ObjectID.Slice()
+
+	getProof := func(req GetProof) *Proof {
+		req.Version = CurrentVersion
+		req.ID = scID
+		rep, err := s.services[1].GetProof(&req)
+		require.Nil(t, err)
+		require.Nil(t, rep.Proof.Verify(scID))
+		return &rep.Proof
+	}
+
+	// At the block of the first transaction, only the first key is
+	// stored, both by ID and by index.
+	for _, req := range []GetProof{{BlockID: rc1.BlockID}, {BlockIndex: rc1.BlockIndex}} {
+		req.Key = key1
+		p := getProof(req)
+		require.True(t, p.InclusionProof.Match())
+		require.True(t, p.Latest.Hash.Equal(rc1.BlockID))
+		req.Key = key2
+		require.False(t, getProof(req).InclusionProof.Match())
+	}
+	// The genesis block holds neither.
+	require.False(t, getProof(GetProof{BlockID: scID, Key: key1}).InclusionProof.Match())
+	require.True(t, getProof(GetProof{Key: key2}).InclusionProof.Match())
+
+	// Without the journal, the state is recreated from the transactions.
+	j := s.services[1].journal
+	require.Nil(t, j.db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(j.bucketName)
+	}))
+	coll, err := s.services[1].collectionAt(s.services[1].db().GetByID(rc1.BlockID))
+	require.Nil(t, err)
+	_, _, err = getValueContract(coll, key1)
+	require.Nil(t, err)
+	_, _, err = getValueContract(coll, key2)
+	require.NotNil(t, err)
+
+	// Unknown blocks are refused.
+	_, err = s.service().GetProof(&GetProof{Version: CurrentVersion, ID: scID,
+		Key: key1, BlockIndex: rc2.BlockIndex + 100})
+	require.NotNil(t, err)
+	_, err = s.service().GetProof(&GetProof{Version: CurrentVersion, ID: scID,
+		Key: key1, BlockID: getSBID("unknown")})
+	require.NotNil(t, err)
+}
+
+func TestService_RestartOldFormat(t *testing.T) {
+	s := newSer(t, 2, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+
+	// Store the collection of the leader as it was stored before the
+	// format was introduced: only the key/value pairs in one bucket.
+	scID := s.sb.SkipChainID()
+	cdb := s.service().getCollection(scID)
+	latest := cdb.latestIndex()
+	entries, err := cdb.entries()
+	require.Nil(t, err)
+	require.Nil(t, cdb.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{cdb.metaName, cdb.nodesName, cdb.bucketName} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		b, err := tx.CreateBucket(cdb.bucketName)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err = b.Put(e.Key, e.Value); err != nil {
+				return err
+			}
+			keykind := append(append([]byte{}, e.Key...), 0, 0, 0, 0)
+			keykind = append(keykind, []byte("kind")...)
+			if err = b.Put(keykind, e.ContractID); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	// The service starts without the configuration of the ledger and
+	// rebuilds the collection from the blocks.
+	require.Nil(t, s.service().tryLoad())
+	require.Nil(t, s.service().syncAll())
+	cdb = s.service().getCollection(scID)
+	require.Equal(t, latest, cdb.latestIndex())
+	rebuilt, err := cdb.entries()
+	require.Nil(t, err)
+	require.Equal(t, entries, rebuilt)
+	_, _, err = cdb.GetValueContract(s.tx.Instructions[0].ObjectID.Slice())
+	require.Nil(t, err)
+}
+
+func TestService_CatchUp(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+
+	scID := s.sb.SkipChainID()
+	send := func(value []byte) (ClientTransaction, *TxReceipt) {
+		tx, err := createOneClientTx(scID, s.darc.GetBaseID(), dummyKind, value, s.signer)
+		require.Nil(t, err)
+		resp, err := s.service().AddTransaction(&AddTxRequest{
+			Version:       CurrentVersion,
+			SkipchainID:   scID,
+			Transaction:   tx,
+			InclusionWait: 10,
+		})
+		require.Nil(t, err)
+		require.Equal(t, TxIncluded, resp.Receipt.Status)
+		return tx, resp.Receipt
+	}
+	_, rc1 := send([]byte("first"))
+	tx2, rc2 := send([]byte("second"))
+	key2 := tx2.Instructions[0].ObjectID.Slice()
+
+	follower := s.services[1]
+	cdb := follower.getCollection(scID)
+	var i int
+	for i = 0; i < 10; i++ {
+		if cdb.latestIndex() == rc2.BlockIndex {
+			break
+		}
+		time.Sleep(testInterval)
+	}
+	require.NotEqual(t, 10, i, "follower didn't apply the block")
+	latest := follower.db().GetByID(rc2.BlockID)
+
+	// The follower goes back to the state of the first block, as if it
+	// missed the second one, and only applies the missing block.
+	coll, err := follower.collectionAt(follower.db().GetByID(rc1.BlockID))
+	require.Nil(t, err)
+	cdb.coll = coll
+	require.Nil(t, cdb.setLatest(rc1.BlockIndex))
+	_, _, err = cdb.GetValueContract(key2)
+	require.NotNil(t, err)
+	require.Nil(t, follower.syncCollection(latest))
+	require.Equal(t, rc2.BlockIndex, cdb.latestIndex())
+	_, _, err = cdb.GetValueContract(key2)
+	require.Nil(t, err)
+
+	// Blocks that are already applied are not applied again.
+	require.Nil(t, follower.syncCollection(follower.db().GetByID(rc1.BlockID)))
+	require.Equal(t, rc2.BlockIndex, cdb.latestIndex())
+
+	// Without the index of the latest applied block, the collection is
+	// rebuilt from the genesis block.
+	require.Nil(t, cdb.reset())
+	require.Nil(t, follower.syncCollection(latest))
+	require.Equal(t, rc2.BlockIndex, cdb.latestIndex())
+	_, _, err = cdb.GetValueContract(key2)
+	require.Nil(t, err)
+	require.Equal(t, s.service().getCollection(scID).RootHash(), cdb.RootHash())
+
+	// The index is stored, so a restarted node only applies the blocks
+	// it missed.
+	require.Equal(t, rc2.BlockIndex, newCollectionDB(cdb.db, cdb.bucketName).latestIndex())
+}
+
 func TestService_InvalidVerification(t *testing.T) {
 	s := newSer(t, 1, testInterval)
 	defer s.local.CloseAll()
@@ -201,7 +489,7 @@ func TestService_InvalidVerification(t *testing.T) {
 
 	// tx1 uses the invalid kind, so it should _not_ be stored.
 	value1 := []byte("a")
-	tx1, err := createOneClientTx(s.darc.GetBaseID(), "invalid", value1, s.signer)
+	tx1, err := createOneClientTx(s.sb.SkipChainID(), s.darc.GetBaseID(), "invalid", value1, s.signer)
 	require.Nil(t, err)
 	akvresp, err := s.service().AddTransaction(&AddTxRequest{
 		Version:     CurrentVersion,
@@ -214,7 +502,7 @@ func TestService_InvalidVerification(t *testing.T) {
 
 	// tx2 uses the dummy kind, its value should be stored.
 	value2 := []byte("b")
-	tx2, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, value2, s.signer)
+	tx2, err := createOneClientTx(s.sb.SkipChainID(), s.darc.GetBaseID(), dummyKind, value2, s.signer)
 	akvresp, err = s.service().AddTransaction(&AddTxRequest{
 		Version:     CurrentVersion,
 		SkipchainID: s.sb.SkipChainID(),
@@ -247,119 +535,1318 @@ func TestService_InvalidVerification(t *testing.T) {
 	require.True(t, match)
 }
 
-func TestService_LoadBlockInterval(t *testing.T) {
-	interval := 200 * time.Millisecond
-	s := newSer(t, 1, interval)
+func TestService_RogueLeader(t *testing.T) {
+	s := newSer(t, 1, testInterval)
 	defer s.local.CloseAll()
 	defer closeQueues(s.local)
 
-	dur, err := s.service().loadBlockInterval(s.sb.SkipChainID())
+	scID := s.sb.SkipChainID()
+	rogue := darc.NewSignerEd25519(nil, nil)
+
+	// An honest block is accepted.
+	tx, err := createOneClientTx(scID, s.darc.GetBaseID(), dummyKind, []byte("honest"), s.signer)
 	require.Nil(t, err)
-	require.Equal(t, dur, interval)
+	sb := s.newBlock(t, ClientTransactions{tx}, ClientTransactions{tx})
+	require.True(t, s.services[1].verifySkipBlock(nil, sb))
+
+	// The rogue leader includes an instruction signed by a key that is
+	// not in the darc, and applies it correctly.
+	unauthorised, err := createOneClientTx(scID, s.darc.GetBaseID(), dummyKind, []byte("rogue"), rogue)
+	require.Nil(t, err)
+	sb = s.newBlock(t, ClientTransactions{unauthorised}, ClientTransactions{unauthorised})
+	require.False(t, s.services[1].verifySkipBlock(nil, sb))
+
+	// Or an instruction without any signature.
+	unsigned, err := createOneClientTx(scID, s.darc.GetBaseID(), dummyKind, []byte("unsigned"), s.signer)
+	require.Nil(t, err)
+	unsigned.Instructions[0].Signatures = nil
+	sb = s.newBlock(t, ClientTransactions{unsigned}, ClientTransactions{unsigned})
+	require.False(t, s.services[1].verifySkipBlock(nil, sb))
+
+	// Or it hides the unauthorised instruction between valid ones.
+	sb = s.newBlock(t, ClientTransactions{tx, unauthorised}, ClientTransactions{tx, unauthorised})
+	require.False(t, s.services[1].verifySkipBlock(nil, sb))
+
+	// The followers don't sign the block, so it cannot be stored and the
+	// value never gets in their collection.
+	_, err = s.service().skService().StoreSkipBlock(&skipchain.StoreSkipBlock{
+		NewBlock:          sb,
+		TargetSkipChainID: scID,
+	})
+	require.NotNil(t, err)
+	pr, err := s.services[1].GetProof(&GetProof{
+		Version: CurrentVersion,
+		ID:      scID,
+		Key:     unauthorised.Instructions[0].ObjectID.Slice(),
+	})
+	require.Nil(t, err)
+	require.False(t, pr.Proof.InclusionProof.Match())
 }
 
-func TestService_StateChange(t *testing.T) {
+func TestService_TxStatus(t *testing.T) {
 	s := newSer(t, 1, testInterval)
 	defer s.local.CloseAll()
 	defer closeQueues(s.local)
 
-	var latest int64
-	f := func(cdb collection.Collection, tx Instruction, c []Coin) ([]StateChange, []Coin, error) {
-		cid, _, err := tx.GetContractState(cdb)
-		if err != nil {
-			return nil, nil, err
-		}
+	for i := range s.hosts {
+		RegisterContract(s.hosts[i], "invalid", verifyInvalidKind)
+	}
 
-		rec, err := cdb.Get(tx.ObjectID.Slice()).Record()
-		if err != nil {
-			return nil, nil, err
-		}
+	// unknown skipchain
+	_, err := s.service().GetTxStatus(&GetTxStatus{
+		Version: CurrentVersion,
+	})
+	require.NotNil(t, err)
 
-		// create the object if it doesn't exist
-		if !rec.Match() {
-			if tx.Spawn == nil {
-				return nil, nil, errors.New("expected spawn")
-			}
-			zeroBuf := make([]byte, 8)
-			binary.PutVarint(zeroBuf, 0)
-			return []StateChange{
-				StateChange{
-					StateAction: Create,
-					ObjectID:    tx.ObjectID.Slice(),
-					ContractID:  []byte(cid),
-					Value:       zeroBuf,
-				},
-			}, nil, nil
-		}
+	// unknown transaction
+	resp, err := s.service().GetTxStatus(&GetTxStatus{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		TxHash:      []byte("unknown"),
+	})
+	require.Nil(t, err)
+	require.Equal(t, TxUnknown, resp.Receipt.Status)
 
-		if tx.Invoke == nil {
-			return nil, nil, errors.New("expected invoke")
-		}
+	// The transaction of newSer must be included, and every node knows
+	// about it.
+	for _, ser := range s.services {
+		resp, err = ser.GetTxStatus(&GetTxStatus{
+			Version:     CurrentVersion,
+			SkipchainID: s.sb.SkipChainID(),
+			TxHash:      s.tx.Hash(),
+		})
+		require.Nil(t, err)
+		require.Equal(t, TxIncluded, resp.Receipt.Status)
+		require.Equal(t, 1, resp.Receipt.BlockIndex)
+		sb := ser.db().GetByID(resp.Receipt.BlockID)
+		require.NotNil(t, sb)
+		require.Equal(t, 1, sb.Index)
+	}
 
-		// increment the object value
-		vals, err := rec.Values()
-		if err != nil {
-			return nil, nil, err
+	// A transaction refused by the contract must be rejected.
+	tx, err := createOneClientTx(s.sb.SkipChainID(), s.darc.GetBaseID(), "invalid", []byte("a"), s.signer)
+	require.Nil(t, err)
+	_, err = s.services[1].AddTransaction(&AddTxRequest{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		Transaction: tx,
+	})
+	require.Nil(t, err)
+	resp, err = s.services[1].GetTxStatus(&GetTxStatus{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		TxHash:      tx.Hash(),
+	})
+	require.Nil(t, err)
+	require.NotEqual(t, TxUnknown, resp.Receipt.Status)
+
+	var i int
+	withBlocks(t, s.service(), s.sb.SkipChainID(), s.darc.GetBaseID(), s.signer, func() {
+		for i = 0; i < 10; i++ {
+			time.Sleep(2 * s.interval)
+			resp, err = s.services[1].GetTxStatus(&GetTxStatus{
+				Version:     CurrentVersion,
+				SkipchainID: s.sb.SkipChainID(),
+				TxHash:      tx.Hash(),
+			})
+			if err != nil || resp.Receipt.Status != TxPending {
+				break
+			}
 		}
-		v, _ := binary.Varint(vals[0].([]byte))
-		v++
+	})
+	require.Nil(t, err)
+	require.NotEqual(t, 10, i, "transaction is still pending")
+	require.Equal(t, TxRejected, resp.Receipt.Status)
+	require.Contains(t, resp.Receipt.Error, "Invalid")
+}
 
-		// we read v back to check later in the test
-		latest = v
+func TestService_AddTransactionWait(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
 
-		vBuf := make([]byte, 8)
-		binary.PutVarint(vBuf, v)
-		return []StateChange{
-			StateChange{
-				StateAction: Update,
-				ObjectID:    tx.ObjectID.Slice(),
-				ContractID:  []byte(cid),
-				Value:       vBuf,
-			},
-		}, nil, nil
+	// A valid transaction sent to a follower is included before the reply.
+	tx, err := createOneClientTx(s.sb.SkipChainID(), s.darc.GetBaseID(), "dummy", []byte("wait"), s.signer)
+	require.Nil(t, err)
+	resp, err := s.services[1].AddTransaction(&AddTxRequest{
+		Version:       CurrentVersion,
+		SkipchainID:   s.sb.SkipChainID(),
+		Transaction:   tx,
+		InclusionWait: 10,
+	})
+	require.Nil(t, err)
+	require.NotNil(t, resp.Receipt)
+	require.Equal(t, TxIncluded, resp.Receipt.Status)
+	require.Equal(t, tx.Hash(), resp.Receipt.TxHash)
+	pr, err := s.services[1].GetProof(&GetProof{
+		Version: CurrentVersion,
+		ID:      s.sb.SkipChainID(),
+		Key:     tx.Instructions[0].ObjectID.Slice(),
+	})
+	require.Nil(t, err)
+	require.True(t, pr.Proof.InclusionProof.Match())
 
-	}
-	RegisterContract(s.hosts[0], "add", f)
+	// Sending it again returns the stored receipt.
+	resp, err = s.service().AddTransaction(&AddTxRequest{
+		Version:       CurrentVersion,
+		SkipchainID:   s.sb.SkipChainID(),
+		Transaction:   tx,
+		InclusionWait: 10,
+	})
+	require.Nil(t, err)
+	require.Equal(t, TxIncluded, resp.Receipt.Status)
 
-	cdb := s.service().getCollection(s.sb.SkipChainID())
-	require.NotNil(t, cdb)
+	// A transaction refused by the contract is rejected, even if the
+	// leader doesn't create a block, and the follower learns about it.
+	tx, err = createOneClientTx(s.sb.SkipChainID(), s.darc.GetBaseID(), "invalid", []byte("a"), s.signer)
+	require.Nil(t, err)
+	resp, err = s.services[1].AddTransaction(&AddTxRequest{
+		Version:       CurrentVersion,
+		SkipchainID:   s.sb.SkipChainID(),
+		Transaction:   tx,
+		InclusionWait: 10,
+	})
+	require.Nil(t, err)
+	require.Equal(t, TxRejected, resp.Receipt.Status)
+	require.Contains(t, resp.Receipt.Error, "Invalid")
+	require.Nil(t, resp.Receipt.BlockID)
+	require.False(t, s.services[1].txPool.has(s.sb.SkipChainID(), tx.Hash()))
 
-	n := 5
-	inst := GenNonce()
-	nonce := GenNonce()
-	instrs := make([]Instruction, n)
-	for i := range instrs {
-		instrs[i] = Instruction{
-			ObjectID: ObjectID{
-				DarcID:     s.darc.GetBaseID(),
-				InstanceID: inst,
-			},
-			Nonce:  nonce,
-			Index:  i,
-			Length: n,
-		}
-		if i == 0 {
-			instrs[i].Spawn = &Spawn{
-				ContractID: "add",
+	// The rejection is recorded in the next block.
+	var rejected TxReceipt
+	withBlocks(t, s.service(), s.sb.SkipChainID(), s.darc.GetBaseID(), s.signer, func() {
+		for i := 0; i < 10 && rejected.BlockID == nil; i++ {
+			time.Sleep(s.interval)
+			status, err := s.services[1].GetTxStatus(&GetTxStatus{
+				Version:     CurrentVersion,
+				SkipchainID: s.sb.SkipChainID(),
+				TxHash:      tx.Hash(),
+			})
+			if err != nil {
+				return
 			}
-		} else {
-			instrs[i].Invoke = &Invoke{}
+			rejected = status.Receipt
 		}
-	}
+	})
+	require.NotNil(t, rejected.BlockID)
+	require.Equal(t, TxRejected, rejected.Status)
 
-	cts := []ClientTransaction{
-		ClientTransaction{
-			Instructions: instrs,
-		},
-	}
+	// Sending a rejected transaction again doesn't return the old receipt,
+	// but the one of the new rejection.
+	resp, err = s.service().AddTransaction(&AddTxRequest{
+		Version:       CurrentVersion,
+		SkipchainID:   s.sb.SkipChainID(),
+		Transaction:   tx,
+		InclusionWait: 10,
+	})
+	require.Nil(t, err)
+	require.Equal(t, TxRejected, resp.Receipt.Status)
+	require.NotEqual(t, rejected.BlockID, resp.Receipt.BlockID)
 
-	_, ctsOK, scs, err := s.service().createStateChanges(cdb.coll, cts)
+	// A transaction already in the pool is not forwarded again, so it never
+	// reaches the leader and stays pending.
+	tx, err = createOneClientTx(s.sb.SkipChainID(), s.darc.GetBaseID(), "dummy", []byte("late"), s.signer)
 	require.Nil(t, err)
+	s.services[1].txPool.add(s.sb.SkipChainID(), tx)
+	resp, err = s.services[1].AddTransaction(&AddTxRequest{
+		Version:       CurrentVersion,
+		SkipchainID:   s.sb.SkipChainID(),
+		Transaction:   tx,
+		InclusionWait: 2,
+	})
+	require.Nil(t, err)
+	require.Equal(t, TxPending, resp.Receipt.Status)
+
+	// The node doesn't wait longer than MaxInclusionWait block intervals.
+	start := time.Now()
+	resp, err = s.services[1].AddTransaction(&AddTxRequest{
+		Version:       CurrentVersion,
+		SkipchainID:   s.sb.SkipChainID(),
+		Transaction:   tx,
+		InclusionWait: 100 * MaxInclusionWait,
+	})
+	require.Nil(t, err)
+	require.Equal(t, TxPending, resp.Receipt.Status)
+	require.True(t, time.Since(start) < 2*MaxInclusionWait*s.interval)
+}
+
+func TestService_LoadBlockInterval(t *testing.T) {
+	interval := 200 * time.Millisecond
+	s := newSer(t, 1, interval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+
+	dur, err := s.service().loadBlockInterval(s.sb.SkipChainID())
+	require.Nil(t, err)
+	require.Equal(t, dur, interval)
+}
+
+func TestService_UpdateConfig(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+
+	scID := s.sb.SkipChainID()
+	size, err := s.tx.Size()
+	require.Nil(t, err)
+
+	// Only the signers of the genesis darc can change the config.
+	instr, err := UpdateConfigInstruction(scID, s.darc.GetBaseID(), 2*testInterval, 0,
+		nextNonce(), darc.NewSignerEd25519(nil, nil))
+	require.Nil(t, err)
+	require.NotNil(t, s.service().verifyClientTx(scID, ClientTransaction{Instructions: Instructions{*instr}}))
+
+	// Invalid values are refused by the contract.
+	cdb := s.service().getCollection(scID)
+	for _, arg := range []string{"block_interval", "max_block_size"} {
+		buf := make([]byte, binary.MaxVarintLen64)
+		instr.Invoke.Args = Arguments{{Name: arg, Value: buf[:binary.PutVarint(buf, 0)]}}
+		_, _, err = s.service().ContractConfig(cdb.coll, *instr, nil)
+		require.NotNil(t, err)
+	}
+
+	// A new interval and a maximum block size that only fits one
+	// transaction.
+	newInterval := 2 * testInterval
+	instr, err = UpdateConfigInstruction(scID, s.darc.GetBaseID(), newInterval, size+size/2,
+		nextNonce(), s.signer)
+	require.Nil(t, err)
+	resp, err := s.services[1].AddTransaction(&AddTxRequest{
+		Version:       CurrentVersion,
+		SkipchainID:   scID,
+		Transaction:   ClientTransaction{Instructions: Instructions{*instr}},
+		InclusionWait: 10,
+	})
+	require.Nil(t, err)
+	require.Equal(t, TxIncluded, resp.Receipt.Status)
+	for _, service := range s.services {
+		interval, err := service.loadBlockInterval(scID)
+		require.Nil(t, err)
+		require.Equal(t, newInterval, interval)
+		maxSize, err := service.loadMaxBlockSize(scID)
+		require.Nil(t, err)
+		require.Equal(t, size+size/2, maxSize)
+	}
+
+	// A transaction bigger than a block is refused.
+	big, err := createOneClientTx(scID, s.darc.GetBaseID(), dummyKind, make([]byte, size), s.signer)
+	require.Nil(t, err)
+	_, err = s.service().AddTransaction(&AddTxRequest{
+		Version:     CurrentVersion,
+		SkipchainID: scID,
+		Transaction: big,
+	})
+	require.NotNil(t, err)
+
+	// The running queue worker uses the new values: every transaction
+	// goes in its own block, one block every new interval.
+	start := time.Now()
+	var txs ClientTransactions
+	for i := 0; i < 3; i++ {
+		tx, err := createOneClientTx(scID, s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+		require.Nil(t, err)
+		_, err = s.service().AddTransaction(&AddTxRequest{
+			Version:     CurrentVersion,
+			SkipchainID: scID,
+			Transaction: tx,
+		})
+		require.Nil(t, err)
+		txs = append(txs, tx)
+	}
+	indexes := map[int]bool{}
+	for _, tx := range txs {
+		resp, err = s.service().AddTransaction(&AddTxRequest{
+			Version:       CurrentVersion,
+			SkipchainID:   scID,
+			Transaction:   tx,
+			InclusionWait: 10,
+		})
+		require.Nil(t, err)
+		require.Equal(t, TxIncluded, resp.Receipt.Status)
+		indexes[resp.Receipt.BlockIndex] = true
+	}
+	require.Equal(t, 3, len(indexes))
+	require.True(t, time.Since(start) > 3*newInterval/2)
+}
+
+func TestService_CrossLedgerReplay(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+
+	// A second ledger with the same genesis darc.
+	scA := s.sb.SkipChainID()
+	genesisMsg, err := DefaultGenesisMsg(CurrentVersion, s.roster, []string{"Spawn_dummy", "Spawn_invalid", "Spawn_darc", "Invoke_UpdateConfig"}, s.signer.Identity())
+	require.Nil(t, err)
+	genesisMsg.BlockInterval = testInterval
+	resp, err := s.service().CreateGenesisBlock(genesisMsg)
+	require.Nil(t, err)
+	scB := resp.Skipblock.SkipChainID()
+	require.False(t, scA.Equal(scB))
+	require.True(t, genesisMsg.GenesisDarc.GetBaseID().Equal(s.darc.GetBaseID()))
+	config, err := s.service().loadConfig(scB)
+	require.Nil(t, err)
+	require.Equal(t, CurrentVersion, config.Version)
+
+	// An instruction signed for one ledger is refused by the other.
+	tx, err := createOneClientTx(scA, s.darc.GetBaseID(), dummyKind, []byte("A"), s.signer)
+	require.Nil(t, err)
+	require.Nil(t, s.service().verifyClientTx(scA, tx))
+	require.NotNil(t, s.service().verifyClientTx(scB, tx))
+
+	// Signatures of version 1 are refused by ledgers of version 2.
+	old, err := createOneClientTx(scB, s.darc.GetBaseID(), dummyKind, []byte("old"), s.signer)
+	require.Nil(t, err)
+	require.Nil(t, signByV1(&old.Instructions[0], s.signer))
+	require.NotNil(t, s.service().verifyClientTx(scA, old))
+	require.NotNil(t, s.service().verifyClientTx(scB, old))
+
+	// Ledger B is turned into a ledger of version 1, which accepts them,
+	// and the new signatures.
+	cdb := s.service().getCollection(scB)
+	configID, err := configObjectID(cdb.coll)
+	require.Nil(t, err)
+	storeConfig := func(c *Config) {
+		buf, err := protobuf.Encode(c)
+		require.Nil(t, err)
+		require.Nil(t, cdb.Store(&StateChange{
+			StateAction: Update,
+			ObjectID:    configID.Slice(),
+			ContractID:  []byte(ContractConfigID),
+			Value:       buf,
+		}))
+	}
+	config.Version = 0
+	storeConfig(config)
+	require.Nil(t, s.service().verifyClientTx(scB, old))
+	tx, err = createOneClientTx(scB, s.darc.GetBaseID(), dummyKind, []byte("B"), s.signer)
+	require.Nil(t, err)
+	require.Nil(t, s.service().verifyClientTx(scB, tx))
+
+	// Once upgraded, it refuses them again. The version cannot go back.
+	instr, err := UpgradeVersionInstruction(scB, s.darc.GetBaseID(), nextNonce(), s.signer)
+	require.Nil(t, err)
+	sc, _, err := s.service().ContractConfig(cdb.coll, *instr, nil)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(sc))
+	require.Nil(t, cdb.Store(&sc[0]))
+	require.NotNil(t, s.service().verifyClientTx(scB, old))
+	require.Nil(t, s.service().verifyClientTx(scB, tx))
+	buf := make([]byte, binary.MaxVarintLen64)
+	instr.Invoke.Args = Arguments{{Name: "version", Value: buf[:binary.PutVarint(buf, 1)]}}
+	_, _, err = s.service().ContractConfig(cdb.coll, *instr, nil)
+	require.NotNil(t, err)
+}
+
+func TestService_StateChange(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+
+	var latest int64
+	f := func(cdb collection.Collection, tx Instruction, c []Coin) ([]StateChange, []Coin, error) {
+		cid, _, err := tx.GetContractState(cdb)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		rec, err := cdb.Get(tx.ObjectID.Slice()).Record()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// create the object if it doesn't exist
+		if !rec.Match() {
+			if tx.Spawn == nil {
+				return nil, nil, errors.New("expected spawn")
+			}
+			zeroBuf := make([]byte, 8)
+			binary.PutVarint(zeroBuf, 0)
+			return []StateChange{
+				StateChange{
+					StateAction: Create,
+					ObjectID:    tx.ObjectID.Slice(),
+					ContractID:  []byte(cid),
+					Value:       zeroBuf,
+				},
+			}, nil, nil
+		}
+
+		if tx.Invoke == nil {
+			return nil, nil, errors.New("expected invoke")
+		}
+
+		// increment the object value
+		vals, err := rec.Values()
+		if err != nil {
+			return nil, nil, err
+		}
+		v, _ := binary.Varint(vals[0].([]byte))
+		v++
+
+		// we read v back to check later in the test
+		latest = v
+
+		vBuf := make([]byte, 8)
+		binary.PutVarint(vBuf, v)
+		return []StateChange{
+			StateChange{
+				StateAction: Update,
+				ObjectID:    tx.ObjectID.Slice(),
+				ContractID:  []byte(cid),
+				Value:       vBuf,
+			},
+		}, nil, nil
+
+	}
+	RegisterContract(s.hosts[0], "add", f)
+
+	cdb := s.service().getCollection(s.sb.SkipChainID())
+	require.NotNil(t, cdb)
+
+	n := 5
+	inst := GenNonce()
+	instrs := make([]Instruction, n)
+	for i := range instrs {
+		instrs[i] = Instruction{
+			ObjectID: ObjectID{
+				DarcID:     s.darc.GetBaseID(),
+				InstanceID: inst,
+			},
+			Nonce:  nextNonce(),
+			Index:  i,
+			Length: n,
+		}
+		if i == 0 {
+			instrs[i].Spawn = &Spawn{
+				ContractID: "add",
+			}
+		} else {
+			instrs[i].Invoke = &Invoke{}
+		}
+	}
+
+	cts := []ClientTransaction{
+		ClientTransaction{
+			Instructions: instrs,
+		},
+	}
+
+	s.service().syncMu.Lock()
+	_, ctsOK, scs, rejected, err := s.service().createStateChanges(cdb.coll, cts)
+	s.service().syncMu.Unlock()
+	require.Nil(t, err)
+	require.Equal(t, 0, len(rejected))
 	require.Equal(t, 1, len(ctsOK))
-	require.Equal(t, n, len(scs))
+	// Every instruction also updates the nonce of the darc.
+	require.Equal(t, 2*n, len(scs))
 	require.Equal(t, latest, int64(n-1))
 }
 
+func TestService_Nonce(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+
+	scID := s.sb.SkipChainID()
+	resp, err := s.services[1].GetNonce(&GetNonce{
+		Version:     CurrentVersion,
+		SkipchainID: scID,
+		DarcID:      s.darc.GetBaseID(),
+	})
+	require.Nil(t, err)
+	next, err := s.tx.Instructions[0].Nonce.Next()
+	require.Nil(t, err)
+	require.Equal(t, next, resp.Nonce)
+
+	// An unused darc starts with the first nonce.
+	resp, err = s.service().GetNonce(&GetNonce{
+		Version:     CurrentVersion,
+		SkipchainID: scID,
+		DarcID:      darcidStr("unused"),
+	})
+	require.Nil(t, err)
+	require.Equal(t, OneNonce, resp.Nonce)
+
+	// Replaying the included transaction must fail.
+	require.NotNil(t, s.service().verifyClientTx(scID, s.tx))
+	cdb := s.service().getCollection(scID)
+	s.service().syncMu.Lock()
+	_, ctsOK, _, rejected, err := s.service().createStateChanges(cdb.coll, ClientTransactions{s.tx})
+	s.service().syncMu.Unlock()
+	require.Nil(t, err)
+	require.Equal(t, 0, len(ctsOK))
+	require.Equal(t, 1, len(rejected))
+	require.Contains(t, rejected[0].Error, "nonce")
+
+	// Sending it again doesn't change its receipt.
+	addResp, err := s.services[1].AddTransaction(&AddTxRequest{
+		Version:       CurrentVersion,
+		SkipchainID:   scID,
+		Transaction:   s.tx,
+		InclusionWait: 2,
+	})
+	require.Nil(t, err)
+	require.Equal(t, TxIncluded, addResp.Receipt.Status)
+
+	// A new transaction signed with an old nonce is rejected.
+	instr := s.tx.Instructions[0]
+	instr.ObjectID.InstanceID = GenNonce()
+	require.Nil(t, instr.SignBy(scID, s.signer))
+	tx := ClientTransaction{Instructions: []Instruction{instr}}
+	withBlocks(t, s.service(), scID, s.darc.GetBaseID(), s.signer, func() {
+		addResp, err = s.services[1].AddTransaction(&AddTxRequest{
+			Version:       CurrentVersion,
+			SkipchainID:   scID,
+			Transaction:   tx,
+			InclusionWait: 10,
+		})
+	})
+	require.Nil(t, err)
+	require.Equal(t, TxRejected, addResp.Receipt.Status)
+	require.Contains(t, addResp.Receipt.Error, "nonce")
+
+	// Two transactions using the same nonce in one block: only one of
+	// them can be applied.
+	tx1, err := createOneClientTx(scID, s.darc.GetBaseID(), dummyKind, []byte("1"), s.signer)
+	require.Nil(t, err)
+	instr = tx1.Instructions[0]
+	instr.ObjectID.InstanceID = GenNonce()
+	require.Nil(t, instr.SignBy(scID, s.signer))
+	tx2 := ClientTransaction{Instructions: []Instruction{instr}}
+	s.service().syncMu.Lock()
+	_, ctsOK, _, rejected, err = s.service().createStateChanges(cdb.coll, ClientTransactions{tx1, tx2})
+	s.service().syncMu.Unlock()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(ctsOK))
+	require.Equal(t, 1, len(rejected))
+
+	// A nonce can be at most MaxNonceStep above the last one, so that the
+	// darc cannot be locked with the biggest nonce.
+	resp, err = s.service().GetNonce(&GetNonce{
+		Version:     CurrentVersion,
+		SkipchainID: scID,
+		DarcID:      s.darc.GetBaseID(),
+	})
+	require.Nil(t, err)
+	last := binary.BigEndian.Uint64(resp.Nonce[24:]) - 1
+	var max Nonce
+	for i := range max {
+		max[i] = 0xff
+	}
+	for n, ok := range map[Nonce]bool{
+		NewNonce(last + MaxNonceStep):     true,
+		NewNonce(last + MaxNonceStep + 1): false,
+		max:                               false,
+	} {
+		instr.Nonce = n
+		require.Nil(t, instr.SignBy(scID, s.signer))
+		tx := ClientTransaction{Instructions: []Instruction{instr}}
+		s.service().syncMu.Lock()
+		_, ctsOK, _, rejected, err = s.service().createStateChanges(cdb.coll, ClientTransactions{tx})
+		s.service().syncMu.Unlock()
+		require.Nil(t, err)
+		if ok {
+			require.Equal(t, 1, len(ctsOK))
+		} else {
+			require.Equal(t, 1, len(rejected))
+			require.Contains(t, rejected[0].Error, "nonce")
+		}
+	}
+
+	// A follower refuses a block that replays a transaction.
+	sb := s.newBlock(t, ClientTransactions{s.tx}, nil)
+	require.False(t, s.services[1].verifySkipBlock(nil, sb))
+}
+
+func TestService_IndexLength(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+
+	scID := s.sb.SkipChainID()
+	values := [][]byte{[]byte("1"), []byte("2"), []byte("3")}
+
+	// The leader refuses a transaction where an instruction has been
+	// removed.
+	tx, err := createClientTx(scID, s.darc.GetBaseID(), dummyKind, values, s.signer)
+	require.Nil(t, err)
+	stripped := ClientTransaction{Instructions: tx.Instructions[:2]}
+	var resp *AddTxResponse
+	withBlocks(t, s.service(), scID, s.darc.GetBaseID(), s.signer, func() {
+		resp, err = s.services[1].AddTransaction(&AddTxRequest{
+			Version:       CurrentVersion,
+			SkipchainID:   scID,
+			Transaction:   stripped,
+			InclusionWait: 10,
+		})
+	})
+	require.Nil(t, err)
+	require.Equal(t, TxRejected, resp.Receipt.Status)
+
+	// A malicious leader removes the last instruction of a transaction and
+	// correctly applies the remaining ones.
+	sb := s.newBlock(t, ClientTransactions{stripped}, ClientTransactions{stripped})
+	require.False(t, s.services[1].verifySkipBlock(nil, sb))
+
+	// Or it removes the first one.
+	stripped = ClientTransaction{Instructions: tx.Instructions[1:]}
+	sb = s.newBlock(t, ClientTransactions{stripped}, ClientTransactions{stripped})
+	require.False(t, s.services[1].verifySkipBlock(nil, sb))
+
+	// Or it swaps two instructions.
+	reordered := ClientTransaction{Instructions: Instructions{
+		tx.Instructions[0], tx.Instructions[2], tx.Instructions[1]}}
+	sb = s.newBlock(t, ClientTransactions{reordered}, ClientTransactions{reordered})
+	require.False(t, s.services[1].verifySkipBlock(nil, sb))
+
+	// The complete transaction is accepted.
+	sb = s.newBlock(t, ClientTransactions{tx}, ClientTransactions{tx})
+	require.True(t, s.services[1].verifySkipBlock(nil, sb))
+	resp, err = s.services[1].AddTransaction(&AddTxRequest{
+		Version:       CurrentVersion,
+		SkipchainID:   scID,
+		Transaction:   tx,
+		InclusionWait: 10,
+	})
+	require.Nil(t, err)
+	require.Equal(t, TxIncluded, resp.Receipt.Status)
+}
+
+func TestService_DarcSpawnEvolve(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+
+	scID := s.sb.SkipChainID()
+	send := func(instr *Instruction) *TxReceipt {
+		resp, err := s.services[1].AddTransaction(&AddTxRequest{
+			Version:       CurrentVersion,
+			SkipchainID:   scID,
+			Transaction:   ClientTransaction{Instructions: Instructions{*instr}},
+			InclusionWait: 10,
+		})
+		require.Nil(t, err)
+		return resp.Receipt
+	}
+	latestDarc := func(dID darc.ID) *darc.Darc {
+		pr, err := s.services[1].GetProof(&GetProof{
+			Version: CurrentVersion,
+			ID:      scID,
+			Key:     toObjectID(dID).Slice(),
+		})
+		require.Nil(t, err)
+		require.True(t, pr.Proof.InclusionProof.Match())
+		_, vs, err := pr.Proof.KeyValue()
+		require.Nil(t, err)
+		require.Equal(t, ContractDarcID, string(vs[1]))
+		d, err := darc.NewDarcFromProto(vs[0])
+		require.Nil(t, err)
+		return d
+	}
+
+	// Spawn a new darc from the genesis darc.
+	owner := darc.NewSignerEd25519(nil, nil)
+	user1 := darc.NewSignerEd25519(nil, nil)
+	user2 := darc.NewSignerEd25519(nil, nil)
+	rules := darc.InitRules([]*darc.Identity{owner.Identity()}, []*darc.Identity{owner.Identity()})
+	rules.AddRule("Spawn_dummy", expression.InitOrExpr(user1.Identity().String()))
+	d1 := darc.NewDarc(rules, []byte("spawned darc"))
+	instr, err := SpawnDarcInstruction(scID, s.darc.GetBaseID(), d1, nextNonce(), s.signer)
+	require.Nil(t, err)
+	require.Equal(t, TxIncluded, send(instr).Status)
+	require.True(t, latestDarc(d1.GetBaseID()).Equal(d1))
+
+	// Spawning it a second time fails.
+	instr, err = SpawnDarcInstruction(scID, s.darc.GetBaseID(), d1, nextNonce(), s.signer)
+	require.Nil(t, err)
+	var resp *AddTxResponse
+	withBlocks(t, s.service(), scID, s.darc.GetBaseID(), s.signer, func() {
+		resp, err = s.services[1].AddTransaction(&AddTxRequest{
+			Version:       CurrentVersion,
+			SkipchainID:   scID,
+			Transaction:   ClientTransaction{Instructions: Instructions{*instr}},
+			InclusionWait: 10,
+		})
+	})
+	require.Nil(t, err)
+	require.Equal(t, TxRejected, resp.Receipt.Status)
+
+	// Only the signers of the parent darc can spawn.
+	d := darc.NewDarc(darc.InitRules([]*darc.Identity{owner.Identity()}, nil), []byte("other"))
+	instr, err = SpawnDarcInstruction(scID, s.darc.GetBaseID(), d, nextNonce(), owner)
+	require.Nil(t, err)
+	require.NotNil(t, s.service().verifyInstruction(scID, *instr))
+
+	// user1 can use the new darc.
+	tx, err := createOneClientTx(scID, d1.GetBaseID(), dummyKind, []byte("user1"), user1)
+	require.Nil(t, err)
+	require.Nil(t, s.service().verifyClientTx(scID, tx))
+
+	// Evolve the darc so that user2 replaces user1.
+	d2 := d1.Copy()
+	require.Nil(t, d2.Rules.UpdateRule("Spawn_dummy", expression.InitOrExpr(user2.Identity().String())))
+	instr, err = EvolveDarcInstruction(scID, d2, latestDarc(d1.GetBaseID()), nextNonce(), owner)
+	require.Nil(t, err)
+	require.Equal(t, TxIncluded, send(instr).Status)
+	stored := latestDarc(d1.GetBaseID())
+	require.True(t, stored.Equal(d2))
+	require.Equal(t, uint64(1), stored.Version)
+
+	// The instructions are verified against the latest version.
+	tx, err = createOneClientTx(scID, d1.GetBaseID(), dummyKind, []byte("user1"), user1)
+	require.Nil(t, err)
+	require.NotNil(t, s.service().verifyClientTx(scID, tx))
+	tx, err = createOneClientTx(scID, d1.GetBaseID(), dummyKind, []byte("user2"), user2)
+	require.Nil(t, err)
+	require.Nil(t, s.service().verifyClientTx(scID, tx))
+
+	// Only the owner can evolve the darc.
+	d3 := stored.Copy()
+	require.Nil(t, d3.Rules.UpdateRule("Spawn_dummy", expression.InitOrExpr(user1.Identity().String())))
+	instr, err = EvolveDarcInstruction(scID, d3, stored, nextNonce(), user2)
+	require.Nil(t, err)
+	require.NotNil(t, s.service().verifyInstruction(scID, *instr))
+	cdb := s.service().getCollection(scID)
+	_, _, err = s.service().ContractDarc(cdb.coll, *instr, nil)
+	require.NotNil(t, err)
+
+	// An evolution based on an old version is refused.
+	d3 = d1.Copy()
+	d3.Description = []byte("stale evolution")
+	instr, err = EvolveDarcInstruction(scID, d3, d1, nextNonce(), owner)
+	require.Nil(t, err)
+	_, _, err = s.service().ContractDarc(cdb.coll, *instr, nil)
+	require.NotNil(t, err)
+
+	// A second evolution is verified against the latest version, which
+	// is stored like the first one, without the versions before it.
+	d4 := stored.Copy()
+	d4.Description = []byte("second evolution")
+	instr, err = EvolveDarcInstruction(scID, d4, stored, nextNonce(), owner)
+	require.Nil(t, err)
+	require.Equal(t, TxIncluded, send(instr).Status)
+	stored = latestDarc(d1.GetBaseID())
+	require.True(t, stored.Equal(d4))
+	require.Equal(t, uint64(2), stored.Version)
+	require.Equal(t, 0, len(stored.Path))
+	require.Equal(t, 0, len(stored.Signatures))
+	storedBuf, err := stored.ToProto()
+	require.Nil(t, err)
+	value, _, err := getValueContract(cdb.coll, toObjectID(d1.GetBaseID()).Slice())
+	require.Nil(t, err)
+	require.Equal(t, storedBuf, value)
+
+	// An evolution after which nobody can evolve the darc is refused.
+	missing := darc.NewIdentityDarc([]byte("missing")).String()
+	for _, expr := range []string{missing, "ed25519:00", "[" + missing + ", " + user1.Identity().String() + "]/2"} {
+		d5 := stored.Copy()
+		require.Nil(t, d5.Rules.UpdateEvolution([]byte(expr)))
+		instr, err = EvolveDarcInstruction(scID, d5, stored, nextNonce(), owner)
+		require.Nil(t, err)
+		_, _, err = s.service().ContractDarc(cdb.coll, *instr, nil)
+		require.NotNil(t, err)
+		require.Contains(t, err.Error(), "lock")
+	}
+}
+
+func TestService_DarcDelegation(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+
+	scID := s.sb.SkipChainID()
+	spawn := func(d *darc.Darc) {
+		instr, err := SpawnDarcInstruction(scID, s.darc.GetBaseID(), d, nextNonce(), s.signer)
+		require.Nil(t, err)
+		resp, err := s.services[1].AddTransaction(&AddTxRequest{
+			Version:       CurrentVersion,
+			SkipchainID:   scID,
+			Transaction:   ClientTransaction{Instructions: Instructions{*instr}},
+			InclusionWait: 10,
+		})
+		require.Nil(t, err)
+		require.Equal(t, TxIncluded, resp.Receipt.Status, resp.Receipt.Error)
+	}
+	darcID := func(d *darc.Darc) string {
+		return darc.NewIdentityDarc(d.GetBaseID()).String()
+	}
+	owner := darc.NewSignerEd25519(nil, nil)
+	user := darc.NewSignerEd25519(nil, nil)
+	newDarc := func(desc string, sign string) *darc.Darc {
+		rules := darc.InitRules([]*darc.Identity{owner.Identity()}, nil)
+		require.Nil(t, rules.UpdateSign([]byte(sign)))
+		return darc.NewDarc(rules, []byte(desc))
+	}
+
+	// user -> team -> group: a rule of the project darc delegates to the
+	// group darc, whose sign rule delegates to the team darc.
+	team := newDarc("team", user.Identity().String())
+	spawn(team)
+	group := newDarc("group", darcID(team))
+	spawn(group)
+	project := newDarc("project", owner.Identity().String())
+	require.Nil(t, project.Rules.AddRule("Spawn_dummy", []byte(darcID(group))))
+	spawn(project)
+
+	tx, err := createOneClientTx(scID, project.GetBaseID(), dummyKind, []byte("user"), user)
+	require.Nil(t, err)
+	require.Nil(t, s.service().verifyClientTx(scID, tx))
+	tx, err = createOneClientTx(scID, project.GetBaseID(), dummyKind, []byte("owner"), owner)
+	require.Nil(t, err)
+	require.NotNil(t, s.service().verifyClientTx(scID, tx))
+
+	// The latest version of a delegated darc is used: once user is
+	// replaced in the team darc, it cannot sign anymore.
+	newUser := darc.NewSignerEd25519(nil, nil)
+	team2 := team.Copy()
+	require.Nil(t, team2.Rules.UpdateSign([]byte(newUser.Identity().String())))
+	instr, err := EvolveDarcInstruction(scID, team2, team, nextNonce(), owner)
+	require.Nil(t, err)
+	resp, err := s.services[1].AddTransaction(&AddTxRequest{
+		Version:       CurrentVersion,
+		SkipchainID:   scID,
+		Transaction:   ClientTransaction{Instructions: Instructions{*instr}},
+		InclusionWait: 10,
+	})
+	require.Nil(t, err)
+	require.Equal(t, TxIncluded, resp.Receipt.Status, resp.Receipt.Error)
+	tx, err = createOneClientTx(scID, project.GetBaseID(), dummyKind, []byte("user"), user)
+	require.Nil(t, err)
+	require.NotNil(t, s.service().verifyClientTx(scID, tx))
+	tx, err = createOneClientTx(scID, project.GetBaseID(), dummyKind, []byte("new user"), newUser)
+	require.Nil(t, err)
+	require.Nil(t, s.service().verifyClientTx(scID, tx))
+
+	// Two darcs delegating to each other are refused instead of looping.
+	loop1 := newDarc("loop1", owner.Identity().String())
+	spawn(loop1)
+	loop2 := newDarc("loop2", darcID(loop1))
+	spawn(loop2)
+	loop1b := loop1.Copy()
+	require.Nil(t, loop1b.Rules.UpdateSign([]byte(darcID(loop2))))
+	instr, err = EvolveDarcInstruction(scID, loop1b, loop1, nextNonce(), owner)
+	require.Nil(t, err)
+	resp, err = s.services[1].AddTransaction(&AddTxRequest{
+		Version:       CurrentVersion,
+		SkipchainID:   scID,
+		Transaction:   ClientTransaction{Instructions: Instructions{*instr}},
+		InclusionWait: 10,
+	})
+	require.Nil(t, err)
+	require.Equal(t, TxIncluded, resp.Receipt.Status, resp.Receipt.Error)
+	looped := newDarc("looped", owner.Identity().String())
+	require.Nil(t, looped.Rules.AddRule("Spawn_dummy", []byte(darcID(loop2))))
+	spawn(looped)
+	tx, err = createOneClientTx(scID, looped.GetBaseID(), dummyKind, []byte("loop"), owner)
+	require.Nil(t, err)
+	err = s.service().verifyClientTx(scID, tx)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "cycle")
+
+	// A delegation to a darc that is not on the ledger is refused.
+	unknown := newDarc("unknown", owner.Identity().String())
+	orphan := newDarc("orphan", owner.Identity().String())
+	require.Nil(t, orphan.Rules.AddRule("Spawn_dummy", []byte(darcID(unknown))))
+	spawn(orphan)
+	tx, err = createOneClientTx(scID, orphan.GetBaseID(), dummyKind, []byte("orphan"), owner)
+	require.Nil(t, err)
+	err = s.service().verifyClientTx(scID, tx)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "couldn't find")
+}
+
+func TestService_ViewChange(t *testing.T) {
+	local := onet.NewTCPTest(tSuite)
+	defer local.CloseAll()
+	hosts, roster, _ := local.GenTree(4, true)
+	var services []*Service
+	for _, sv := range local.GetServices(hosts, omniledgerID) {
+		services = append(services, sv.(*Service))
+	}
+	registerDummy(services)
+
+	signer := darc.NewSignerEd25519(nil, nil)
+	genesisMsg, err := DefaultGenesisMsg(CurrentVersion, roster, []string{"Spawn_dummy"}, signer.Identity())
+	require.Nil(t, err)
+	genesisMsg.BlockInterval = testInterval
+	resp, err := services[0].CreateGenesisBlock(genesisMsg)
+	require.Nil(t, err)
+	scID := resp.Skipblock.SkipChainID()
+
+	// Kill the leader: stop its queue and monitor and shut down the
+	// server. It is removed from the local test so that it is not
+	// closed twice.
+	close(services[0].CloseQueues)
+	require.Nil(t, hosts[0].Close())
+	delete(local.Servers, hosts[0].ServerIdentity.ID)
+	defer closeQueues(local)
+
+	// The followers should elect the next node in the roster.
+	var latest *skipchain.SkipBlock
+	var i int
+	for i = 0; i < 10; i++ {
+		time.Sleep(rotationWindow * testInterval)
+		latest, err = services[1].db().GetLatest(services[1].db().GetByID(scID))
+		require.Nil(t, err)
+		if latest.Roster.List[0].Equal(hosts[1].ServerIdentity) {
+			break
+		}
+	}
+	require.NotEqual(t, 10, i, "no view-change happened")
+	require.Equal(t, len(roster.List), len(latest.Roster.List))
+
+	// The new leader must accept transactions and create new blocks.
+	tx, err := createOneClientTx(resp.Skipblock.SkipChainID(), genesisMsg.GenesisDarc.GetBaseID(), dummyKind, []byte("value"), signer)
+	require.Nil(t, err)
+	_, err = services[1].AddTransaction(&AddTxRequest{
+		Version:     CurrentVersion,
+		SkipchainID: scID,
+		Transaction: tx,
+	})
+	require.Nil(t, err)
+	for i = 0; i < 10; i++ {
+		time.Sleep(2 * testInterval)
+		pr, err := services[2].GetProof(&GetProof{
+			Version: CurrentVersion,
+			ID:      scID,
+			Key:     tx.Instructions[0].ObjectID.Slice(),
+		})
+		require.Nil(t, err)
+		if pr.Proof.InclusionProof.Match() {
+			require.Nil(t, pr.Proof.Verify(scID))
+			break
+		}
+	}
+	require.NotEqual(t, 10, i, "new leader didn't create a block")
+}
+
+func TestViewChange_Vote(t *testing.T) {
+	vc := newViewChange()
+	var sis []*network.ServerIdentity
+	for i := 0; i < 4; i++ {
+		sis = append(sis, network.NewServerIdentity(tSuite.Point().Pick(tSuite.RandomStream()),
+			network.NewAddress(network.Local, fmt.Sprintf("127.0.0.1:%d", 2000+i))))
+	}
+	scID := skipchain.SkipBlockID("skipchain")
+	req := &viewChangeReq{SkipchainID: scID, LatestID: []byte("latest"), LeaderIndex: 1}
+	threshold := viewChangeThreshold(len(sis))
+
+	// The candidate takes over exactly once, even if more nodes than the
+	// threshold ask for it.
+	var taken int
+	for _, si := range sis {
+		if vc.vote(req, si, threshold) {
+			taken++
+		}
+	}
+	require.Equal(t, 1, taken)
+
+	// The votes for another candidate are counted separately.
+	other := &viewChangeReq{SkipchainID: scID, LatestID: []byte("latest"), LeaderIndex: 2}
+	for _, si := range sis[:threshold-1] {
+		require.False(t, vc.vote(other, si, threshold))
+	}
+
+	// A new block drops the votes, so that the same view can be requested
+	// again.
+	vc.newBlock(scID)
+	for _, si := range sis[:threshold-1] {
+		require.False(t, vc.vote(other, si, threshold))
+	}
+	require.True(t, vc.vote(other, sis[threshold-1], threshold))
+}
+
+func TestService_RosterChange(t *testing.T) {
+	local := onet.NewTCPTest(tSuite)
+	defer local.CloseAll()
+	hosts, roster, _ := local.GenTree(4, true)
+	var services []*Service
+	for _, sv := range local.GetServices(hosts, omniledgerID) {
+		services = append(services, sv.(*Service))
+	}
+	registerDummy(services)
+	defer closeQueues(local)
+
+	// The fourth node is not part of the ledger yet.
+	signer := darc.NewSignerEd25519(nil, nil)
+	genesisMsg, err := DefaultGenesisMsg(CurrentVersion, onet.NewRoster(roster.List[:3]),
+		[]string{"Spawn_dummy", "Invoke_add_node", "Invoke_remove_node", "Invoke_rotate_leader"},
+		signer.Identity())
+	require.Nil(t, err)
+	genesisMsg.BlockInterval = testInterval
+	resp, err := services[0].CreateGenesisBlock(genesisMsg)
+	require.Nil(t, err)
+	scID := resp.Skipblock.SkipChainID()
+	gID := genesisMsg.GenesisDarc.GetBaseID()
+
+	send := func(s *Service, tx ClientTransaction) *TxReceipt {
+		resp, err := s.AddTransaction(&AddTxRequest{
+			Version:       CurrentVersion,
+			SkipchainID:   scID,
+			Transaction:   tx,
+			InclusionWait: 10,
+		})
+		require.Nil(t, err)
+		return resp.Receipt
+	}
+	changeRoster := func(s *Service, cmd string, node *network.ServerIdentity) *skipchain.SkipBlock {
+		instr, err := ChangeRosterInstruction(scID, gID, cmd, node, nextNonce(), signer)
+		require.Nil(t, err)
+		rc := send(s, ClientTransaction{Instructions: Instructions{*instr}})
+		require.Equal(t, TxIncluded, rc.Status, rc.Error)
+		return s.db().GetByID(rc.BlockID)
+	}
+
+	before, err := createOneClientTx(scID, gID, dummyKind, []byte("before"), signer)
+	require.Nil(t, err)
+	require.Equal(t, TxIncluded, send(services[0], before).Status)
+
+	// Only the genesis darc can change the roster.
+	instr, err := ChangeRosterInstruction(scID, gID, CmdAddNode, roster.List[3], nextNonce(),
+		darc.NewSignerEd25519(nil, nil))
+	require.Nil(t, err)
+	require.NotNil(t, services[0].verifyClientTx(scID, ClientTransaction{Instructions: Instructions{*instr}}))
+
+	// Nodes of the roster cannot be added again.
+	instr, err = ChangeRosterInstruction(scID, gID, CmdAddNode, roster.List[1], nextNonce(), signer)
+	require.Nil(t, err)
+	var addResp *AddTxResponse
+	withBlocks(t, services[0], scID, gID, signer, func() {
+		addResp, err = services[0].AddTransaction(&AddTxRequest{
+			Version:       CurrentVersion,
+			SkipchainID:   scID,
+			Transaction:   ClientTransaction{Instructions: Instructions{*instr}},
+			InclusionWait: 10,
+		})
+	})
+	require.Nil(t, err)
+	rc := addResp.Receipt
+	require.Equal(t, TxRejected, rc.Status)
+
+	// The new node is in the roster of the block holding the instruction
+	// and catches up on the state of the ledger.
+	sb := changeRoster(services[0], CmdAddNode, roster.List[3])
+	require.Equal(t, 4, len(sb.Roster.List))
+	require.True(t, sb.Roster.List[0].Equal(roster.List[0]))
+	require.True(t, sb.Roster.List[3].Equal(roster.List[3]))
+	var i int
+	for i = 0; i < 10; i++ {
+		if bytes.Equal(services[0].getCollection(scID).RootHash(), services[3].getCollection(scID).RootHash()) {
+			break
+		}
+		time.Sleep(testInterval)
+	}
+	require.NotEqual(t, 10, i, "new node didn't catch up")
+	pr, err := services[3].GetProof(&GetProof{
+		Version: CurrentVersion,
+		ID:      scID,
+		Key:     before.Instructions[0].ObjectID.Slice(),
+	})
+	require.Nil(t, err)
+	require.True(t, pr.Proof.InclusionProof.Match())
+	require.Nil(t, pr.Proof.Verify(scID))
+
+	// The new node can become the leader and creates the next blocks.
+	sb = changeRoster(services[1], CmdRotateLeader, roster.List[3])
+	require.True(t, sb.Roster.List[0].Equal(roster.List[3]))
+	tx, err := createOneClientTx(scID, gID, dummyKind, []byte("new leader"), signer)
+	require.Nil(t, err)
+	rc = send(services[1], tx)
+	require.Equal(t, TxIncluded, rc.Status)
+	require.True(t, services[1].db().GetByID(rc.BlockID).Roster.List[0].Equal(roster.List[3]))
+
+	// The first node is removed and doesn't get the new blocks anymore.
+	sb = changeRoster(services[1], CmdRemoveNode, roster.List[0])
+	require.Equal(t, 3, len(sb.Roster.List))
+	i, _ = sb.Roster.Search(roster.List[0].ID)
+	require.True(t, i < 0)
+	after, err := createOneClientTx(scID, gID, dummyKind, []byte("after"), signer)
+	require.Nil(t, err)
+	require.Equal(t, TxIncluded, send(services[2], after).Status)
+	require.NotEqual(t, services[0].getCollection(scID).RootHash(), services[2].getCollection(scID).RootHash())
+
+	// Proofs still verify across all roster changes.
+	for _, key := range [][]byte{before.Instructions[0].ObjectID.Slice(), after.Instructions[0].ObjectID.Slice()} {
+		pr, err = services[2].GetProof(&GetProof{
+			Version: CurrentVersion,
+			ID:      scID,
+			Key:     key,
+		})
+		require.Nil(t, err)
+		require.True(t, pr.Proof.InclusionProof.Match())
+		require.Nil(t, pr.Proof.Verify(scID))
+	}
+}
+
+func TestService_Snapshot(t *testing.T) {
+	// Every entry of the collection gets its own chunk.
+	defer func(size int) { snapshotChunkSize = size }(snapshotChunkSize)
+	snapshotChunkSize = 1
+
+	local := onet.NewTCPTest(tSuite)
+	defer local.CloseAll()
+	hosts, roster, _ := local.GenTree(4, true)
+	var services []*Service
+	for _, sv := range local.GetServices(hosts, omniledgerID) {
+		services = append(services, sv.(*Service))
+	}
+	registerDummy(services)
+	defer closeQueues(local)
+
+	// The fourth node is not part of the ledger yet.
+	signer := darc.NewSignerEd25519(nil, nil)
+	genesisMsg, err := DefaultGenesisMsg(CurrentVersion, onet.NewRoster(roster.List[:3]),
+		[]string{"Spawn_dummy", "Invoke_add_node"}, signer.Identity())
+	require.Nil(t, err)
+	genesisMsg.BlockInterval = testInterval
+	genesisMsg.SnapshotInterval = 2
+	resp, err := services[0].CreateGenesisBlock(genesisMsg)
+	require.Nil(t, err)
+	scID := resp.Skipblock.SkipChainID()
+	gID := genesisMsg.GenesisDarc.GetBaseID()
+
+	send := func(tx ClientTransaction) *TxReceipt {
+		resp, err := services[0].AddTransaction(&AddTxRequest{
+			Version:       CurrentVersion,
+			SkipchainID:   scID,
+			Transaction:   tx,
+			InclusionWait: 10,
+		})
+		require.Nil(t, err)
+		require.Equal(t, TxIncluded, resp.Receipt.Status, resp.Receipt.Error)
+		return resp.Receipt
+	}
+	var keys [][]byte
+	var rc *TxReceipt
+	for rc == nil || rc.BlockIndex < 4 {
+		tx, err := createOneClientTx(scID, gID, dummyKind, []byte(fmt.Sprintf("value%d", len(keys))), signer)
+		require.Nil(t, err)
+		rc = send(tx)
+		keys = append(keys, tx.Instructions[0].ObjectID.Slice())
+	}
+
+	// The snapshots are stored in the background.
+	for i := 0; ; i++ {
+		index, _, err := services[0].snapshots.latest(scID, rc.BlockIndex)
+		require.Nil(t, err)
+		if index == rc.BlockIndex-rc.BlockIndex%2 {
+			break
+		}
+		require.True(t, i < 100, "snapshot was not created")
+		time.Sleep(testInterval / 10)
+	}
+
+	// The snapshots are split in chunks and only the latest ones are
+	// kept.
+	cl := NewClient()
+	defer cl.Close()
+	snap, err := cl.GetSnapshot(roster.List[0], scID, rc.BlockIndex, 0)
+	require.Nil(t, err)
+	require.Equal(t, 0, snap.BlockIndex%2)
+	require.True(t, snap.BlockIndex >= 4)
+	require.True(t, snap.Chunks > 1)
+	require.Equal(t, 1, len(snap.Entries))
+	_, err = cl.GetSnapshot(roster.List[0], scID, rc.BlockIndex, snap.Chunks)
+	require.NotNil(t, err)
+	_, err = cl.GetSnapshot(roster.List[0], scID, 1, 0)
+	require.NotNil(t, err)
+	index, _, err := services[0].snapshots.latest(scID, snap.BlockIndex-2*keepSnapshots)
+	require.Nil(t, err)
+	require.Equal(t, -1, index)
+
+	// The state of an earlier block is replayed from the latest local
+	// snapshot that is not after it.
+	latest, err := services[0].db().GetLatest(resp.Skipblock)
+	require.Nil(t, err)
+	coll, index, err := services[0].localSnapshot(latest)
+	require.Nil(t, err)
+	require.Equal(t, snap.BlockIndex, index)
+	for _, key := range keys[:index] {
+		_, _, err = getValueContract(*coll, key)
+		require.Nil(t, err)
+	}
+	replayed, err := services[0].collectionAt(latest)
+	require.Nil(t, err)
+	for _, key := range keys {
+		_, _, err = getValueContract(replayed, key)
+		require.Nil(t, err)
+	}
+
+	// A snapshot with more chunks than the biggest snapshot can have is
+	// refused.
+	_, _, _, err = services[1].downloadSnapshot(cl, roster.List[0], latest, 0)
+	require.Nil(t, err)
+	snapshotChunkSize = maxSnapshotSize
+	_, _, _, err = services[1].downloadSnapshot(cl, roster.List[0], latest, 0)
+	require.NotNil(t, err)
+	snapshotChunkSize = 1
+
+	// The new node gets a snapshot instead of replaying all blocks, so
+	// its journal doesn't hold the first blocks.
+	instr, err := ChangeRosterInstruction(scID, gID, CmdAddNode, roster.List[3], nextNonce(), signer)
+	require.Nil(t, err)
+	rc = send(ClientTransaction{Instructions: Instructions{*instr}})
+	cdb := services[3].getCollection(scID)
+	var i int
+	for i = 0; i < 10; i++ {
+		if cdb.latestIndex() == rc.BlockIndex {
+			break
+		}
+		time.Sleep(testInterval)
+	}
+	require.NotEqual(t, 10, i, "new node didn't catch up")
+	require.Equal(t, services[0].getCollection(scID).RootHash(), cdb.RootHash())
+	for _, key := range keys {
+		_, _, err = cdb.GetValueContract(key)
+		require.Nil(t, err)
+	}
+	_, found, err := services[3].journal.get(scID, 1)
+	require.Nil(t, err)
+	require.False(t, found)
+	_, found, err = services[3].journal.get(scID, rc.BlockIndex)
+	require.Nil(t, err)
+	require.True(t, found)
+}
+
+func TestChangeRoster(t *testing.T) {
+	r, _ := genRoster(4)
+	small := onet.NewRoster(r.List[:3])
+
+	added, err := changeRoster(small, CmdAddNode, r.List[3])
+	require.Nil(t, err)
+	require.True(t, sameRoster(r, added))
+	_, err = changeRoster(small, CmdAddNode, r.List[0])
+	require.NotNil(t, err)
+
+	removed, err := changeRoster(r, CmdRemoveNode, r.List[3])
+	require.Nil(t, err)
+	require.True(t, sameRoster(small, removed))
+	_, err = changeRoster(small, CmdRemoveNode, r.List[3])
+	require.NotNil(t, err)
+	_, err = changeRoster(onet.NewRoster(r.List[:1]), CmdRemoveNode, r.List[0])
+	require.NotNil(t, err)
+
+	rotated, err := changeRoster(r, CmdRotateLeader, r.List[2])
+	require.Nil(t, err)
+	require.True(t, sameRoster(rotateRoster(r, 2), rotated))
+	_, err = changeRoster(small, CmdRotateLeader, r.List[3])
+	require.NotNil(t, err)
+
+	_, err = changeRoster(r, CmdConfigUpdate, r.List[0])
+	require.NotNil(t, err)
+}
+
+func TestRotateRoster(t *testing.T) {
+	r, _ := genRoster(4)
+	rotated := rotateRoster(r, 2)
+	require.Equal(t, 4, len(rotated.List))
+	for i := range r.List {
+		require.True(t, r.List[(i+2)%4].Equal(rotated.List[i]))
+	}
+	require.False(t, r.ID.Equal(rotated.ID))
+}
+
 type ser struct {
 	local    *onet.LocalTest
 	hosts    []*onet.Server
@@ -377,6 +1864,62 @@ func (s *ser) service() *Service {
 	return s.services[0]
 }
 
+// newBlock returns a block following the latest block, with the given
+// transactions in its body. The header is created from the state changes of
+// applied, which is the same as body for an honest leader.
+func (s *ser) newBlock(t *testing.T, body, applied ClientTransactions) *skipchain.SkipBlock {
+	latest, err := s.service().db().GetLatest(s.sb)
+	require.Nil(t, err)
+	sb := latest.Copy()
+	sb.Index++
+	sb.BackLinkIDs = []skipchain.SkipBlockID{latest.Hash}
+	sb.Payload, err = network.Marshal(&DataBody{Transactions: body})
+	require.Nil(t, err)
+	cdb := s.service().getCollection(s.sb.SkipChainID())
+	s.service().syncMu.Lock()
+	mr, _, scs, _, err := s.service().createStateChanges(cdb.coll, applied)
+	s.service().syncMu.Unlock()
+	require.Nil(t, err)
+	sb.Data, err = network.Marshal(&DataHeader{
+		CollectionRoot:        mr,
+		ClientTransactionHash: body.Hash(),
+		StateChangesHash:      scs.Hash(),
+		Timestamp:             time.Now().UnixNano(),
+		RejectedHash:          RejectedTxs{}.Hash(),
+	})
+	require.Nil(t, err)
+	return sb
+}
+
+// withBlocks sends valid transactions to s until f returns. A batch of
+// rejected transactions doesn't create a block on its own, so the
+// transactions rejected while f runs get their receipts with these blocks.
+// f must not call require, as it runs in another goroutine.
+func withBlocks(t *testing.T, s *Service, scID skipchain.SkipBlockID, dID darc.ID, signer *darc.Signer, f func()) {
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		f()
+	}()
+	interval, err := s.loadBlockInterval(scID)
+	require.Nil(t, err)
+	for i := 0; ; i++ {
+		select {
+		case <-done:
+			return
+		case <-time.After(interval):
+		}
+		tx, err := createOneClientTx(scID, dID, dummyKind, []byte(fmt.Sprintf("block %d", i)), signer)
+		require.Nil(t, err)
+		_, err = s.AddTransaction(&AddTxRequest{
+			Version:     CurrentVersion,
+			SkipchainID: scID,
+			Transaction: tx,
+		})
+		require.Nil(t, err)
+	}
+}
+
 func newSer(t *testing.T, step int, interval time.Duration) *ser {
 	s := &ser{
 		local:  onet.NewTCPTest(tSuite),
@@ -391,7 +1934,7 @@ func newSer(t *testing.T, step int, interval time.Duration) *ser {
 	}
 	registerDummy(s.services)
 
-	genesisMsg, err := DefaultGenesisMsg(CurrentVersion, s.roster, []string{"Spawn_dummy", "Spawn_invalid"}, s.signer.Identity())
+	genesisMsg, err := DefaultGenesisMsg(CurrentVersion, s.roster, []string{"Spawn_dummy", "Spawn_invalid", "Spawn_darc", "Invoke_UpdateConfig"}, s.signer.Identity())
 	require.Nil(t, err)
 	s.darc = &genesisMsg.GenesisDarc
 
@@ -405,7 +1948,7 @@ func newSer(t *testing.T, step int, interval time.Duration) *ser {
 			require.Nil(t, err)
 			s.sb = resp.Skipblock
 		case 1:
-			tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+			tx, err := createOneClientTx(s.sb.SkipChainID(), s.darc.GetBaseID(), dummyKind, s.value, s.signer)
 			require.Nil(t, err)
 			s.tx = tx
 			_, err = s.service().AddTransaction(&AddTxRequest{
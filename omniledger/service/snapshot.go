@@ -0,0 +1,373 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/protobuf"
+	"github.com/dedis/student_18_omniledger/omniledger/collection"
+	"gopkg.in/dedis/cothority.v2/skipchain"
+	"gopkg.in/dedis/onet.v2/log"
+	"gopkg.in/dedis/onet.v2/network"
+)
+
+// snapshotChunkSize is the size in bytes above which the entries of a
+// snapshot are split into a new chunk.
+var snapshotChunkSize = 1000 * 1000
+
+// maxSnapshotSize is the maximum size in bytes of the entries of a snapshot
+// downloaded from another node.
+const maxSnapshotSize = 1000 * 1000 * 1000
+
+// keepSnapshots is the number of snapshots kept for every skipchain.
+const keepSnapshots = 2
+
+// SnapshotEntry is a key of the collection, together with its value and
+// contract ID.
+type SnapshotEntry struct {
+	Key        []byte
+	Value      []byte
+	ContractID []byte
+}
+
+// snapshotInfo describes a snapshot stored in the snapshotDB.
+type snapshotInfo struct {
+	BlockID skipchain.SkipBlockID
+	Chunks  int
+}
+
+// snapshotChunk holds the entries of one chunk of a snapshot.
+type snapshotChunk struct {
+	Entries []SnapshotEntry
+}
+
+// snapshotDB stores the state of the collections at some blocks, so that new
+// nodes can download it instead of replaying all blocks. Under scID+index is
+// the snapshotInfo of the snapshot of the block with this index, and under
+// scID+index+chunk are the chunks of the snapshot.
+type snapshotDB struct {
+	db         *bolt.DB
+	bucketName []byte
+}
+
+// newSnapshotDB makes sure the bucket exists and returns a snapshotDB.
+func newSnapshotDB(db *bolt.DB, name []byte) *snapshotDB {
+	sdb := &snapshotDB{
+		db:         db,
+		bucketName: name,
+	}
+	sdb.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(name)
+		return err
+	})
+	return sdb
+}
+
+// snapshotKey returns the key of the info of the snapshot of the block with
+// the given index, or of one of its chunks if chunk is not negative.
+func snapshotKey(scID skipchain.SkipBlockID, index, chunk int) []byte {
+	key := make([]byte, len(scID)+4, len(scID)+8)
+	copy(key, scID)
+	binary.BigEndian.PutUint32(key[len(scID):], uint32(index))
+	if chunk >= 0 {
+		key = key[:len(scID)+8]
+		binary.BigEndian.PutUint32(key[len(scID)+4:], uint32(chunk))
+	}
+	return key
+}
+
+// store saves the entries as the snapshot of the block sb, split in chunks
+// of about snapshotChunkSize bytes. Only the latest keepSnapshots snapshots
+// of the skipchain are kept.
+func (sdb *snapshotDB) store(sb *skipchain.SkipBlock, entries []SnapshotEntry) error {
+	var chunks [][]byte
+	var chunk snapshotChunk
+	var size int
+	for i, e := range entries {
+		chunk.Entries = append(chunk.Entries, e)
+		size += len(e.Key) + len(e.Value) + len(e.ContractID)
+		if size < snapshotChunkSize && i < len(entries)-1 {
+			continue
+		}
+		buf, err := protobuf.Encode(&chunk)
+		if err != nil {
+			return err
+		}
+		chunks = append(chunks, buf)
+		chunk = snapshotChunk{}
+		size = 0
+	}
+	if len(chunks) == 0 {
+		buf, err := protobuf.Encode(&chunk)
+		if err != nil {
+			return err
+		}
+		chunks = append(chunks, buf)
+	}
+	info, err := protobuf.Encode(&snapshotInfo{BlockID: sb.Hash, Chunks: len(chunks)})
+	if err != nil {
+		return err
+	}
+
+	scID := sb.SkipChainID()
+	return sdb.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(sdb.bucketName)
+		if err := b.Put(snapshotKey(scID, sb.Index, -1), info); err != nil {
+			return err
+		}
+		for i, c := range chunks {
+			if err := b.Put(snapshotKey(scID, sb.Index, i), c); err != nil {
+				return err
+			}
+		}
+
+		// Remove the older snapshots of the skipchain. The keys are
+		// sorted by index, and the info comes before the chunks.
+		var keys [][]byte
+		var indexes []int
+		cur := b.Cursor()
+		for k, _ := cur.Seek(scID); k != nil && bytes.HasPrefix(k, scID); k, _ = cur.Next() {
+			keys = append(keys, append([]byte{}, k...))
+			if len(k) == len(scID)+4 {
+				indexes = append(indexes, int(binary.BigEndian.Uint32(k[len(scID):])))
+			}
+		}
+		if len(indexes) <= keepSnapshots {
+			return nil
+		}
+		oldest := indexes[len(indexes)-keepSnapshots]
+		for _, k := range keys {
+			if int(binary.BigEndian.Uint32(k[len(scID):])) < oldest {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// latest returns the index and the info of the latest snapshot of the
+// skipchain that is not after the block with the given index. info is nil if
+// there is no such snapshot.
+func (sdb *snapshotDB) latest(scID skipchain.SkipBlockID, maxIndex int) (index int, info *snapshotInfo, err error) {
+	var buf []byte
+	err = sdb.db.View(func(tx *bolt.Tx) error {
+		// All keys before the one of maxIndex+1 are of snapshots that are
+		// not after maxIndex.
+		cur := tx.Bucket(sdb.bucketName).Cursor()
+		k, v := cur.Seek(snapshotKey(scID, maxIndex+1, -1))
+		if k == nil {
+			k, v = cur.Last()
+		} else {
+			k, v = cur.Prev()
+		}
+		for ; k != nil && bytes.HasPrefix(k, scID); k, v = cur.Prev() {
+			if len(k) == len(scID)+4 {
+				index = int(binary.BigEndian.Uint32(k[len(scID):]))
+				buf = append([]byte{}, v...)
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil || buf == nil {
+		return -1, nil, err
+	}
+	info = &snapshotInfo{}
+	if err = protobuf.Decode(buf, info); err != nil {
+		return -1, nil, err
+	}
+	return index, info, nil
+}
+
+// chunk returns the entries of a chunk of the snapshot of the block with the
+// given index.
+func (sdb *snapshotDB) chunk(scID skipchain.SkipBlockID, index, chunk int) ([]SnapshotEntry, error) {
+	var buf []byte
+	sdb.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(sdb.bucketName).Get(snapshotKey(scID, index, chunk)); v != nil {
+			buf = append([]byte{}, v...)
+		}
+		return nil
+	})
+	if buf == nil {
+		return nil, fmt.Errorf("no chunk %d in snapshot of block %d", chunk, index)
+	}
+	c := &snapshotChunk{}
+	if err := protobuf.Decode(buf, c); err != nil {
+		return nil, err
+	}
+	return c.Entries, nil
+}
+
+// createSnapshot stores the state of the collection after the block sb if
+// the index of sb is a multiple of the snapshot interval of the skipchain. It
+// is called while syncMu is held, so it only starts a read-only transaction of
+// bolt, which keeps seeing the state after sb while the next blocks are
+// applied. The snapshot is read from it and stored in the background.
+func (s *Service) createSnapshot(sb *skipchain.SkipBlock) error {
+	config, err := s.loadConfig(sb.SkipChainID())
+	if err != nil {
+		return err
+	}
+	if config.SnapshotInterval <= 0 || sb.Index == 0 || sb.Index%config.SnapshotInterval != 0 {
+		return nil
+	}
+	cdb := s.getCollection(sb.SkipChainID())
+	tx, err := cdb.db.Begin(false)
+	if err != nil {
+		return err
+	}
+	go func() {
+		entries, err := cdb.entriesIn(tx)
+		// bolt cannot grow the database while a transaction is
+		// open, so it is closed before the snapshot is stored.
+		tx.Rollback()
+		if err == nil {
+			log.Lvlf2("%s: creating snapshot of %x at block %d", s.ServerIdentity(), sb.SkipChainID(), sb.Index)
+			err = s.snapshots.store(sb, entries)
+		}
+		if err != nil {
+			log.Error("couldn't create snapshot: " + err.Error())
+		}
+	}()
+	return nil
+}
+
+// localSnapshot returns a collection holding the latest snapshot of this
+// node that is not after the block sb, and the index of the block of the
+// snapshot. The collection is nil if there is no such snapshot.
+func (s *Service) localSnapshot(sb *skipchain.SkipBlock) (*collection.Collection, int, error) {
+	scID := sb.SkipChainID()
+	index, info, err := s.snapshots.latest(scID, sb.Index)
+	if err != nil || info == nil {
+		return nil, -1, err
+	}
+	block := s.db().GetByID(info.BlockID)
+	if block == nil || block.Index != index || !block.SkipChainID().Equal(scID) {
+		return nil, -1, fmt.Errorf("don't have block %d of snapshot", index)
+	}
+	header, _, err := decodeBlock(block)
+	if err != nil {
+		return nil, -1, err
+	}
+	coll := collection.New(collection.Data{}, collection.Data{})
+	for i := 0; i < info.Chunks; i++ {
+		entries, err := s.snapshots.chunk(scID, index, i)
+		if err != nil {
+			return nil, -1, err
+		}
+		for _, e := range entries {
+			if err = coll.Add(e.Key, e.Value, e.ContractID); err != nil {
+				return nil, -1, err
+			}
+		}
+	}
+	if !bytes.Equal(coll.GetRoot(), header.CollectionRoot) {
+		return nil, -1, fmt.Errorf("snapshot doesn't match the root of block %d", index)
+	}
+	return &coll, index, nil
+}
+
+// loadSnapshot replaces the collection with the latest snapshot of the
+// roster of sb that is after the block with the index after, and not after
+// sb.
+func (s *Service) loadSnapshot(sb *skipchain.SkipBlock, after int) error {
+	cl := NewClient()
+	defer cl.Close()
+	err := errors.New("no node to get a snapshot from")
+	for _, si := range sb.Roster.List {
+		if si.Equal(s.ServerIdentity()) {
+			continue
+		}
+		var coll collection.Collection
+		var entries []SnapshotEntry
+		var block *skipchain.SkipBlock
+		coll, entries, block, err = s.downloadSnapshot(cl, si, sb, after)
+		if err != nil {
+			log.Lvl2(s.ServerIdentity(), "couldn't get snapshot from", si, err)
+			continue
+		}
+		log.Lvlf2("%s: got snapshot of %x at block %d", s.ServerIdentity(), sb.SkipChainID(), block.Index)
+		return s.getCollection(sb.SkipChainID()).restore(coll, entries, block.Index)
+	}
+	return err
+}
+
+// downloadSnapshot gets all chunks of the latest snapshot of si that is
+// after the block with the index after, and not after sb. The block of the
+// snapshot is checked against the back-links from sb, and the root of the
+// snapshot against the header of this block. It returns the collection with
+// the entries of the snapshot, and the block of the snapshot.
+func (s *Service) downloadSnapshot(cl *Client, si *network.ServerIdentity, sb *skipchain.SkipBlock,
+	after int) (collection.Collection, []SnapshotEntry, *skipchain.SkipBlock, error) {
+	var coll collection.Collection
+	reply, err := cl.GetSnapshot(si, sb.SkipChainID(), sb.Index, 0)
+	if err != nil {
+		return coll, nil, nil, err
+	}
+	if reply.BlockIndex <= after || reply.BlockIndex > sb.Index {
+		return coll, nil, nil, errors.New("no snapshot after the latest applied block")
+	}
+	block := sb
+	if reply.BlockIndex < sb.Index {
+		blocks, err := s.fetchBlocks(sb, reply.BlockIndex)
+		if err != nil {
+			return coll, nil, nil, err
+		}
+		block = blocks[0]
+	}
+	if !block.Hash.Equal(reply.BlockID) {
+		return coll, nil, nil, fmt.Errorf("snapshot is not of block %d", block.Index)
+	}
+	header, _, err := decodeBlock(block)
+	if err != nil {
+		return coll, nil, nil, err
+	}
+
+	// All chunks but the last one hold at least snapshotChunkSize bytes.
+	if reply.Chunks <= 0 || reply.Chunks > maxSnapshotSize/snapshotChunkSize+1 {
+		return coll, nil, nil, fmt.Errorf("snapshot has an invalid number of chunks: %d", reply.Chunks)
+	}
+	entries := reply.Entries
+	size := entriesSize(entries)
+	if size > maxSnapshotSize {
+		return coll, nil, nil, errors.New("snapshot is too big")
+	}
+	for i := 1; i < reply.Chunks; i++ {
+		r, err := cl.GetSnapshot(si, sb.SkipChainID(), reply.BlockIndex, i)
+		if err != nil {
+			return coll, nil, nil, err
+		}
+		if r.BlockIndex != reply.BlockIndex || r.Chunks != reply.Chunks {
+			return coll, nil, nil, errors.New("snapshot changed during download")
+		}
+		if size += entriesSize(r.Entries); size > maxSnapshotSize {
+			return coll, nil, nil, errors.New("snapshot is too big")
+		}
+		entries = append(entries, r.Entries...)
+	}
+	coll = collection.New(collection.Data{}, collection.Data{})
+	for _, e := range entries {
+		if err = coll.Add(e.Key, e.Value, e.ContractID); err != nil {
+			return coll, nil, nil, err
+		}
+	}
+	if !bytes.Equal(coll.GetRoot(), header.CollectionRoot) {
+		return coll, nil, nil, fmt.Errorf("snapshot doesn't match the root of block %d", block.Index)
+	}
+	return coll, entries, block, nil
+}
+
+// entriesSize returns the size of the entries as counted for the chunks.
+func entriesSize(entries []SnapshotEntry) int {
+	var size int
+	for _, e := range entries {
+		size += len(e.Key) + len(e.Value) + len(e.ContractID)
+	}
+	return size
+}
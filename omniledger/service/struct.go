@@ -1,13 +1,18 @@
 package service
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
 
 	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/protobuf"
 	"github.com/dedis/student_18_omniledger/omniledger/collection"
 	"github.com/dedis/student_18_omniledger/omniledger/darc"
 	"gopkg.in/dedis/cothority.v2/skipchain"
+	"gopkg.in/dedis/onet.v2/log"
 	"gopkg.in/dedis/onet.v2/network"
 )
 
@@ -20,6 +25,39 @@ type collectionDB struct {
 	db         *bolt.DB
 	bucketName []byte
 	coll       collection.Collection
+	// nodesName is the bucket holding the nodes of the tree of the
+	// collection, which are loaded when they are needed.
+	nodesName []byte
+	// metaName is the bucket holding the index of the latest block
+	// applied to the collection.
+	metaName []byte
+	latest   int
+}
+
+// latestKey is the key under which the index of the latest applied block is
+// stored in the meta bucket.
+var latestKey = []byte("latest")
+
+// versionKey is the key under which the format of the key/value pairs is
+// stored in the meta bucket.
+var versionKey = []byte("version")
+
+// collectionFormat is the version of the format of the key/value pairs in
+// bolt. In version 1, the value and the contract ID of a key are stored as a
+// collectionEntry. Version 2 also stores the nodes of the tree, so that the
+// collection doesn't have to be rebuilt from the key/value pairs. Collections
+// stored in another format are dropped and rebuilt from the blocks of the
+// skipchain.
+const collectionFormat = 2
+
+// collectionCacheSize is the number of nodes of the tree of a collection that
+// are kept in memory.
+const collectionCacheSize = 1 << 16
+
+// collectionEntry is stored in bolt under every key of the collection.
+type collectionEntry struct {
+	Value      []byte
+	ContractID []byte
 }
 
 // OmniLedgerContract is the type signature of the class functions
@@ -28,13 +66,18 @@ type collectionDB struct {
 // which is to be modified, we pass it as a pointer here.
 type OmniLedgerContract func(cdb collection.Collection, tx Instruction, c []Coin) ([]StateChange, []Coin, error)
 
-// newCollectionDB initialises a structure and reads all key/value pairs to store
-// it in the collection.
+// newCollectionDB initialises a structure and loads the root of the tree of
+// the collection. If it cannot be loaded, the collection is emptied, so that
+// it is rebuilt from the skipchain. The root of the collection is checked
+// against the skipchain by the service.
 func newCollectionDB(db *bolt.DB, name []byte) *collectionDB {
 	c := &collectionDB{
 		db:         db,
 		bucketName: name,
 		coll:       collection.New(collection.Data{}, collection.Data{}),
+		nodesName:  append(append([]byte{}, name...), []byte("_nodes")...),
+		metaName:   append(append([]byte{}, name...), []byte("_meta")...),
+		latest:     -1,
 	}
 	c.db.Update(func(tx *bolt.Tx) error {
 		_, err := tx.CreateBucket(name)
@@ -43,28 +86,216 @@ func newCollectionDB(db *bolt.DB, name []byte) *collectionDB {
 		}
 		return nil
 	})
-	c.loadAll()
-	// TODO: Check the merkle tree root.
+	c.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(c.metaName)
+		return err
+	})
+	c.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(c.nodesName)
+		return err
+	})
+	if err := c.load(); err != nil {
+		log.Lvl2("dropping collection to rebuild it:", err)
+		if err = c.reset(); err != nil {
+			log.Error("couldn't reset collection:", err)
+		}
+		return c
+	}
+	c.loadLatest()
 	return c
 }
 
-func (c *collectionDB) loadAll() {
+// load opens the tree of the collection stored in bolt. It returns an error
+// if it is not stored in the current format.
+func (c *collectionDB) load() error {
+	err := c.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(c.metaName).Get(versionKey)
+		if len(v) != 8 {
+			return errors.New("unknown format of the stored collection")
+		}
+		if version := binary.BigEndian.Uint64(v); version != collectionFormat {
+			return fmt.Errorf("stored collection has format %d instead of %d", version, collectionFormat)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.coll, err = collection.NewStored(&nodeStorage{c.db, c.nodesName}, collectionCacheSize,
+		collection.Data{}, collection.Data{})
+	return err
+}
+
+// loadLatest reads the index of the latest applied block. It stays -1 if no
+// block has been applied yet, or if the collection has been stored by an
+// older version that didn't keep track of it.
+func (c *collectionDB) loadLatest() {
 	c.db.View(func(tx *bolt.Tx) error {
-		// Assume bucket exists and has keys
-		b := tx.Bucket([]byte(c.bucketName))
-		cur := b.Cursor()
+		b := tx.Bucket(c.metaName)
+		if b == nil {
+			return nil
+		}
+		if v := b.Get(latestKey); len(v) == 8 {
+			c.latest = int(int64(binary.BigEndian.Uint64(v)))
+		}
+		return nil
+	})
+}
+
+// latestIndex returns the index of the latest block applied to the
+// collection, or -1 if there is none.
+func (c *collectionDB) latestIndex() int {
+	return c.latest
+}
+
+// setLatest stores the index of the latest block applied to the collection.
+func (c *collectionDB) setLatest(index int) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(index))
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(c.metaName).Put(latestKey, buf)
+	})
+	if err != nil {
+		return err
+	}
+	c.latest = index
+	return nil
+}
 
-		for k, v := cur.First(); k != nil; k, v = cur.Next() {
-			sig := b.Get(append(k, []byte("sig")...))
-			ck := make([]byte, len(k))
-			vk := make([]byte, len(v))
-			csig := make([]byte, len(sig))
-			copy(ck, k)
-			copy(vk, v)
-			copy(csig, sig)
-			c.coll.Add(ck, vk, csig)
+// reset removes all key/value pairs, so that the collection can be rebuilt
+// from the blocks of the skipchain. The key/value pairs stored afterwards are
+// in the current format.
+func (c *collectionDB) reset() error {
+	c.coll = collection.New(collection.Data{}, collection.Data{})
+	c.latest = -1
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(c.metaName)
+		if err := meta.Delete(latestKey); err != nil {
+			return err
+		}
+		version := make([]byte, 8)
+		binary.BigEndian.PutUint64(version, collectionFormat)
+		if err := meta.Put(versionKey, version); err != nil {
+			return err
+		}
+		for _, name := range [][]byte{c.bucketName, c.nodesName} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return c.load()
+}
 
+// entries returns all key/value pairs stored in bolt, sorted by key.
+func (c *collectionDB) entries() ([]SnapshotEntry, error) {
+	var entries []SnapshotEntry
+	err := c.db.View(func(tx *bolt.Tx) error {
+		var err error
+		entries, err = c.entriesIn(tx)
+		return err
+	})
+	return entries, err
+}
+
+// entriesIn returns all key/value pairs stored in bolt as seen by the
+// transaction tx, sorted by key.
+func (c *collectionDB) entriesIn(tx *bolt.Tx) ([]SnapshotEntry, error) {
+	var entries []SnapshotEntry
+	cur := tx.Bucket(c.bucketName).Cursor()
+	for k, v := cur.First(); k != nil; k, v = cur.Next() {
+		entry := &collectionEntry{}
+		if err := protobuf.Decode(append([]byte{}, v...), entry); err != nil {
+			return nil, fmt.Errorf("couldn't decode key %x: %s", k, err)
+		}
+		entries = append(entries, SnapshotEntry{
+			Key:        append([]byte{}, k...),
+			Value:      entry.Value,
+			ContractID: entry.ContractID,
+		})
+	}
+	return entries, nil
+}
+
+// restore replaces the collection with the entries of the snapshot of the
+// block with the given index. The root of the restored collection must be the
+// one of coll, which holds the same entries.
+func (c *collectionDB) restore(coll collection.Collection, entries []SnapshotEntry, index int) error {
+	if err := c.reset(); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := c.coll.Add(e.Key, e.Value, e.ContractID); err != nil {
+			return err
+		}
+	}
+	if !bytes.Equal(c.coll.GetRoot(), coll.GetRoot()) {
+		return errors.New("restored collection doesn't match the snapshot")
+	}
+	if err := c.coll.Flush(); err != nil {
+		return err
+	}
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(c.bucketName)
+		for _, e := range entries {
+			buf, err := protobuf.Encode(&collectionEntry{
+				Value:      e.Value,
+				ContractID: e.ContractID,
+			})
+			if err != nil {
+				return err
+			}
+			if err = b.Put(e.Key, buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return c.setLatest(index)
+}
+
+// nodeStorage stores the nodes of the tree of a collection in a bolt bucket.
+type nodeStorage struct {
+	db         *bolt.DB
+	bucketName []byte
+}
+
+// Get returns a copy of the value stored under the key, or nil.
+func (s *nodeStorage) Get(key []byte) (value []byte, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(s.bucketName).Get(key); v != nil {
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return
+}
+
+// Write stores all values of the batch in one bolt transaction.
+func (s *nodeStorage) Write(batch map[string][]byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucketName)
+		for k, v := range batch {
+			var err error
+			if v == nil {
+				err = b.Delete([]byte(k))
+			} else {
+				err = b.Put([]byte(k), v)
+			}
+			if err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 }
@@ -86,23 +317,23 @@ func (c *collectionDB) Store(t *StateChange) error {
 	if err := storeInColl(c.coll, t); err != nil {
 		return err
 	}
+	if err := c.coll.Flush(); err != nil {
+		return err
+	}
 	err := c.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(c.bucketName))
-		keykind := make([]byte, len(t.ObjectID)+4)
-		copy(keykind, t.ObjectID)
-		keykind = append(keykind, []byte("kind")...)
-
 		switch t.StateAction {
 		case Create, Update:
-			if err := bucket.Put(t.ObjectID, t.Value); err != nil {
+			buf, err := protobuf.Encode(&collectionEntry{
+				Value:      t.Value,
+				ContractID: t.ContractID,
+			})
+			if err != nil {
 				return err
 			}
-			return bucket.Put(keykind, t.ContractID)
+			return bucket.Put(t.ObjectID, buf)
 		case Remove:
-			if err := bucket.Delete(t.ObjectID); err != nil {
-				return err
-			}
-			return bucket.Delete(keykind)
+			return bucket.Delete(t.ObjectID)
 		default:
 			return errors.New("invalid state action")
 		}
@@ -111,7 +342,12 @@ func (c *collectionDB) Store(t *StateChange) error {
 }
 
 func (c *collectionDB) GetValueContract(key []byte) (value, contract []byte, err error) {
-	proof, err := c.coll.Get(key).Record()
+	return getValueContract(c.coll, key)
+}
+
+// getValueContract returns the value and the contract stored under the key.
+func getValueContract(coll collection.Collection, key []byte) (value, contract []byte, err error) {
+	proof, err := coll.Get(key).Record()
 	if err != nil {
 		return
 	}
@@ -187,10 +423,41 @@ type DataHeader struct {
 	StateChangesHash []byte
 	// Timestamp is a unix timestamp in nanoseconds.
 	Timestamp int64
+	// RejectedHash is the sha256 of the rejected transactions in the body,
+	// so that their receipts are covered by the signature of the block.
+	RejectedHash []byte
 }
 
 // DataBody is stored in the body of the skipblock but is not hashed. This reduces
 // the proof needed for a key/value pair.
 type DataBody struct {
 	Transactions ClientTransactions
+	// Rejected holds the transactions the leader refused to include in
+	// this block, together with the reason.
+	Rejected RejectedTxs
+}
+
+// RejectedTx points to a client transaction that has been refused by the
+// leader.
+type RejectedTx struct {
+	// TxHash is the hash of the refused client transaction.
+	TxHash []byte
+	// Error is the reason why the transaction has been refused.
+	Error string
+}
+
+// RejectedTxs is a slice of RejectedTx.
+type RejectedTxs []RejectedTx
+
+// Hash computes the sha256 hash of all the rejected transactions.
+func (rts RejectedTxs) Hash() []byte {
+	h := sha256.New()
+	for _, rt := range rts {
+		rtBuf, err := protobuf.Encode(&rt)
+		if err != nil {
+			log.Lvl2("Couldn't marshal rejected transaction")
+		}
+		h.Write(rtBuf)
+	}
+	return h.Sum(nil)
 }
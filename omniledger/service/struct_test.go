@@ -1,12 +1,14 @@
 package service
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"testing"
 
 	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/student_18_omniledger/omniledger/collection"
 	"github.com/stretchr/testify/require"
 )
 
@@ -79,10 +81,12 @@ func TestCollectionDB(t *testing.T) {
 	cdb2 := newCollectionDB(db, testName)
 
 	// Verify it's all there
+	require.Equal(t, cdb.RootHash(), cdb2.RootHash())
 	for c, v := range pairs {
-		stored, _, err := cdb2.GetValueContract([]byte(c))
+		stored, contract, err := cdb2.GetValueContract([]byte(c))
 		require.Nil(t, err)
 		require.Equal(t, v, string(stored))
+		require.Equal(t, myContract, contract)
 	}
 
 	// Update
@@ -155,3 +159,137 @@ func TestCollectionDBtryHash(t *testing.T) {
 	mrReal := cdb.RootHash()
 	require.Equal(t, mrTrial, mrReal)
 }
+
+func TestCollectionDBLatest(t *testing.T) {
+	tmpDB, err := ioutil.TempFile("", "tmpDB")
+	require.Nil(t, err)
+	tmpDB.Close()
+	defer os.Remove(tmpDB.Name())
+
+	db, err := bolt.Open(tmpDB.Name(), 0600, nil)
+	require.Nil(t, err)
+
+	cdb := newCollectionDB(db, testName)
+	require.Equal(t, -1, cdb.latestIndex())
+	require.Nil(t, cdb.setLatest(0))
+	require.Nil(t, cdb.setLatest(5))
+	require.Equal(t, 5, cdb.latestIndex())
+
+	// The index is kept when reloading, but not shared with other
+	// collections.
+	require.Equal(t, 5, newCollectionDB(db, testName).latestIndex())
+	require.Equal(t, -1, newCollectionDB(db, []byte("coll2")).latestIndex())
+
+	require.Nil(t, cdb.reset())
+	require.Equal(t, -1, cdb.latestIndex())
+	require.Equal(t, -1, newCollectionDB(db, testName).latestIndex())
+}
+
+func TestCollectionDBFormat(t *testing.T) {
+	tmpDB, err := ioutil.TempFile("", "tmpDB")
+	require.Nil(t, err)
+	tmpDB.Close()
+	defer os.Remove(tmpDB.Name())
+
+	db, err := bolt.Open(tmpDB.Name(), 0600, nil)
+	require.Nil(t, err)
+
+	// A collection stored without a format is dropped, so that it can be
+	// rebuilt from the skipchain.
+	require.Nil(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket(testName)
+		if err != nil {
+			return err
+		}
+		if err = b.Put([]byte("key"), []byte("value")); err != nil {
+			return err
+		}
+		return b.Put([]byte("key\x00\x00\x00\x00kind"), []byte("contract"))
+	}))
+	cdb := newCollectionDB(db, testName)
+	_, _, err = cdb.GetValueContract([]byte("key"))
+	require.NotNil(t, err)
+	require.Equal(t, -1, cdb.latestIndex())
+
+	require.Nil(t, cdb.Store(&StateChange{
+		StateAction: Create,
+		ObjectID:    []byte("key"),
+		Value:       []byte("value"),
+		ContractID:  []byte("contract"),
+	}))
+	require.Nil(t, cdb.setLatest(1))
+	cdb = newCollectionDB(db, testName)
+	value, contract, err := cdb.GetValueContract([]byte("key"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("value"), value)
+	require.Equal(t, []byte("contract"), contract)
+	require.Equal(t, 1, cdb.latestIndex())
+
+	// The same happens for a newer format, or for a tree whose root cannot
+	// be loaded.
+	require.Nil(t, db.Update(func(tx *bolt.Tx) error {
+		version := make([]byte, 8)
+		binary.BigEndian.PutUint64(version, collectionFormat+1)
+		return tx.Bucket(cdb.metaName).Put(versionKey, version)
+	}))
+	cdb = newCollectionDB(db, testName)
+	_, _, err = cdb.GetValueContract([]byte("key"))
+	require.NotNil(t, err)
+
+	require.Nil(t, cdb.Store(&StateChange{
+		StateAction: Create,
+		ObjectID:    []byte("key"),
+		Value:       []byte("value"),
+		ContractID:  []byte("contract"),
+	}))
+	require.Nil(t, db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(cdb.nodesName).Put([]byte("root"), []byte{0xff})
+	}))
+	cdb = newCollectionDB(db, testName)
+	_, _, err = cdb.GetValueContract([]byte("key"))
+	require.NotNil(t, err)
+}
+
+func TestCollectionDBNodes(t *testing.T) {
+	tmpDB, err := ioutil.TempFile("", "tmpDB")
+	require.Nil(t, err)
+	tmpDB.Close()
+	defer os.Remove(tmpDB.Name())
+
+	db, err := bolt.Open(tmpDB.Name(), 0600, nil)
+	require.Nil(t, err)
+
+	// The tree is the same as the one of a collection kept in memory, so
+	// the roots in the blocks stay valid.
+	cdb := newCollectionDB(db, testName)
+	coll := collection.New(collection.Data{}, collection.Data{})
+	for i := 0; i < 64; i++ {
+		sc := &StateChange{
+			StateAction: Create,
+			ObjectID:    []byte(fmt.Sprintf("key%d", i)),
+			Value:       []byte(fmt.Sprintf("value%d", i)),
+			ContractID:  []byte("contract"),
+		}
+		require.Nil(t, cdb.Store(sc))
+		require.Nil(t, storeInColl(coll, sc))
+	}
+	expected, err := coll.Get([]byte("key0")).Proof()
+	require.Nil(t, err)
+	for _, c := range []*collectionDB{cdb, newCollectionDB(db, testName)} {
+		proof, err := c.coll.Get([]byte("key0")).Proof()
+		require.Nil(t, err)
+		require.Equal(t, expected.Root, proof.Root)
+		require.Equal(t, expected.Steps, proof.Steps)
+	}
+
+	// The nodes of the tree are removed with the collection.
+	require.Nil(t, cdb.reset())
+	var nodes int
+	require.Nil(t, db.View(func(tx *bolt.Tx) error {
+		nodes = tx.Bucket(cdb.nodesName).Stats().KeyN
+		return nil
+	}))
+	// The root node, the placeholders that are the same, and the label of
+	// the root.
+	require.Equal(t, 3, nodes)
+}
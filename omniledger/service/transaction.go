@@ -6,9 +6,11 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math/big"
 	"sort"
 
 	"gopkg.in/dedis/cothority.v2"
+	"gopkg.in/dedis/cothority.v2/skipchain"
 	"gopkg.in/dedis/onet.v2/log"
 	"gopkg.in/dedis/onet.v2/network"
 
@@ -29,7 +31,8 @@ type Instruction struct {
 	ObjectID ObjectID
 	// Nonce is monotonically increasing with regard to the darc in the objectID
 	// and used to prevent replay attacks.
-	// The client has to track which is the current nonce of a darc-ID.
+	// The client has to track which is the current nonce of a darc-ID, or
+	// ask for it with GetNonce.
 	Nonce Nonce
 	// Index and length prevent a leader from censoring specific instructions from
 	// a client and still keep the other instructions valid.
@@ -61,9 +64,77 @@ func (oid ObjectID) Slice() []byte {
 	return append(oid.DarcID[:], oid.InstanceID[:]...)
 }
 
-// Nonce is used to prevent replay attacks in instructions.
+// Nonce is used to prevent replay attacks in instructions. It is interpreted
+// as a big-endian integer and must be bigger than the last nonce used with the
+// same darc, by at most MaxNonceStep.
 type Nonce [32]byte
 
+// MaxNonceStep is the biggest difference accepted between the nonce of an
+// instruction and the last nonce used with its darc. It leaves room for the
+// instructions sent before the others are included, but keeps a signer from
+// using up all the nonces of a darc at once.
+const MaxNonceStep = 1 << 20
+
+// NewNonce returns the nonce with the value i.
+func NewNonce(i uint64) (n Nonce) {
+	binary.BigEndian.PutUint64(n[24:], i)
+	return n
+}
+
+// Next returns the nonce following n, or an error if n is the biggest nonce.
+func (n Nonce) Next() (Nonce, error) {
+	for i := len(n) - 1; i >= 0; i-- {
+		n[i]++
+		if n[i] != 0 {
+			return n, nil
+		}
+	}
+	return Nonce{}, errors.New("no nonce follows the biggest nonce")
+}
+
+// Cmp returns -1 if n is smaller than o, 0 if they are equal and +1 if n is
+// bigger than o.
+func (n Nonce) Cmp(o Nonce) int {
+	return bytes.Compare(n[:], o[:])
+}
+
+// nonceKey returns the key under which the last nonce used with the darc is
+// stored in the collection.
+func nonceKey(dID darc.ID) []byte {
+	key := make([]byte, 0, len(dID)+len(NonceInstanceID))
+	key = append(key, dID...)
+	return append(key, NonceInstanceID[:]...)
+}
+
+// isNonceKey returns true if the key points to the last nonce of a darc.
+func isNonceKey(key []byte) bool {
+	return len(key) == darcIDLen+len(NonceInstanceID) &&
+		bytes.Equal(key[darcIDLen:], NonceInstanceID[:])
+}
+
+// loadNonce returns the last nonce used with the darc. If the darc has never
+// been used, ZeroNonce is returned.
+func loadNonce(coll collection.Collection, dID darc.ID) (n Nonce, found bool, err error) {
+	record, err := coll.Get(nonceKey(dID)).Record()
+	if err != nil {
+		return
+	}
+	if !record.Match() {
+		return
+	}
+	values, err := record.Values()
+	if err != nil {
+		return
+	}
+	buf, ok := values[0].([]byte)
+	if !ok || len(buf) != len(n) {
+		err = errors.New("invalid nonce stored in collection")
+		return
+	}
+	copy(n[:], buf)
+	return n, true, nil
+}
+
 // Spawn is called upon an existing object that will spawn a new object.
 type Spawn struct {
 	// ContractID represents the kind of contract that needs to be spawn.
@@ -109,7 +180,10 @@ func (args Arguments) Search(name string) []byte {
 	return nil
 }
 
-// Hash computes the digest of the hash function
+// Hash computes the digest of the hash function. It identifies the
+// instruction in the client transactions and was signed by the signers up to
+// version 1 of the protocol. As it covers neither the skipchain nor the
+// command of an invoke, new signatures use SigningDigest.
 func (instr Instruction) Hash() []byte {
 	h := sha256.New()
 	h.Write(instr.ObjectID.DarcID)
@@ -139,6 +213,57 @@ func (instr Instruction) Hash() []byte {
 	return h.Sum(nil)
 }
 
+// signingDomain separates the signing digest from all other hashes signed by
+// the same keys.
+const signingDomain = "omniledger instruction signature v2"
+
+// SigningDigest returns the digest the signers of the instruction sign for
+// the skipchain scID. Unlike Hash it covers the skipchain, the action type,
+// the contract ID, the command and the arguments, and all variable-length
+// fields are prefixed with their length, so an instruction signed for one
+// skipchain cannot be replayed on another one using the same darc.
+func (instr Instruction) SigningDigest(scID skipchain.SkipBlockID) []byte {
+	h := sha256.New()
+	writeBytes := func(buf []byte) {
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, uint64(len(buf)))
+		h.Write(b)
+		h.Write(buf)
+	}
+	writeBytes([]byte(signingDomain))
+	writeBytes(scID)
+	writeBytes(instr.ObjectID.DarcID)
+	writeBytes(instr.ObjectID.InstanceID[:])
+	writeBytes(instr.Nonce[:])
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(instr.Index))
+	h.Write(b)
+	binary.LittleEndian.PutUint64(b, uint64(instr.Length))
+	h.Write(b)
+	var args []Argument
+	switch {
+	case instr.Spawn != nil:
+		h.Write([]byte{0})
+		writeBytes([]byte(instr.Spawn.ContractID))
+		args = instr.Spawn.Args
+	case instr.Invoke != nil:
+		h.Write([]byte{1})
+		writeBytes([]byte(instr.Invoke.Command))
+		args = instr.Invoke.Args
+	case instr.Delete != nil:
+		h.Write([]byte{2})
+	default:
+		h.Write([]byte{3})
+	}
+	binary.LittleEndian.PutUint64(b, uint64(len(args)))
+	h.Write(b)
+	for _, a := range args {
+		writeBytes([]byte(a.Name))
+		writeBytes(a.Value)
+	}
+	return h.Sum(nil)
+}
+
 // GetContractState searches for the contract kind of this instruction and the
 // attached state to it. It needs the collection to do so.
 func (instr Instruction) GetContractState(coll collection.Collection) (contractID string, state []byte, err error) {
@@ -167,6 +292,35 @@ func (instr Instruction) GetContractState(coll collection.Collection) (contractI
 	return
 }
 
+// checkNonce verifies that the nonce of the instruction is bigger than the
+// last nonce used with its darc, by at most MaxNonceStep. It returns the state
+// change that stores the nonce of the instruction as the new last nonce.
+func (instr Instruction) checkNonce(coll collection.Collection) (StateChange, error) {
+	last, found, err := loadNonce(coll, instr.ObjectID.DarcID)
+	if err != nil {
+		return StateChange{}, err
+	}
+	if instr.Nonce.Cmp(last) <= 0 {
+		return StateChange{}, fmt.Errorf("nonce %x is not bigger than the last nonce %x of darc %x",
+			instr.Nonce, last, instr.ObjectID.DarcID)
+	}
+	step := new(big.Int).Sub(new(big.Int).SetBytes(instr.Nonce[:]), new(big.Int).SetBytes(last[:]))
+	if step.Cmp(big.NewInt(MaxNonceStep)) > 0 {
+		return StateChange{}, fmt.Errorf("nonce %x is more than %d above the last nonce %x of darc %x",
+			instr.Nonce, MaxNonceStep, last, instr.ObjectID.DarcID)
+	}
+	sa := Create
+	if found {
+		sa = Update
+	}
+	return StateChange{
+		StateAction: sa,
+		ObjectID:    nonceKey(instr.ObjectID.DarcID),
+		ContractID:  []byte(ContractNonceID),
+		Value:       append([]byte{}, instr.Nonce[:]...),
+	}, nil
+}
+
 // Action returns the action that the user wants to do with this
 // instruction.
 func (instr Instruction) Action() string {
@@ -194,12 +348,13 @@ func (instr Instruction) String() string {
 	return out
 }
 
-// SignBy gets signers to sign the (receiver) transaction.
-func (instr *Instruction) SignBy(signers ...*darc.Signer) error {
+// SignBy gets signers to sign the (receiver) transaction for the skipchain
+// scID.
+func (instr *Instruction) SignBy(scID skipchain.SkipBlockID, signers ...*darc.Signer) error {
 	// Create the request and populate it with the right identities.  We
 	// need to do this prior to signing because identities are a part of
 	// the digest.
-	req, err := instr.ToDarcRequest()
+	req, err := instr.ToDarcRequest(scID)
 	if err != nil {
 		return err
 	}
@@ -224,17 +379,35 @@ func (instr *Instruction) SignBy(signers ...*darc.Signer) error {
 	return nil
 }
 
-// ToDarcRequest converts the Instruction content into a darc.Request.
-func (instr Instruction) ToDarcRequest() (*darc.Request, error) {
+// ToDarcRequest converts the Instruction content into a darc.Request for the
+// skipchain scID, using the signing digest of the current version.
+func (instr Instruction) ToDarcRequest(scID skipchain.SkipBlockID) (*darc.Request, error) {
+	return instr.toDarcRequest(scID, CurrentVersion)
+}
+
+// toDarcRequest converts the Instruction content into a darc.Request with the
+// signing digest of version v. Up to version 1 the signers signed Hash,
+// which doesn't depend on the skipchain.
+func (instr Instruction) toDarcRequest(scID skipchain.SkipBlockID, v Version) (*darc.Request, error) {
 	baseID := instr.ObjectID.DarcID
-	action := instr.Action()
+	action := darc.Action(instr.Action())
+	// Evolving a darc on the ledger needs the same rights as evolving it
+	// off-chain.
+	if instr.Invoke != nil && instr.Invoke.Command == CmdDarcEvolve &&
+		instr.ObjectID.InstanceID == ZeroNonce {
+		action = darc.Action("_evolve")
+	}
 	ids := make([]*darc.Identity, len(instr.Signatures))
 	sigs := make([][]byte, len(instr.Signatures))
 	for i, sig := range instr.Signatures {
 		ids[i] = &sig.Signer
 		sigs[i] = sig.Signature // TODO shallow copy is ok?
 	}
-	req := darc.InitRequest(baseID, darc.Action(action), instr.Hash(), ids, sigs)
+	msg := instr.SigningDigest(scID)
+	if v <= 1 {
+		msg = instr.Hash()
+	}
+	req := darc.InitRequest(baseID, action, msg, ids, sigs)
 	return &req, nil
 }
 
@@ -256,6 +429,63 @@ type ClientTransaction struct {
 	Instructions Instructions
 }
 
+// Hash returns the sha256 hash of all instructions of the client
+// transaction, together with their commands and signatures. It is used to look
+// up the status of the transaction, so a copy of the transaction with other
+// signatures doesn't take the place of the original one in the pool.
+func (ct ClientTransaction) Hash() []byte {
+	h := sha256.New()
+	b := make([]byte, 4)
+	write := func(buf []byte) {
+		binary.LittleEndian.PutUint32(b, uint32(len(buf)))
+		h.Write(b)
+		h.Write(buf)
+	}
+	for _, instr := range ct.Instructions {
+		h.Write(instr.Hash())
+		if instr.Invoke != nil {
+			write([]byte(instr.Invoke.Command))
+		}
+		binary.LittleEndian.PutUint32(b, uint32(len(instr.Signatures)))
+		h.Write(b)
+		for _, sig := range instr.Signatures {
+			write([]byte(sig.Signer.String()))
+			write(sig.Signature)
+		}
+	}
+	return h.Sum(nil)
+}
+
+// Size returns the number of bytes of the encoded client transaction. It is
+// used to limit the size of the blocks.
+func (ct ClientTransaction) Size() (int, error) {
+	buf, err := protobuf.Encode(&ct)
+	if err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+// verifyIndices checks that the Index of every instruction is its position in
+// the client transaction and that the Length is the number of instructions.
+// As both are signed, nobody can remove or reorder the instructions of a
+// client transaction without invalidating it.
+func (ct ClientTransaction) verifyIndices() error {
+	if len(ct.Instructions) == 0 {
+		return errors.New("client transaction has no instructions")
+	}
+	for i, instr := range ct.Instructions {
+		if instr.Index != i {
+			return fmt.Errorf("instruction %d has index %d", i, instr.Index)
+		}
+		if instr.Length != len(ct.Instructions) {
+			return fmt.Errorf("instruction %d has length %d, but there are %d instructions",
+				i, instr.Length, len(ct.Instructions))
+		}
+	}
+	return nil
+}
+
 // ClientTransactions is a slice of ClientTransaction
 type ClientTransactions []ClientTransaction
 
@@ -408,6 +638,33 @@ func sortTransactions(ts []ClientTransaction) error {
 	return nil
 }
 
+// sortNonces reorders the transactions of every darc so that their nonces are
+// increasing, without moving the transactions of the other darcs. This makes
+// sure that a client can send more than one transaction per block. The darc
+// and the nonce of a transaction are taken from its first instruction.
+func sortNonces(ts []ClientTransaction) {
+	positions := make(map[string][]int)
+	for i, t := range ts {
+		if len(t.Instructions) == 0 {
+			continue
+		}
+		dID := string(t.Instructions[0].ObjectID.DarcID)
+		positions[dID] = append(positions[dID], i)
+	}
+	for _, pos := range positions {
+		darcTs := make([]ClientTransaction, len(pos))
+		for i, p := range pos {
+			darcTs[i] = ts[p]
+		}
+		sort.SliceStable(darcTs, func(i, j int) bool {
+			return darcTs[i].Instructions[0].Nonce.Cmp(darcTs[j].Instructions[0].Nonce) < 0
+		})
+		for i, p := range pos {
+			ts[p] = darcTs[i]
+		}
+	}
+}
+
 // xorTransactions returns the XOR of the hash values of all the transactions.
 func xorTransactions(ts [][]byte) []byte {
 	result := make([]byte, sha256.Size)
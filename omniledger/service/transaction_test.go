@@ -1,12 +1,23 @@
 package service
 
 import (
+	"sync/atomic"
 	"testing"
 
 	"github.com/dedis/student_18_omniledger/omniledger/darc"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/cothority.v2/skipchain"
 )
 
+// testNonce is increased for every instruction created in the tests, so that
+// the nonces are always bigger than the last one of the darc. It starts at
+// one, which is the nonce of the genesis instruction.
+var testNonce uint64 = 1
+
+func nextNonce() Nonce {
+	return NewNonce(atomic.AddUint64(&testNonce, 1))
+}
+
 func nonceStr(s string) (n Nonce) {
 	copy(n[:], s)
 	return n
@@ -91,6 +102,98 @@ func TestSortTransactions(t *testing.T) {
 	}
 }
 
+func TestNonce(t *testing.T) {
+	require.Equal(t, OneNonce, NewNonce(1))
+	next, err := ZeroNonce.Next()
+	require.Nil(t, err)
+	require.Equal(t, OneNonce, next)
+	next, err = NewNonce(255).Next()
+	require.Nil(t, err)
+	require.Equal(t, NewNonce(256), next)
+	require.Equal(t, -1, NewNonce(255).Cmp(NewNonce(256)))
+	require.Equal(t, 0, OneNonce.Cmp(NewNonce(1)))
+	require.Equal(t, 1, NonceInstanceID.Cmp(NewNonce(1<<63)))
+
+	var max Nonce
+	for i := range max {
+		max[i] = 0xff
+	}
+	_, err = max.Next()
+	require.NotNil(t, err)
+
+	require.True(t, isNonceKey(nonceKey(darcidStr("darc"))))
+	require.False(t, isNonceKey(ObjectID{darcidStr("darc"), OneNonce}.Slice()))
+}
+
+func TestSortNonces(t *testing.T) {
+	tx := func(d string, n uint64) ClientTransaction {
+		return ClientTransaction{
+			Instructions: []Instruction{{
+				ObjectID: ObjectID{DarcID: darcidStr(d)},
+				Nonce:    NewNonce(n),
+			}},
+		}
+	}
+	ts := []ClientTransaction{tx("a", 3), tx("b", 2), tx("a", 1), tx("b", 1), tx("a", 2)}
+	sortNonces(ts)
+	expected := []ClientTransaction{tx("a", 1), tx("b", 1), tx("a", 2), tx("b", 2), tx("a", 3)}
+	require.Equal(t, expected, ts)
+}
+
+func TestClientTransaction_VerifyIndices(t *testing.T) {
+	signer := darc.NewSignerEd25519(nil, nil)
+	values := [][]byte{[]byte("1"), []byte("2"), []byte("3")}
+	ct, err := createClientTx(getSBID("chain"), darcidStr("darc"), "dummy", values, signer)
+	require.Nil(t, err)
+	require.Nil(t, ct.verifyIndices())
+
+	require.NotNil(t, ClientTransaction{}.verifyIndices())
+	require.NotNil(t, ClientTransaction{Instructions: ct.Instructions[:2]}.verifyIndices())
+	require.NotNil(t, ClientTransaction{Instructions: ct.Instructions[1:]}.verifyIndices())
+	reordered := Instructions{ct.Instructions[1], ct.Instructions[0], ct.Instructions[2]}
+	require.NotNil(t, ClientTransaction{Instructions: reordered}.verifyIndices())
+	doubled := append(Instructions{}, ct.Instructions...)
+	doubled = append(doubled, ct.Instructions[2])
+	require.NotNil(t, ClientTransaction{Instructions: doubled}.verifyIndices())
+}
+
+func TestClientTransaction_Hash(t *testing.T) {
+	scID := getSBID("chain")
+	signer := darc.NewSignerEd25519(nil, nil)
+	ct, err := createOneClientTx(scID, darcidStr("darc"), "dummy", []byte("1"), signer)
+	require.Nil(t, err)
+	hash := ct.Hash()
+
+	// The copies of the transaction with other signatures or another
+	// command have another hash, although their instructions have the
+	// same hash.
+	copied := func() ClientTransaction {
+		instr := ct.Instructions[0]
+		instr.Signatures = append([]darc.Signature{}, instr.Signatures...)
+		return ClientTransaction{Instructions: Instructions{instr}}
+	}
+	forged := copied()
+	forged.Instructions[0].Signatures[0].Signature = []byte("forged")
+	other := copied()
+	require.Nil(t, other.Instructions[0].SignBy(scID, darc.NewSignerEd25519(nil, nil)))
+	unsigned := copied()
+	unsigned.Instructions[0].Signatures = nil
+	for _, c := range []ClientTransaction{forged, other, unsigned} {
+		require.Equal(t, ct.Instructions.Hash(), c.Instructions.Hash())
+		require.NotEqual(t, hash, c.Hash())
+	}
+	require.Equal(t, hash, copied().Hash())
+
+	invoke := copied()
+	invoke.Instructions[0].Spawn = nil
+	invoke.Instructions[0].Invoke = &Invoke{Command: "one"}
+	command := copied()
+	command.Instructions[0].Spawn = nil
+	command.Instructions[0].Invoke = &Invoke{Command: "two"}
+	require.Equal(t, invoke.Instructions.Hash(), command.Instructions.Hash())
+	require.NotEqual(t, invoke.Hash(), command.Hash())
+}
+
 func TestTransaction_Signing(t *testing.T) {
 	signer := darc.NewSignerEd25519(nil, nil)
 	ids := []*darc.Identity{signer.Identity()}
@@ -98,35 +201,152 @@ func TestTransaction_Signing(t *testing.T) {
 	d.Rules.AddRule("Spawn_dummy_kind", d.Rules.GetSignExpr())
 	require.Nil(t, d.Verify())
 
-	instr, err := createInstr(d.GetBaseID(), "dummy_kind", []byte("dummy_value"), signer)
+	scID := getSBID("ledger A")
+	instr, err := createInstr(scID, d.GetBaseID(), "dummy_kind", []byte("dummy_value"), signer)
 	require.Nil(t, err)
 
-	require.Nil(t, instr.SignBy(signer))
+	require.Nil(t, instr.SignBy(scID, signer))
 
-	req, err := instr.ToDarcRequest()
+	req, err := instr.ToDarcRequest(scID)
 	require.Nil(t, err)
 	require.Nil(t, req.Verify(d))
+
+	// The same instruction must not be valid on another ledger using the
+	// same darc.
+	req, err = instr.ToDarcRequest(getSBID("ledger B"))
+	require.Nil(t, err)
+	require.NotNil(t, req.Verify(d))
+
+	// Nor with the digest of version 1, which doesn't cover the ledger.
+	req, err = instr.toDarcRequest(scID, 1)
+	require.Nil(t, err)
+	require.NotNil(t, req.Verify(d))
+
+	// Signatures of version 1 are valid on every ledger.
+	require.Nil(t, signByV1(&instr, signer))
+	for _, id := range []string{"ledger A", "ledger B"} {
+		req, err = instr.toDarcRequest(getSBID(id), 1)
+		require.Nil(t, err)
+		require.Nil(t, req.Verify(d))
+	}
+	req, err = instr.ToDarcRequest(scID)
+	require.Nil(t, err)
+	require.NotNil(t, req.Verify(d))
 }
 
-func createOneClientTx(dID darc.ID, kind string, value []byte, signer *darc.Signer) (ClientTransaction, error) {
-	instr, err := createInstr(dID, kind, value, signer)
+func TestInstruction_SigningDigest(t *testing.T) {
+	scID := getSBID("ledger A")
+	invoke := Instruction{
+		ObjectID: ObjectID{DarcID: darcidStr("darc"), InstanceID: OneNonce},
+		Nonce:    NewNonce(1),
+		Length:   1,
+		Invoke: &Invoke{
+			Command: "one",
+			Args:    Arguments{{Name: "ab", Value: []byte("c")}},
+		},
+	}
+	digest := invoke.SigningDigest(scID)
+	require.Equal(t, digest, invoke.SigningDigest(scID))
+	require.NotEqual(t, digest, invoke.Hash())
+	require.NotEqual(t, digest, invoke.SigningDigest(getSBID("ledger B")))
+
+	// Every field changes the digest.
+	changes := []func(*Instruction){
+		func(i *Instruction) { i.Invoke.Command = "two" },
+		func(i *Instruction) { i.Invoke.Args[0] = Argument{Name: "a", Value: []byte("bc")} },
+		func(i *Instruction) { i.Invoke.Args = append(i.Invoke.Args, Argument{}) },
+		func(i *Instruction) { i.Nonce = NewNonce(2) },
+		func(i *Instruction) { i.Index = 1 },
+		func(i *Instruction) { i.Length = 2 },
+		func(i *Instruction) { i.ObjectID.InstanceID = ZeroNonce },
+		func(i *Instruction) { i.Spawn, i.Invoke = &Spawn{Args: i.Invoke.Args}, nil },
+		func(i *Instruction) { i.Delete, i.Invoke = &Delete{}, nil },
+	}
+	for n, change := range changes {
+		instr := invoke
+		instr.Invoke = &Invoke{
+			Command: invoke.Invoke.Command,
+			Args:    append(Arguments{}, invoke.Invoke.Args...),
+		}
+		change(&instr)
+		require.NotEqual(t, digest, instr.SigningDigest(scID), "change %d", n)
+	}
+
+	// The contract ID and the first argument cannot be mixed up.
+	spawn := Instruction{Spawn: &Spawn{ContractID: "ab",
+		Args: Arguments{{Name: "c"}}}}
+	other := Instruction{Spawn: &Spawn{ContractID: "a",
+		Args: Arguments{{Name: "bc"}}}}
+	require.Equal(t, spawn.Hash(), other.Hash())
+	require.NotEqual(t, spawn.SigningDigest(scID), other.SigningDigest(scID))
+}
+
+// signByV1 signs the instruction like the clients of version 1, which
+// signed Instruction.Hash.
+func signByV1(instr *Instruction, signers ...*darc.Signer) error {
+	req, err := instr.toDarcRequest(nil, 1)
+	if err != nil {
+		return err
+	}
+	instr.Signatures = make([]darc.Signature, len(signers))
+	req.Identities = make([]*darc.Identity, len(signers))
+	for i := range signers {
+		req.Identities[i] = signers[i].Identity()
+	}
+	for i := range signers {
+		sig, err := signers[i].Sign(req.Hash())
+		if err != nil {
+			return err
+		}
+		instr.Signatures[i] = darc.Signature{
+			Signature: sig,
+			Signer:    *signers[i].Identity(),
+		}
+	}
+	return nil
+}
+
+func createOneClientTx(scID skipchain.SkipBlockID, dID darc.ID, kind string, value []byte, signer *darc.Signer) (ClientTransaction, error) {
+	instr, err := createInstr(scID, dID, kind, value, signer)
 	t := ClientTransaction{
 		Instructions: []Instruction{instr},
 	}
 	return t, err
 }
 
-func createInstr(dID darc.ID, contractID string, value []byte, signer *darc.Signer) (Instruction, error) {
+func createInstr(scID skipchain.SkipBlockID, dID darc.ID, contractID string, value []byte, signer *darc.Signer) (Instruction, error) {
 	instr := Instruction{
 		ObjectID: ObjectID{
 			DarcID:     dID,
 			InstanceID: GenNonce(),
 		},
+		Nonce:  nextNonce(),
+		Index:  0,
+		Length: 1,
 		Spawn: &Spawn{
 			ContractID: contractID,
 			Args:       Arguments{{Name: "data", Value: value}},
 		},
 	}
-	err := instr.SignBy(signer)
+	err := instr.SignBy(scID, signer)
 	return instr, err
 }
+
+// createClientTx returns a client transaction with one instruction for
+// every value.
+func createClientTx(scID skipchain.SkipBlockID, dID darc.ID, kind string, values [][]byte, signer *darc.Signer) (ClientTransaction, error) {
+	var t ClientTransaction
+	for i, value := range values {
+		instr, err := createInstr(scID, dID, kind, value, signer)
+		if err != nil {
+			return t, err
+		}
+		instr.Index = i
+		instr.Length = len(values)
+		if err = instr.SignBy(scID, signer); err != nil {
+			return t, err
+		}
+		t.Instructions = append(t.Instructions, instr)
+	}
+	return t, nil
+}
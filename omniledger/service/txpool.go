@@ -0,0 +1,297 @@
+package service
+
+/*
+Every node accepts new transactions from clients. The transactions are kept in
+a pending pool until they are included in a block. Followers forward the
+transactions to the leader, which puts them in its queue. If the leader
+changes, all nodes forward their pending transactions to the new leader, so
+that no transaction is lost if the old leader failed.
+*/
+
+import (
+	"errors"
+	"sync"
+
+	"gopkg.in/dedis/cothority.v2/skipchain"
+	"gopkg.in/dedis/onet.v2/log"
+	"gopkg.in/dedis/onet.v2/network"
+)
+
+// maxPoolAge is the number of blocks a transaction stays in the pending pool
+// without being included. After that it is dropped, because the leader most
+// probably refused it.
+const maxPoolAge = 10
+
+var forwardTxsID network.MessageTypeID
+var rejectedTxsID network.MessageTypeID
+
+func init() {
+	forwardTxsID = network.RegisterMessage(&forwardTxs{})
+	rejectedTxsID = network.RegisterMessage(&rejectedTxs{})
+}
+
+// forwardTxs is sent by a follower to the leader with the transactions it
+// received from clients.
+type forwardTxs struct {
+	SkipchainID  skipchain.SkipBlockID
+	Transactions ClientTransactions
+}
+
+// rejectedTxs is sent by the leader to the other nodes of the roster with the
+// transactions it refused without creating a block.
+type rejectedTxs struct {
+	SkipchainID skipchain.SkipBlockID
+	Rejected    RejectedTxs
+}
+
+// pendingTx is a transaction in the pool together with the number of blocks
+// it has been waiting for.
+type pendingTx struct {
+	tx  ClientTransaction
+	age int
+}
+
+// txPool holds the transactions received by this node for all skipchains
+// that are not yet included in a block.
+type txPool struct {
+	sync.Mutex
+	// txs maps the skipchain ID to the hashes of the pending transactions.
+	txs map[string]map[string]*pendingTx
+	// rejected holds for every skipchain the transactions refused by the
+	// leader that wait for the next block to get their receipts.
+	rejected map[string]RejectedTxs
+}
+
+func newTxPool() *txPool {
+	return &txPool{
+		txs:      make(map[string]map[string]*pendingTx),
+		rejected: make(map[string]RejectedTxs),
+	}
+}
+
+// add stores the transaction in the pool. It returns false if the
+// transaction was already in the pool.
+func (p *txPool) add(scID skipchain.SkipBlockID, tx ClientTransaction) bool {
+	p.Lock()
+	defer p.Unlock()
+	if p.txs[string(scID)] == nil {
+		p.txs[string(scID)] = make(map[string]*pendingTx)
+	}
+	key := string(tx.Hash())
+	if _, ok := p.txs[string(scID)][key]; ok {
+		return false
+	}
+	p.txs[string(scID)][key] = &pendingTx{tx: tx}
+	return true
+}
+
+// update removes all transactions that have been included in a new block
+// and drops the transactions that are waiting for too long.
+func (p *txPool) update(scID skipchain.SkipBlockID, included ClientTransactions) {
+	p.Lock()
+	defer p.Unlock()
+	pending := p.txs[string(scID)]
+	for _, tx := range included {
+		delete(pending, string(tx.Hash()))
+	}
+	for key, ptx := range pending {
+		ptx.age++
+		if ptx.age > maxPoolAge {
+			log.Lvlf2("dropping transaction %x from pool", key)
+			delete(pending, key)
+		}
+	}
+}
+
+// remove deletes the transaction with the given hash from the pool.
+func (p *txPool) remove(scID skipchain.SkipBlockID, txHash []byte) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.txs[string(scID)], string(txHash))
+}
+
+// has returns true if the transaction with the given hash is pending.
+func (p *txPool) has(scID skipchain.SkipBlockID, txHash []byte) bool {
+	p.Lock()
+	defer p.Unlock()
+	_, ok := p.txs[string(scID)][string(txHash)]
+	return ok
+}
+
+// reject keeps the refused transactions until the next block is created.
+func (p *txPool) reject(scID skipchain.SkipBlockID, rts RejectedTxs) {
+	p.Lock()
+	defer p.Unlock()
+	p.rejected[string(scID)] = append(p.rejected[string(scID)], rts...)
+}
+
+// takeRejected returns the refused transactions waiting for a block and
+// removes them from the pool.
+func (p *txPool) takeRejected(scID skipchain.SkipBlockID) RejectedTxs {
+	p.Lock()
+	defer p.Unlock()
+	rts := p.rejected[string(scID)]
+	delete(p.rejected, string(scID))
+	return rts
+}
+
+// get returns all pending transactions of the skipchain.
+func (p *txPool) get(scID skipchain.SkipBlockID) ClientTransactions {
+	p.Lock()
+	defer p.Unlock()
+	var txs ClientTransactions
+	for _, ptx := range p.txs[string(scID)] {
+		txs = append(txs, ptx.tx)
+	}
+	return txs
+}
+
+// enqueue passes the transaction to the queue worker of the skipchain. It
+// must only be called on the leader.
+func (s *Service) enqueue(scID skipchain.SkipBlockID, tx ClientTransaction) error {
+	s.startQueueWorker(scID)
+	s.workersMu.Lock()
+	c, ok := s.queueWorkers[string(scID)]
+	closing := s.queueClosing[string(scID)]
+	s.workersMu.Unlock()
+	if !ok {
+		return errors.New("no queue worker for this skipchain")
+	}
+
+	select {
+	case c <- tx:
+		return nil
+	case <-closing:
+		return errors.New("this node is not the leader anymore")
+	case <-s.CloseQueues:
+		return errors.New("queues are closed")
+	}
+}
+
+// forwardToLeader sends the transactions to the leader of the latest block.
+// If this node is the leader, the transactions are put in its own queue.
+func (s *Service) forwardToLeader(latest *skipchain.SkipBlock, txs ClientTransactions) error {
+	if len(txs) == 0 {
+		return nil
+	}
+	leader := latest.Roster.List[0]
+	if leader.Equal(s.ServerIdentity()) {
+		for _, tx := range txs {
+			if err := s.enqueue(latest.SkipChainID(), tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	log.Lvlf2("%s: forwarding %d transactions to %s", s.ServerIdentity(), len(txs), leader)
+	return s.SendRaw(leader, &forwardTxs{
+		SkipchainID:  latest.SkipChainID(),
+		Transactions: txs,
+	})
+}
+
+// handleForwardTxs is called on the leader when a follower forwards
+// transactions.
+func (s *Service) handleForwardTxs(env *network.Envelope) {
+	msg, ok := env.Msg.(*forwardTxs)
+	if !ok {
+		log.Error("wrong message type")
+		return
+	}
+	sb := s.db().GetByID(msg.SkipchainID)
+	if sb == nil {
+		log.Lvl2(s.ServerIdentity(), "forwarded transactions for unknown skipchain")
+		return
+	}
+	latest, err := s.db().GetLatest(sb)
+	if err != nil {
+		log.Error("couldn't get latest block:", err)
+		return
+	}
+	if i, _ := latest.Roster.Search(env.ServerIdentity.ID); i < 0 {
+		log.Lvl2(s.ServerIdentity(), "forwarded transactions from a node outside of the roster")
+		return
+	}
+	if !latest.Roster.List[0].Equal(s.ServerIdentity()) {
+		log.Lvl2(s.ServerIdentity(), "got forwarded transactions but is not the leader")
+		return
+	}
+	// Don't block the processing of messages while the queue worker is
+	// busy creating a new block.
+	go func() {
+		for _, tx := range msg.Transactions {
+			s.txPool.add(msg.SkipchainID, tx)
+			if err := s.enqueue(msg.SkipchainID, tx); err != nil {
+				log.Error("couldn't queue forwarded transaction:", err)
+				return
+			}
+		}
+	}()
+}
+
+// announceRejected stores the receipts of the transactions the leader refused
+// without creating a block, and sends them to the other nodes of the roster,
+// so that the clients waiting for them don't have to wait for the next block.
+func (s *Service) announceRejected(sb *skipchain.SkipBlock, rts RejectedTxs) {
+	s.storeRejected(sb.SkipChainID(), rts)
+	for _, si := range sb.Roster.List {
+		if si.Equal(s.ServerIdentity()) {
+			continue
+		}
+		err := s.SendRaw(si, &rejectedTxs{
+			SkipchainID: sb.SkipChainID(),
+			Rejected:    rts,
+		})
+		if err != nil {
+			log.Lvl2(s.ServerIdentity(), "couldn't send rejected transactions to", si, err)
+		}
+	}
+}
+
+// handleRejectedTxs is called on the followers when the leader refused
+// transactions without creating a block.
+func (s *Service) handleRejectedTxs(env *network.Envelope) {
+	msg, ok := env.Msg.(*rejectedTxs)
+	if !ok {
+		log.Error("wrong message type")
+		return
+	}
+	sb := s.db().GetByID(msg.SkipchainID)
+	if sb == nil {
+		log.Lvl2(s.ServerIdentity(), "rejected transactions for unknown skipchain")
+		return
+	}
+	latest, err := s.db().GetLatest(sb)
+	if err != nil {
+		log.Error("couldn't get latest block:", err)
+		return
+	}
+	if !latest.Roster.List[0].Equal(env.ServerIdentity) {
+		log.Lvl2(s.ServerIdentity(), "got rejected transactions from a node that is not the leader")
+		return
+	}
+	s.storeRejected(msg.SkipchainID, msg.Rejected)
+}
+
+// storeRejected removes the refused transactions from the pool and stores
+// their receipts, which are replaced by the ones of the block recording the
+// rejections. The receipt of a transaction that is already included is kept,
+// as it can only be refused again because of its nonce.
+func (s *Service) storeRejected(scID skipchain.SkipBlockID, rts RejectedTxs) {
+	for _, rt := range rts {
+		s.txPool.remove(scID, rt.TxHash)
+		rc, err := s.receipts.get(scID, rt.TxHash)
+		if err != nil {
+			log.Error("couldn't get receipt:", err)
+			continue
+		}
+		if rc != nil && rc.Status == TxIncluded {
+			continue
+		}
+		s.storeReceipt(scID, &TxReceipt{
+			TxHash: rt.TxHash,
+			Status: TxRejected,
+			Error:  rt.Error,
+		})
+	}
+}
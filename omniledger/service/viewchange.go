@@ -0,0 +1,368 @@
+package service
+
+/*
+This file implements the view-change of OmniLedger. The leader of a skipchain
+is always the first node in the roster of the latest block. It sends a
+heartbeat to all followers at every block interval. If a follower doesn't hear
+from the leader for longer than the view-change timeout, it asks the next node
+in the roster to take over. Once enough nodes asked the same candidate, the
+candidate proposes a new block without transactions, but with a roster
+rotated so that the candidate is the first node. The followers only sign this
+block if they requested the view-change themselves, so the collective signature
+of the block is the agreement on the new leader.
+*/
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gopkg.in/dedis/cothority.v2/skipchain"
+	"gopkg.in/dedis/onet.v2"
+	"gopkg.in/dedis/onet.v2/log"
+	"gopkg.in/dedis/onet.v2/network"
+)
+
+// rotationWindow is the number of block intervals a follower waits without
+// hearing from the leader before it requests a view-change.
+const rotationWindow = 10
+
+var heartbeatID network.MessageTypeID
+var viewChangeReqID network.MessageTypeID
+
+func init() {
+	heartbeatID = network.RegisterMessage(&heartbeat{})
+	viewChangeReqID = network.RegisterMessage(&viewChangeReq{})
+}
+
+// heartbeat is sent by the leader to all followers at every block interval,
+// so they know it is alive even if no new block is created.
+type heartbeat struct {
+	SkipchainID skipchain.SkipBlockID
+	LatestID    skipchain.SkipBlockID
+}
+
+// viewChangeReq is sent by a follower to the node it wants to be the new
+// leader of the skipchain.
+type viewChangeReq struct {
+	SkipchainID skipchain.SkipBlockID
+	// LatestID is the latest block known to the follower. The view-change
+	// only happens if the candidate has the same latest block.
+	LatestID skipchain.SkipBlockID
+	// LeaderIndex is the index of the candidate in the roster of the latest
+	// block.
+	LeaderIndex int
+}
+
+// viewChange holds the state of the leader monitoring and the view-changes
+// for all skipchains of a service.
+type viewChange struct {
+	sync.Mutex
+	// lastSeen is the last time we heard from the leader of a skipchain,
+	// either through a heartbeat or a new block.
+	lastSeen map[string]time.Time
+	// monitors indicates for which skipchains a monitor is running.
+	monitors map[string]bool
+	// requests holds the last view-change request sent by this node for
+	// each skipchain.
+	requests map[string]viewChangeReq
+	// votes is used by the candidate to count the nodes that requested
+	// each view of a skipchain. They are cleared on every new block.
+	votes map[string]map[view]*ballot
+}
+
+// view identifies a view-change: the block it starts from and the index of
+// the candidate in the roster of that block.
+type view struct {
+	latestID    string
+	leaderIndex int
+}
+
+// ballot holds the nodes that requested a view, and whether the candidate
+// already took over for it.
+type ballot struct {
+	voters map[network.ServerIdentityID]bool
+	done   bool
+}
+
+func newViewChange() *viewChange {
+	return &viewChange{
+		lastSeen: make(map[string]time.Time),
+		monitors: make(map[string]bool),
+		requests: make(map[string]viewChangeReq),
+		votes:    make(map[string]map[view]*ballot),
+	}
+}
+
+// seen resets the timer of the leader of the given skipchain.
+func (vc *viewChange) seen(scID skipchain.SkipBlockID) {
+	vc.Lock()
+	defer vc.Unlock()
+	vc.lastSeen[string(scID)] = time.Now()
+	delete(vc.requests, string(scID))
+}
+
+// newBlock resets the timer of the leader of the given skipchain and drops
+// the votes for the views of the previous blocks.
+func (vc *viewChange) newBlock(scID skipchain.SkipBlockID) {
+	vc.seen(scID)
+	vc.Lock()
+	defer vc.Unlock()
+	delete(vc.votes, string(scID))
+}
+
+// since returns how long ago we last heard from the leader of the skipchain.
+func (vc *viewChange) since(scID skipchain.SkipBlockID) time.Duration {
+	vc.Lock()
+	defer vc.Unlock()
+	last, ok := vc.lastSeen[string(scID)]
+	if !ok {
+		last = time.Now()
+		vc.lastSeen[string(scID)] = last
+	}
+	return time.Since(last)
+}
+
+// requested returns true if this node asked for the view-change to the
+// leader with the given index, starting from the block latestID.
+func (vc *viewChange) requested(scID, latestID skipchain.SkipBlockID, idx int) bool {
+	vc.Lock()
+	defer vc.Unlock()
+	req, ok := vc.requests[string(scID)]
+	return ok && req.LatestID.Equal(latestID) && req.LeaderIndex == idx
+}
+
+// vote adds the vote of si for the view-change request. It returns true
+// exactly once per view, as soon as threshold nodes asked for it.
+func (vc *viewChange) vote(req *viewChangeReq, si *network.ServerIdentity, threshold int) bool {
+	vc.Lock()
+	defer vc.Unlock()
+	scID := string(req.SkipchainID)
+	if vc.votes[scID] == nil {
+		vc.votes[scID] = make(map[view]*ballot)
+	}
+	v := view{string(req.LatestID), req.LeaderIndex}
+	b := vc.votes[scID][v]
+	if b == nil {
+		b = &ballot{voters: make(map[network.ServerIdentityID]bool)}
+		vc.votes[scID][v] = b
+	}
+	b.voters[si.ID] = true
+	if b.done || len(b.voters) < threshold {
+		return false
+	}
+	b.done = true
+	return true
+}
+
+// startMonitor starts the monitoring of the leader of the given skipchain,
+// if it is not already running. The monitor sends heartbeats if this node is
+// the leader, else it checks whether the leader is still alive.
+func (s *Service) startMonitor(scID skipchain.SkipBlockID) {
+	s.viewChange.Lock()
+	if s.viewChange.monitors[string(scID)] {
+		s.viewChange.Unlock()
+		return
+	}
+	s.viewChange.monitors[string(scID)] = true
+	s.viewChange.lastSeen[string(scID)] = time.Now()
+	s.viewChange.Unlock()
+
+	go func() {
+		for {
+			interval, err := s.loadBlockInterval(scID)
+			if err != nil {
+				log.Lvl2(s.ServerIdentity(), "couldn't load block interval:", err)
+			}
+			select {
+			case <-time.After(interval):
+			case <-s.CloseQueues:
+				log.Lvlf2("%s: closing monitor of %x", s.ServerIdentity(), scID)
+				return
+			}
+			latest, err := s.db().GetLatest(s.db().GetByID(scID))
+			if err != nil {
+				log.Error("couldn't get latest block:", err)
+				continue
+			}
+			// A node removed from the roster doesn't take part
+			// anymore. The monitor is started again if it is added
+			// back.
+			if i, _ := latest.Roster.Search(s.ServerIdentity().ID); i < 0 {
+				log.Lvlf2("%s: not in the roster of %x anymore, closing monitor", s.ServerIdentity(), scID)
+				s.viewChange.Lock()
+				delete(s.viewChange.monitors, string(scID))
+				s.viewChange.Unlock()
+				return
+			}
+			if latest.Roster.List[0].Equal(s.ServerIdentity()) {
+				s.viewChange.seen(scID)
+				s.sendHeartbeats(latest)
+				continue
+			}
+			s.checkLeader(latest, interval)
+		}
+	}()
+}
+
+// sendHeartbeats tells all followers that the leader is still alive.
+func (s *Service) sendHeartbeats(latest *skipchain.SkipBlock) {
+	hb := &heartbeat{
+		SkipchainID: latest.SkipChainID(),
+		LatestID:    latest.Hash,
+	}
+	for _, si := range latest.Roster.List[1:] {
+		if err := s.SendRaw(si, hb); err != nil {
+			log.Lvl3(s.ServerIdentity(), "couldn't send heartbeat to", si, err)
+		}
+	}
+}
+
+// handleHeartbeat resets the view-change timer if the heartbeat comes from
+// the current leader.
+func (s *Service) handleHeartbeat(env *network.Envelope) {
+	hb, ok := env.Msg.(*heartbeat)
+	if !ok {
+		log.Error("wrong message type")
+		return
+	}
+	latest, err := s.db().GetLatest(s.db().GetByID(hb.SkipchainID))
+	if err != nil {
+		log.Lvl2(s.ServerIdentity(), "heartbeat for unknown skipchain", err)
+		return
+	}
+	if !latest.Roster.List[0].Equal(env.ServerIdentity) {
+		log.Lvl2(s.ServerIdentity(), "ignoring heartbeat from non-leader", env.ServerIdentity)
+		return
+	}
+	s.viewChange.seen(hb.SkipchainID)
+}
+
+// checkLeader requests a view-change if the leader didn't send anything for
+// more than rotationWindow block intervals. If the candidate doesn't take
+// over in time, the next node in the roster is asked.
+func (s *Service) checkLeader(latest *skipchain.SkipBlock, interval time.Duration) {
+	timeout := rotationWindow * interval
+	scID := latest.SkipChainID()
+	silent := s.viewChange.since(scID)
+	if silent < timeout {
+		return
+	}
+	n := len(latest.Roster.List)
+	if n < 2 {
+		return
+	}
+	attempt := int(silent / timeout)
+	req := viewChangeReq{
+		SkipchainID: scID,
+		LatestID:    latest.Hash,
+		LeaderIndex: 1 + (attempt-1)%(n-1),
+	}
+	s.viewChange.Lock()
+	s.viewChange.requests[string(scID)] = req
+	s.viewChange.Unlock()
+
+	candidate := latest.Roster.List[req.LeaderIndex]
+	log.Lvlf2("%s: no news from leader of %x since %s, asking %s to take over",
+		s.ServerIdentity(), scID, silent, candidate)
+	if candidate.Equal(s.ServerIdentity()) {
+		s.handleViewChangeReq(&network.Envelope{
+			ServerIdentity: s.ServerIdentity(),
+			Msg:            &req,
+		})
+		return
+	}
+	if err := s.SendRaw(candidate, &req); err != nil {
+		log.Lvl2(s.ServerIdentity(), "couldn't send view-change request:", err)
+	}
+}
+
+// handleViewChangeReq counts the requests of the followers and takes over
+// the leadership once enough nodes asked for it.
+func (s *Service) handleViewChangeReq(env *network.Envelope) {
+	req, ok := env.Msg.(*viewChangeReq)
+	if !ok {
+		log.Error("wrong message type")
+		return
+	}
+	latest, err := s.db().GetLatest(s.db().GetByID(req.SkipchainID))
+	if err != nil {
+		log.Lvl2(s.ServerIdentity(), "view-change for unknown skipchain", err)
+		return
+	}
+	if !latest.Hash.Equal(req.LatestID) {
+		log.Lvl2(s.ServerIdentity(), "view-change request for an old block")
+		return
+	}
+	if req.LeaderIndex <= 0 || req.LeaderIndex >= len(latest.Roster.List) ||
+		!latest.Roster.List[req.LeaderIndex].Equal(s.ServerIdentity()) {
+		log.Lvl2(s.ServerIdentity(), "view-change request for another leader")
+		return
+	}
+	if i, _ := latest.Roster.Search(env.ServerIdentity.ID); i < 0 {
+		log.Lvl2(s.ServerIdentity(), "view-change request from a node outside of the roster")
+		return
+	}
+	if !s.viewChange.vote(req, env.ServerIdentity, viewChangeThreshold(len(latest.Roster.List))) {
+		return
+	}
+
+	log.Lvlf1("%s: taking over as leader of %x", s.ServerIdentity(), req.SkipchainID)
+	go func() {
+		if _, err := s.createNewBlock(req.SkipchainID, rotateRoster(latest.Roster, req.LeaderIndex), nil); err != nil {
+			log.Error("view-change failed:", err)
+		}
+	}()
+}
+
+// viewChangeThreshold returns how many nodes need to request a view-change
+// before the candidate takes over. It is the same threshold as the one needed
+// to sign the new block.
+func viewChangeThreshold(n int) int {
+	return n - (n-1)/3
+}
+
+// rotateRoster returns a new roster where the node at index idx is the first
+// one, followed by all other nodes in the same order.
+func rotateRoster(r *onet.Roster, idx int) *onet.Roster {
+	list := append([]*network.ServerIdentity{}, r.List[idx:]...)
+	list = append(list, r.List[:idx]...)
+	return onet.NewRoster(list)
+}
+
+// sameRoster returns true if both rosters hold the same nodes in the same
+// order.
+func sameRoster(a, b *onet.Roster) bool {
+	if len(a.List) != len(b.List) {
+		return false
+	}
+	for i := range a.List {
+		if !a.List[i].Equal(b.List[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyViewChange checks that the roster of newSB is a valid rotation of the
+// roster of prev and that this node requested the view-change, or is the new
+// leader itself.
+func (s *Service) verifyViewChange(prev, newSB *skipchain.SkipBlock, body *DataBody) error {
+	if len(body.Transactions) > 0 {
+		return errors.New("view-change block must not contain transactions")
+	}
+	idx, _ := prev.Roster.Search(newSB.Roster.List[0].ID)
+	if idx <= 0 {
+		return errors.New("new leader is not part of the previous roster")
+	}
+	if !sameRoster(rotateRoster(prev.Roster, idx), newSB.Roster) {
+		return errors.New("roster of view-change is not a rotation of the previous roster")
+	}
+	if newSB.Roster.List[0].Equal(s.ServerIdentity()) {
+		return nil
+	}
+	if !s.viewChange.requested(prev.SkipChainID(), prev.Hash, idx) {
+		return errors.New("didn't request a view-change to this leader")
+	}
+	return nil
+}